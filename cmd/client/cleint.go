@@ -2,14 +2,16 @@ package client
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"io"
 	"net"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jdambly/kitter/pkg/netapi"
@@ -19,21 +21,122 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// metricLabels are the labels every probe metric is partitioned by, see ProbeConfig.labelValues.
+// The profile label is the name of the socket profile of the probe, empty without --socket-profile, and the interface
+// label the interface or source address the probe was sent from, empty when the kernel chose it. The family label is
+// ipv4 or ipv6 so the two stacks of a dual-stack service can be compared.
+// The src_ and dst_ labels hold the identity of the client and the server, only the fields selected with
+// --identity-labels are filled in, the others are left empty.
+var metricLabels = []string{"target", "mode", "payload_size", "profile", "interface", "family",
+	"src_pod", "src_namespace", "src_node", "src_zone",
+	"dst_pod", "dst_namespace", "dst_node", "dst_zone"}
+
+// phaseBuckets are the buckets of the histograms timing a single phase of a probe, which can take microseconds.
+var phaseBuckets = prometheus.ExponentialBuckets(1e-5, 4, 10) // 10µs to ~2.6s
+
 var (
 	metricRTT = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "kitter_rtt",
 		Help:    "round trip time",
 		Buckets: prometheus.DefBuckets, // default buckets
-	}, []string{"target"})
+	}, metricLabels)
+	metricNetworkRTT = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kitter_network_rtt",
+		Help:    "round trip time without the server processing time",
+		Buckets: prometheus.DefBuckets,
+	}, metricLabels)
+	metricForwardDelay = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kitter_forward_delay",
+		Help:    "client to server delay corrected for the clock offset",
+		Buckets: prometheus.DefBuckets,
+	}, metricLabels)
+	metricReverseDelay = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kitter_reverse_delay",
+		Help:    "server to client delay corrected for the clock offset",
+		Buckets: prometheus.DefBuckets,
+	}, metricLabels)
+	metricClockOffset = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kitter_clock_offset",
+		Help: "estimated offset of the server clock from the client clock in seconds",
+	}, metricLabels)
+	metricTLSHandshake = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kitter_tls_handshake",
+		Help:    "duration of the TLS handshake",
+		Buckets: prometheus.DefBuckets,
+	}, metricLabels)
+	metricConnect = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kitter_connect",
+		Help:    "time taken to open the connection, the dial of a tcp probe",
+		Buckets: phaseBuckets,
+	}, metricLabels)
+	metricFirstWrite = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kitter_first_write",
+		Help:    "time taken to write a tcp probe to the connection",
+		Buckets: phaseBuckets,
+	}, metricLabels)
+	metricFirstByte = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kitter_first_byte",
+		Help:    "time from sending a probe to the first byte of the response",
+		Buckets: phaseBuckets,
+	}, metricLabels)
+	metricKernelRTT = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kitter_kernel_rtt",
+		Help:    "round trip time between the kernel timestamps of the probe and the reply",
+		Buckets: prometheus.DefBuckets,
+	}, metricLabels)
+	metricAppOverhead = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kitter_app_overhead",
+		Help:    "round trip time spent in the client process rather than the network, the rtt minus the kernel rtt",
+		Buckets: phaseBuckets,
+	}, metricLabels)
+	metricTCPRTT = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kitter_tcp_rtt",
+		Help: "smoothed round trip time the kernel keeps for the probe connection in seconds",
+	}, metricLabels)
+	metricTCPRTTVar = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kitter_tcp_rttvar",
+		Help: "variation of the round trip time the kernel keeps for the probe connection in seconds",
+	}, metricLabels)
+	metricTCPRetransmits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kitter_tcp_retransmits_total",
+		Help: "segments retransmitted on the probe connections",
+	}, metricLabels)
+	metricClose = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kitter_close",
+		Help:    "time taken to close the connection after a probe",
+		Buckets: phaseBuckets,
+	}, metricLabels)
+	metricTWAMPErrorEstimate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kitter_twamp_error_estimate",
+		Help: "sum of the error estimates of the sender and reflector timestamps of the twamp probes in seconds, the accuracy of the one way delays",
+	}, metricLabels)
+	metricForwardLost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kitter_forward_lost_total",
+		Help: "stamp test packets lost on the way to the reflector, counted on the persistent sessions of stateful reflectors",
+	}, metricLabels)
+	metricReverseLost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kitter_reverse_lost_total",
+		Help: "reflected twamp and stamp packets lost on the way back from the reflector, counted on persistent sessions",
+	}, metricLabels)
+	// the handshake label tells resumed 0-RTT connections apart from full 1-RTT handshakes
+	metricQUICHandshake = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kitter_quic_handshake",
+		Help:    "duration of the QUIC handshake",
+		Buckets: prometheus.DefBuckets,
+	}, append(slices.Clone(metricLabels), "handshake"))
 )
 
 // NewCmd
 func NewCmd() *cobra.Command {
 	// create the vars I need to make sure they have the correct scope and are not shadowed
 	var hostName string
-	var port string
+	var probe ProbeConfig
 	var wait time.Duration
 	var httpAddr string
+	var tlsConfig netapi.TLSConfig
+	var profileSpecs []string
+	var sourceAddrs, bindInterfaces []string
+	var stampKeyFile string
 	defaultResolver := &DefaultDNSResolver{}
 	// vars for DNS retry and back off
 	retries := RetryConfig{
@@ -47,16 +150,50 @@ func NewCmd() *cobra.Command {
 		Use:   "client",
 		Short: "start client",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			// Check if the "hostName" flag was set
-			if hostName == "" {
+			var cNames []string
+			var err error
+			// Check if the "hostName" flag was set, a client probing only local sockets does not need it
+			if hostName == "" && len(probe.UnixSockets) == 0 {
 				return errors.New("the --hostName flag is required")
 			}
-			// resolve the hostname with a retry and backoff
-			cNames, err := WaitForDNS(defaultResolver, retries, hostName)
+			if err := validIdentityLabels(probe.IdentityLabels); err != nil {
+				return err
+			}
+			if err := validIPFamily(probe.IPFamily); err != nil {
+				return err
+			}
+			if err := validKernelTimestamps(probe); err != nil {
+				return err
+			}
+			probe.Profiles, err = parseSocketProfiles(profileSpecs)
 			if err != nil {
-				log.Fatal().Err(err).Msg("")
 				return err
 			}
+			probe.Sources, err = sourceBindings(sourceAddrs, bindInterfaces)
+			if err != nil {
+				return err
+			}
+			// TLS is turned on by giving a CA or a client certificate
+			if tlsConfig.CAFile != "" || tlsConfig.CertFile != "" {
+				probe.TLS, err = netapi.NewCertReloader(tlsConfig)
+				if err != nil {
+					return err
+				}
+			}
+			if stampKeyFile != "" {
+				probe.STAMPKey, err = netapi.ReadSTAMPKey(stampKeyFile)
+				if err != nil {
+					return err
+				}
+			}
+			// resolve the hostname with a retry and backoff
+			if hostName != "" {
+				cNames, err = WaitForDNS(defaultResolver, retries, hostName)
+				if err != nil {
+					log.Fatal().Err(err).Msg("")
+					return err
+				}
+			}
 			log.Debug().Strs("cnames", cNames).Msg("")
 
 			registry, ok := prometheus.DefaultRegisterer.(*prometheus.Registry)
@@ -83,6 +220,13 @@ func NewCmd() *cobra.Command {
 				}
 			}()
 
+			// in persistent mode the connections are kept across rounds
+			var pool *connPool
+			if probe.Persistent {
+				pool = newConnPool()
+				defer pool.closeAll()
+			}
+
 			ticker := time.NewTimer(0)
 			dTicker := time.NewTicker(30)
 			for {
@@ -99,9 +243,12 @@ func NewCmd() *cobra.Command {
 
 					return nil
 				case <-ticker.C:
-					ConnectToMultipleServers(cNames, port)
+					ConnectToMultipleServers(cNames, probe, pool)
 					ticker.Reset(wait)
 				case <-dTicker.C:
+					if hostName == "" {
+						continue
+					}
 					newNames, err := ResolveHostname(defaultResolver, hostName)
 					if err == nil {
 						cNames = newNames
@@ -113,40 +260,141 @@ func NewCmd() *cobra.Command {
 
 	// Add the "host" flag to the "client" command.
 	cmd.Flags().StringVarP(&hostName, "hostName", "s", "", "Host to connect to")
-	cmd.Flags().StringVarP(&port, "port", "p", "5102", "Port to connect to")
+	cmd.Flags().StringVarP(&probe.Port, "port", "p", "5102", "Port to connect to")
+	cmd.Flags().StringVar(&probe.Protocol, "protocol", "tcp", "Protocol used to probe the servers (tcp, udp, http, grpc, quic, or twamp and stamp for TWAMP-Light and STAMP reflectors, usually on port 862)")
+	cmd.Flags().StringVar(&probe.HTTPVersion, "http-version", netapi.HTTP1, "HTTP version of the http probes: 1.1, h2c for HTTP/2 without TLS, or h2 for HTTP/2 over TLS")
+	cmd.Flags().BoolVar(&probe.KernelTimestamps, "kernel-timestamps", false, "Measure the RTT of udp probes with kernel timestamps as well and export the application overhead, Linux only and requires --protocol udp with --wire binary")
+	cmd.Flags().BoolVar(&probe.GRPCStream, "grpc-stream", false, "Send the grpc probes on one bidirectional stream per connection instead of unary RPCs")
+	cmd.Flags().StringArrayVar(&profileSpecs, "socket-profile", nil, "Named socket options every server is probed with side by side, as in ef:dscp=46,priority=6,mark=0x10,nodelay=false,congestion=bbr, can be repeated")
+	cmd.Flags().StringVar(&probe.IPFamily, "ip-family", FamilyBoth, "Address family of the servers to probe: v4, v6 or both to compare the two stacks of a dual-stack service")
+	cmd.Flags().StringArrayVar(&sourceAddrs, "source-addr", nil, "Local address the probes are sent from, every server is probed from each one, can be repeated")
+	cmd.Flags().StringArrayVar(&bindInterfaces, "bind-interface", nil, "Interface the probes are sent over with SO_BINDTODEVICE, every server is probed over each one, can be repeated and is paired with --source-addr by position, Linux only")
+	cmd.Flags().StringArrayVar(&probe.UnixSockets, "unix-socket", nil, "Unix domain socket to probe every poll as a baseline without the network, @name for the abstract namespace, can be repeated")
+	cmd.Flags().StringVar(&probe.Wire, "wire", netapi.WireBinary, "Wire format offered to the servers (binary or text), servers that only speak text are detected automatically")
+	cmd.Flags().IntVar(&probe.PayloadSize, "payload-size", 0, "Number of padding bytes sent with every probe, use it to probe with MTU sized packets")
+	cmd.Flags().IntVar(&probe.ReplySize, "reply-payload-size", 0, "Number of padding bytes the binary replies must carry when the servers run with --payload-size, 0 expects the probe payload to be echoed")
+	cmd.Flags().BoolVar(&probe.Persistent, "persistent", false, "Keep one connection per server open across polls instead of dialing for every probe")
 	cmd.Flags().DurationVarP(&wait, "wait", "w", 1*time.Second, "Time in seconds to wait between polls")
 	cmd.Flags().StringVar(&httpAddr, "http-addr", ":8080", "interface:port to bind the http hostName to")
+	cmd.Flags().StringVar(&tlsConfig.CAFile, "tls-ca", "", "CA bundle used to verify the servers, turns on TLS")
+	cmd.Flags().StringVar(&tlsConfig.CertFile, "tls-cert", "", "client certificate presented to the servers for mutual TLS, turns on TLS")
+	cmd.Flags().StringVar(&tlsConfig.KeyFile, "tls-key", "", "key of the client certificate")
+	cmd.Flags().StringVar(&stampKeyFile, "stamp-key-file", "", "file holding the key the stamp probes are authenticated with, the unauthenticated mode is used without it")
+	cmd.Flags().StringVar(&tlsConfig.ServerName, "tls-server-name", "", "name the server certificates are verified against, defaults to the address being probed")
+	env := netapi.IdentityFromEnv()
+	cmd.Flags().StringVar(&probe.Identity.Pod, "pod-name", env.Pod, "name of the pod the client runs in, defaults to $"+netapi.EnvPodName)
+	cmd.Flags().StringVar(&probe.Identity.Namespace, "pod-namespace", env.Namespace, "namespace of the pod the client runs in, defaults to $"+netapi.EnvPodNamespace)
+	cmd.Flags().StringVar(&probe.Identity.Node, "node-name", env.Node, "node the client runs on, defaults to $"+netapi.EnvNodeName)
+	cmd.Flags().StringVar(&probe.Identity.Zone, "zone", env.Zone, "zone of the node the client runs on, defaults to $"+netapi.EnvZone)
+	cmd.Flags().StringSliceVar(&probe.IdentityLabels, "identity-labels", []string{"node", "zone"}, "identity fields of the client and server added to the metric labels: pod, namespace, node and zone")
 
 	// Return the new command.
 	return cmd
 }
 
-// connectToServer
-func connectToServer(addr string, data string) (string, error) {
-	log.Debug().Str("addr", addr).Msg("connection to hose")
-	client := netapi.NewClient(addr)
-	err := client.Connect()
+// newClient creates a netapi.Client for target using the probe settings.
+func newClient(probe ProbeConfig, target Target) (netapi.Client, error) {
+	opts := []netapi.ClientOption{
+		netapi.WithWire(probe.Wire),
+		netapi.WithPayloadSize(probe.PayloadSize),
+		netapi.WithReplySize(probe.ReplySize),
+		netapi.WithIdentity(probe.Identity),
+		netapi.WithHTTPVersion(probe.HTTPVersion),
+		netapi.WithGRPCStream(probe.GRPCStream),
+		netapi.WithSocketOptions(target.Profile.Options),
+		netapi.WithSource(target.Source),
+	}
+	// unix sockets are local to the pod and are never probed with TLS
+	if probe.TLS != nil && target.Protocol != "unix" {
+		opts = append(opts, netapi.WithTLS(probe.TLS))
+	}
+	if probe.STAMPKey != nil && target.Protocol == "stamp" {
+		opts = append(opts, netapi.WithSTAMPKey(probe.STAMPKey))
+	}
+	if probe.KernelTimestamps && target.Protocol == "udp" {
+		opts = append(opts, netapi.WithKernelTimestamps(true))
+	}
+	return netapi.NewClient(target.Protocol, target.Addr, opts...)
+}
+
+// connectToServer probes target on a new connection and closes it, the time spent closing it is part of the Response.
+func connectToServer(probe ProbeConfig, target Target) (netapi.Response, error) {
+	addr := target.Addr
+	log.Debug().Str("addr", addr).Str("protocol", target.Protocol).Msg("connection to hose")
+	client, err := newClient(probe, target)
+	if err != nil {
+		return netapi.Response{}, err
+	}
+	err = client.Connect()
 	if err != nil {
-		return "", fmt.Errorf("failed to connect to %s: %w", addr, err)
+		return netapi.Response{}, fmt.Errorf("failed to connect to %s: %w", addr, err)
 	}
-	defer client.Close()
 
-	response, err := client.SendData(data)
+	response, err := client.Probe()
 	if err != nil {
-		return "", fmt.Errorf("failed to send data to %s: %w", addr, err)
+		_ = client.Close()
+		return netapi.Response{}, fmt.Errorf("failed to send data to %s: %w", addr, err)
 	}
 
+	start := time.Now()
+	if err := client.Close(); err != nil {
+		log.Debug().Str("addr", addr).Err(err).Msg("failed to close connection")
+	} else {
+		response.Close = time.Since(start).Seconds()
+	}
 	return response, nil
 }
 
-// ConnectToMultipleServers
-func ConnectToMultipleServers(addresses []string, port string) {
-	ch := make(chan string, len(addresses)) // Buffered channel to collect responses
+// sendOnPooledConnection sends a probe over the pooled connection to target.
+// A failed exchange drops the connection so that the next round reconnects. When the server closed the pooled
+// connection, for example because its pod is being terminated, the probe is retried once on a new connection.
+func sendOnPooledConnection(pool *connPool, probe ProbeConfig, target Target) (netapi.Response, error) {
+	log.Debug().Str("addr", target.Addr).Str("protocol", target.Protocol).Msg("reusing connection to host")
+	for attempt := 0; ; attempt++ {
+		client, err := pool.get(probe, target)
+		if err != nil {
+			return netapi.Response{}, err
+		}
+
+		response, err := client.Probe()
+		if err == nil {
+			return response, nil
+		}
+		pool.drop(target)
+		if attempt > 0 || !isConnectionClosed(err) {
+			return netapi.Response{}, fmt.Errorf("failed to send data to %s: %w", target.Addr, err)
+		}
+		log.Debug().Str("addr", target.Addr).Err(err).Msg("pooled connection was closed by the server, reconnecting")
+	}
+}
+
+// isConnectionClosed reports whether err means the peer closed the connection rather than the probe failing.
+func isConnectionClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// probeResult is the Response to the probe of a target.
+type probeResult struct {
+	target Target
+	resp   netapi.Response
+}
+
+// ConnectToMultipleServers probes every address and every local unix socket once.
+// When pool is not nil the connections are reused.
+func ConnectToMultipleServers(addresses []string, probe ProbeConfig, pool *connPool) {
+	targets := probe.targets(addresses)
+	ch := make(chan probeResult, len(targets)) // Buffered channel to collect responses
+	done := make(chan struct{})
+
+	if pool != nil {
+		pool.prune(targets)
+	}
 
 	// Collect responses from all goroutines
 	go func() {
+		defer close(done)
 		for msg := range ch { // range over the channels (this is a good pattern)
-			err := ProcessResponse(msg)
+			err := ProcessResponse(msg.resp, probe, msg.target)
 			if err != nil {
 				log.Error().Err(err).Msg("processing response")
 			}
@@ -154,21 +402,28 @@ func ConnectToMultipleServers(addresses []string, port string) {
 	}()
 
 	var wg sync.WaitGroup
-	for _, addr := range addresses {
+	for _, target := range targets {
 		// Start a goroutine for each server connection
 		wg.Add(1)
-		go func(addr string) {
+		go func(target Target) {
 			defer wg.Done()
-			resp, err := connectToServer(addr+":"+port, time.Now().Format(time.RFC3339Nano))
+			var resp netapi.Response
+			var err error
+			if pool != nil {
+				resp, err = sendOnPooledConnection(pool, probe, target)
+			} else {
+				resp, err = connectToServer(probe, target)
+			}
 			if err != nil {
-				log.Error().Str("addr", addr+":"+port).Err(err).Msg("")
+				log.Error().Str("addr", target.Addr).Err(err).Msg("")
 				return
 			}
-			ch <- resp
-		}(addr)
+			ch <- probeResult{target: target, resp: resp}
+		}(target)
 	}
 	wg.Wait() // wait for all the channels to do a thing and finish
 	close(ch)
+	<-done // wait for all the responses to be processed
 }
 
 // ResolveHostname resolves a given hostname to its IP addresses.
@@ -193,28 +448,96 @@ func ResolveHostname(resolver DNSResolver, hostname string) ([]string, error) {
 	return ips, nil
 }
 
-// ProcessResponse take the response from the server and calculates the RRT latency
-func ProcessResponse(data string) error {
-	dStamp := time.Now()
-	var resp netapi.Response
-	err := json.Unmarshal([]byte(data), &resp)
+// ProcessResponse take the response from the server and calculates the RRT latency.
+// The metrics are labeled with the settings of the probe and the target it was sent to.
+func ProcessResponse(resp netapi.Response, probe ProbeConfig, target Target) error {
+	cStamp, err := time.Parse(time.RFC3339Nano, resp.ClientTime)
 	if err != nil {
 		return err
 	}
-	resp.ClientDone = dStamp.Format(time.RFC3339Nano)
-	cStamp, err := time.Parse(time.RFC3339Nano, resp.ClientTime)
+	dStamp, err := time.Parse(time.RFC3339Nano, resp.ClientDone)
 	if err != nil {
 		return err
 	}
 
 	rtt := dStamp.Sub(cStamp)
 	resp.RTT = rtt.Seconds()
-	metricRTT.WithLabelValues(resp.Server).Observe(resp.RTT)
+	metricRTT.WithLabelValues(probe.labelValues(target, resp)...).Observe(resp.RTT)
+	if resp.TLSHandshake > 0 {
+		metricTLSHandshake.WithLabelValues(probe.labelValues(target, resp)...).Observe(resp.TLSHandshake)
+	}
+	if resp.Connect > 0 {
+		metricConnect.WithLabelValues(probe.labelValues(target, resp)...).Observe(resp.Connect)
+	}
+	if resp.FirstWrite > 0 {
+		metricFirstWrite.WithLabelValues(probe.labelValues(target, resp)...).Observe(resp.FirstWrite)
+	}
+	if resp.FirstByte > 0 {
+		metricFirstByte.WithLabelValues(probe.labelValues(target, resp)...).Observe(resp.FirstByte)
+	}
+	if resp.KernelRTT > 0 {
+		metricKernelRTT.WithLabelValues(probe.labelValues(target, resp)...).Observe(resp.KernelRTT)
+		// scheduling delays and GC pauses of the client, never negative as the kernel sees the packets first
+		metricAppOverhead.WithLabelValues(probe.labelValues(target, resp)...).Observe(max(resp.RTT-resp.KernelRTT, 0))
+	}
+	if resp.TCPInfo != nil {
+		metricTCPRTT.WithLabelValues(probe.labelValues(target, resp)...).Set(resp.TCPInfo.RTT)
+		metricTCPRTTVar.WithLabelValues(probe.labelValues(target, resp)...).Set(resp.TCPInfo.RTTVar)
+		metricTCPRetransmits.WithLabelValues(probe.labelValues(target, resp)...).Add(float64(resp.TCPInfo.Retransmits))
+	}
+	if resp.TWAMP != nil {
+		metricTWAMPErrorEstimate.WithLabelValues(probe.labelValues(target, resp)...).Set(resp.TWAMP.SenderError + resp.TWAMP.ReflectorError)
+		metricForwardLost.WithLabelValues(probe.labelValues(target, resp)...).Add(float64(resp.TWAMP.ForwardLost))
+		metricReverseLost.WithLabelValues(probe.labelValues(target, resp)...).Add(float64(resp.TWAMP.ReverseLost))
+	}
+	if resp.Close > 0 {
+		metricClose.WithLabelValues(probe.labelValues(target, resp)...).Observe(resp.Close)
+	}
+	if resp.QUICHandshake > 0 {
+		handshake := "1rtt"
+		if resp.ZeroRTT {
+			handshake = "0rtt"
+		}
+		metricQUICHandshake.WithLabelValues(append(probe.labelValues(target, resp), handshake)...).Observe(resp.QUICHandshake)
+	}
+
+	// servers that only record when they received the probe can not be used for the four timestamp calculation
+	if resp.ServerSendTime != "" {
+		err = calculateClockOffset(&resp, cStamp, dStamp)
+		if err != nil {
+			return err
+		}
+		metricNetworkRTT.WithLabelValues(probe.labelValues(target, resp)...).Observe(resp.NetworkRTT)
+		metricForwardDelay.WithLabelValues(probe.labelValues(target, resp)...).Observe(resp.ForwardDelay)
+		metricReverseDelay.WithLabelValues(probe.labelValues(target, resp)...).Observe(resp.ReverseDelay)
+		metricClockOffset.WithLabelValues(probe.labelValues(target, resp)...).Set(resp.ClockOffset)
+	}
 	log.Info().Any("resp", resp).Msg("")
 
 	return nil
 }
 
+// calculateClockOffset does the NTP style calculation with the four timestamps of a probe:
+// t1 the client sent the probe, t2 the server received it, t3 the server replied and t4 the client received the reply.
+// The one way delays assume the path is symmetric, the same assumption NTP makes to estimate the offset.
+func calculateClockOffset(resp *netapi.Response, t1, t4 time.Time) error {
+	t2, err := time.Parse(time.RFC3339Nano, resp.ServerTime)
+	if err != nil {
+		return err
+	}
+	t3, err := time.Parse(time.RFC3339Nano, resp.ServerSendTime)
+	if err != nil {
+		return err
+	}
+
+	offset := (t2.Sub(t1) + t3.Sub(t4)) / 2
+	resp.ClockOffset = offset.Seconds()
+	resp.NetworkRTT = (t4.Sub(t1) - t3.Sub(t2)).Seconds()
+	resp.ForwardDelay = (t2.Sub(t1) - offset).Seconds()
+	resp.ReverseDelay = (t4.Sub(t3) + offset).Seconds()
+	return nil
+}
+
 // WaitForDNS this function trys to resolve a host name and then retries with a back off and then fails if it doesn't get a reponse
 func WaitForDNS(resolver DNSResolver, retry RetryConfig, hostName string) ([]string, error) {
 	var cNames []string
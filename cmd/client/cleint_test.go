@@ -1,10 +1,11 @@
 package client
 
 import (
-	"encoding/json"
 	"errors"
 	"github.com/jdambly/kitter/pkg/netapi"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/netip"
 	"testing"
 	"time"
 )
@@ -102,9 +103,197 @@ func TestProcessResponse(t *testing.T) {
 	resp := netapi.Response{
 		ServerTime: time.Now().Add(-5 * time.Millisecond).Format(time.RFC3339Nano),
 		ClientTime: time.Now().Format(time.RFC3339Nano),
+		ClientDone: time.Now().Add(time.Millisecond).Format(time.RFC3339Nano),
 	}
-	data, _ := json.Marshal(resp)
 
-	err := ProcessResponse(string(data))
+	err := ProcessResponse(resp, ProbeConfig{}, Target{})
 	assert.NoError(t, err)
+
+	// a response without the receive time can not be used to calculate the RTT
+	resp.ClientDone = ""
+	assert.Error(t, ProcessResponse(resp, ProbeConfig{}, Target{}))
+}
+
+func TestCalculateClockOffset(t *testing.T) {
+	// the server clock is 100ms ahead, each direction takes 2ms and the server spends 1ms on the probe
+	t1 := time.Now()
+	t2 := t1.Add(102 * time.Millisecond)
+	t3 := t2.Add(time.Millisecond)
+	t4 := t1.Add(5 * time.Millisecond)
+	resp := netapi.Response{
+		ServerTime:     t2.Format(time.RFC3339Nano),
+		ServerSendTime: t3.Format(time.RFC3339Nano),
+	}
+
+	err := calculateClockOffset(&resp, t1, t4)
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.1, resp.ClockOffset, 1e-9)
+	assert.InDelta(t, 0.004, resp.NetworkRTT, 1e-9)
+	assert.InDelta(t, 0.002, resp.ForwardDelay, 1e-9)
+	assert.InDelta(t, 0.002, resp.ReverseDelay, 1e-9)
+}
+
+func TestLabelValues(t *testing.T) {
+	probe := ProbeConfig{PayloadSize: 10, IdentityLabels: []string{"node", "zone"}}
+	resp := netapi.Response{
+		Server:         "10.0.0.1:5102",
+		ClientIdentity: &netapi.Identity{Pod: "client-0", Node: "node-1", Zone: "zone-a"},
+		ServerIdentity: &netapi.Identity{Pod: "server-0", Node: "node-2", Zone: "zone-b"},
+	}
+	target := Target{Addr: "10.0.0.1:5102", Profile: SocketProfile{Name: "ef"}, Source: netapi.SourceBinding{Interface: "net1"}}
+	values := probe.labelValues(target, resp)
+	assert.Len(t, values, len(metricLabels))
+	assert.Equal(t, []string{"10.0.0.1:5102", "fresh", "10", "ef", "net1", "ipv4",
+		"", "", "node-1", "zone-a",
+		"", "", "node-2", "zone-b"}, values)
+
+	// servers that do not announce an identity leave the dst labels empty
+	resp.ServerIdentity = nil
+	assert.Equal(t, []string{"", "", "", ""}, probe.labelValues(target, resp)[10:])
+
+	assert.NoError(t, validIdentityLabels([]string{"pod", "namespace"}))
+	assert.Error(t, validIdentityLabels([]string{"ip"}))
+}
+
+func TestSocketProfiles(t *testing.T) {
+	profiles, err := parseSocketProfiles([]string{"ef:dscp=46,priority=6", "bulk:dscp=8,nodelay=false", "default"})
+	require.NoError(t, err)
+	assert.Equal(t, []SocketProfile{
+		{Name: "ef", Options: netapi.SocketOptions{DSCP: 46, Priority: 6}},
+		{Name: "bulk", Options: netapi.SocketOptions{DSCP: 8, Nagle: true}},
+		{Name: "default"},
+	}, profiles)
+
+	// every server is probed with every profile, the unix sockets only once
+	probe := ProbeConfig{Protocol: "tcp", Port: "5102", Profiles: profiles[:2], UnixSockets: []string{"/tmp/kitter.sock"}}
+	assert.Equal(t, []Target{
+		{Protocol: "tcp", Addr: "10.0.0.1:5102", Profile: profiles[0]},
+		{Protocol: "tcp", Addr: "10.0.0.2:5102", Profile: profiles[0]},
+		{Protocol: "tcp", Addr: "10.0.0.1:5102", Profile: profiles[1]},
+		{Protocol: "tcp", Addr: "10.0.0.2:5102", Profile: profiles[1]},
+		{Protocol: "unix", Addr: "/tmp/kitter.sock"},
+	}, probe.targets([]string{"10.0.0.1", "10.0.0.2"}))
+
+	for _, specs := range [][]string{{":dscp=46"}, {"ef:dscp=99"}, {"ef:dscp=46", "ef:dscp=10"}} {
+		_, err := parseSocketProfiles(specs)
+		assert.Error(t, err, specs)
+	}
+}
+
+func TestSourceBindings(t *testing.T) {
+	net1 := netapi.SourceBinding{Addr: netip.MustParseAddr("10.1.0.5"), Interface: "net1"}
+	net2 := netapi.SourceBinding{Addr: netip.MustParseAddr("10.2.0.5"), Interface: "net2"}
+	bindings, err := sourceBindings([]string{"10.1.0.5", "10.2.0.5"}, []string{"net1", "net2"})
+	require.NoError(t, err)
+	assert.Equal(t, []netapi.SourceBinding{net1, net2}, bindings)
+
+	// an address alone is labeled with the address
+	bindings, err = sourceBindings([]string{"10.1.0.5"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "10.1.0.5", bindings[0].String())
+
+	// every server is probed over every binding
+	probe := ProbeConfig{Protocol: "udp", Port: "5102", Sources: []netapi.SourceBinding{net1, net2}}
+	assert.Equal(t, []Target{
+		{Protocol: "udp", Addr: "10.0.0.1:5102", Source: net1},
+		{Protocol: "udp", Addr: "10.0.0.1:5102", Source: net2},
+	}, probe.targets([]string{"10.0.0.1"}))
+
+	_, err = sourceBindings([]string{"10.1.0.5"}, []string{"net1", "net2"})
+	assert.Error(t, err)
+	_, err = sourceBindings([]string{"net1"}, nil)
+	assert.Error(t, err)
+}
+
+func TestIPFamily(t *testing.T) {
+	addresses := []string{"10.0.0.1", "fd00::1", "fe80::1%eth0"}
+	probe := ProbeConfig{Protocol: "tcp", Port: "5102"}
+	targets := probe.targets(addresses)
+	assert.Equal(t, []Target{
+		{Protocol: "tcp", Addr: "10.0.0.1:5102"},
+		{Protocol: "tcp", Addr: "[fd00::1]:5102"},
+		{Protocol: "tcp", Addr: "[fe80::1%eth0]:5102"},
+	}, targets)
+	assert.Equal(t, "ipv4", targets[0].family())
+	assert.Equal(t, "ipv6", targets[2].family())
+	assert.Empty(t, Target{Protocol: "unix", Addr: "/tmp/kitter.sock"}.family())
+
+	probe.IPFamily = FamilyV6
+	assert.Len(t, probe.targets(addresses), 2)
+	probe.IPFamily = FamilyV4
+	assert.Equal(t, []Target{{Protocol: "tcp", Addr: "10.0.0.1:5102"}}, probe.targets(addresses))
+
+	// source addresses are only used for the servers of their family
+	probe.IPFamily = FamilyBoth
+	probe.Sources = []netapi.SourceBinding{{Addr: netip.MustParseAddr("fd00::2")}}
+	assert.Len(t, probe.targets(addresses), 2)
+
+	assert.NoError(t, validIPFamily(FamilyBoth))
+	assert.Error(t, validIPFamily("v5"))
+}
+
+func TestValidKernelTimestamps(t *testing.T) {
+	assert.NoError(t, validKernelTimestamps(ProbeConfig{Protocol: "tcp", Wire: netapi.WireText}))
+	assert.NoError(t, validKernelTimestamps(ProbeConfig{Protocol: "udp", Wire: netapi.WireBinary, KernelTimestamps: true}))
+	assert.Error(t, validKernelTimestamps(ProbeConfig{Protocol: "udp", Wire: netapi.WireText, KernelTimestamps: true}))
+	assert.Error(t, validKernelTimestamps(ProbeConfig{Protocol: "quic", Wire: netapi.WireBinary, KernelTimestamps: true}))
+}
+
+// stubClient is a netapi.Client that is never used to probe.
+type stubClient struct {
+	netapi.Client
+	closed bool
+}
+
+func (c *stubClient) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestConnPoolSlowTarget(t *testing.T) {
+	slow := Target{Protocol: "tcp", Addr: "10.0.0.1:5102"}
+	fast := Target{Protocol: "tcp", Addr: "10.0.0.2:5102"}
+	dialing, release := make(chan struct{}), make(chan struct{})
+	dialed := &stubClient{}
+	pool := newConnPool()
+	pool.dial = func(_ ProbeConfig, target Target) (netapi.Client, error) {
+		if target == slow {
+			close(dialing)
+			<-release
+			return dialed, nil
+		}
+		return &stubClient{}, nil
+	}
+
+	slowDone := make(chan netapi.Client)
+	go func() {
+		client, _ := pool.get(ProbeConfig{}, slow)
+		slowDone <- client
+	}()
+	<-dialing
+
+	// the other targets connect while the slow one is still dialing
+	done := make(chan struct{})
+	go func() {
+		_, err := pool.get(ProbeConfig{}, fast)
+		assert.NoError(t, err)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a target was held up by the slow one")
+	}
+
+	// a second dial of the slow target racing the first keeps the first connection
+	first := &stubClient{}
+	pool.mu.Lock()
+	pool.clients[slow] = first
+	pool.mu.Unlock()
+	close(release)
+	assert.Same(t, first, <-slowDone)
+	assert.True(t, dialed.closed, "the connection that lost the race is closed")
+	client, err := pool.get(ProbeConfig{}, slow)
+	require.NoError(t, err)
+	assert.Same(t, first, client)
 }
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jdambly/kitter/pkg/netapi"
+)
+
+// connPool keeps one long-lived connection per target so persistent probes do not pay for a new handshake every round.
+type connPool struct {
+	mu      sync.Mutex
+	clients map[Target]netapi.Client
+
+	// dial opens a new connection to target, it is called without holding mu.
+	dial func(probe ProbeConfig, target Target) (netapi.Client, error)
+}
+
+// newConnPool creates an empty connPool.
+func newConnPool() *connPool {
+	return &connPool{
+		clients: make(map[Target]netapi.Client),
+		dial:    dialClient,
+	}
+}
+
+// dialClient creates a client for target and connects it.
+func dialClient(probe ProbeConfig, target Target) (netapi.Client, error) {
+	client, err := newClient(probe, target)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Connect(); err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", target.Addr, err)
+	}
+	return client, nil
+}
+
+// get returns the open connection for target, dialing a new one if there is none.
+// The pool is not locked while dialing, so a target that does not answer does not hold up the connections to the
+// others. When two probes of the same target dial at once the first connection is kept and the other one closed.
+func (p *connPool) get(probe ProbeConfig, target Target) (netapi.Client, error) {
+	p.mu.Lock()
+	client, ok := p.clients[target]
+	p.mu.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	client, err := p.dial(probe, target)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if existing, ok := p.clients[target]; ok {
+		_ = client.Close()
+		return existing, nil
+	}
+	p.clients[target] = client
+	return client, nil
+}
+
+// drop closes the connection for target and removes it from the pool so the next get reconnects.
+func (p *connPool) drop(target Target) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if client, ok := p.clients[target]; ok {
+		_ = client.Close()
+		delete(p.clients, target)
+	}
+}
+
+// prune closes the connections to targets that are no longer probed, for example after a DNS change.
+func (p *connPool) prune(targets []Target) {
+	keep := make(map[Target]struct{}, len(targets))
+	for _, target := range targets {
+		keep[target] = struct{}{}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for target, client := range p.clients {
+		if _, ok := keep[target]; !ok {
+			_ = client.Close()
+			delete(p.clients, target)
+		}
+	}
+}
+
+// closeAll closes every connection in the pool.
+func (p *connPool) closeAll() {
+	p.prune(nil)
+}
@@ -1,8 +1,16 @@
 package client
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/jdambly/kitter/pkg/netapi"
 )
 
 type DNSResolver interface {
@@ -20,3 +28,220 @@ type RetryConfig struct {
 	initialWaitTime time.Duration // initial wait time before retry
 	factor          int           // factor by which wait time increases
 }
+
+// ProbeConfig holds the settings used to probe every target in a round.
+type ProbeConfig struct {
+	Port        string   // port the servers listen on
+	Protocol    string   // transport used for the probes, tcp, udp, http, grpc, quic, twamp or stamp
+	HTTPVersion string   // HTTP version of the http probes, 1.1, h2c or h2
+	GRPCStream  bool     // send the grpc probes on a stream instead of unary RPCs
+	Wire        string   // wire format offered to the servers, binary or text
+	Persistent  bool     // reuse one connection per target across rounds
+	PayloadSize int      // number of padding bytes sent with every probe
+	ReplySize   int      // number of padding bytes the binary replies carry, PayloadSize when 0
+	UnixSockets []string // local unix sockets probed every round as a baseline without the network
+
+	TLS      *netapi.CertReloader // secures the probes with TLS when set
+	STAMPKey []byte               // authenticates the stamp probes when set
+
+	KernelTimestamps bool // measure the RTT of udp probes with kernel timestamps as well
+
+	Profiles []SocketProfile        // socket options every target is probed with side by side, none probes with the defaults
+	Sources  []netapi.SourceBinding // local addresses and interfaces every target is probed from, none lets the kernel choose
+	IPFamily string                 // address family of the servers probed, v4, v6 or both
+
+	Identity       netapi.Identity // where the client runs, sent to the servers
+	IdentityLabels []string        // identity fields used as metric labels: pod, namespace, node or zone
+}
+
+// SocketProfile is a named set of socket options the probes are sent with, the name is the profile metric label.
+type SocketProfile struct {
+	Name    string
+	Options netapi.SocketOptions
+}
+
+// parseSocketProfile parses a profile given as name:options, as in ef:dscp=46,priority=6.
+func parseSocketProfile(spec string) (SocketProfile, error) {
+	name, options, _ := strings.Cut(spec, ":")
+	if name == "" {
+		return SocketProfile{}, fmt.Errorf("invalid socket profile %q, use name:options", spec)
+	}
+	parsed, err := netapi.ParseSocketOptions(options)
+	if err != nil {
+		return SocketProfile{}, fmt.Errorf("socket profile %s: %w", name, err)
+	}
+	return SocketProfile{Name: name, Options: parsed}, nil
+}
+
+// parseSocketProfiles parses every profile spec, the names must be unique as they tell the metrics apart.
+func parseSocketProfiles(specs []string) ([]SocketProfile, error) {
+	profiles := make([]SocketProfile, 0, len(specs))
+	for _, spec := range specs {
+		profile, err := parseSocketProfile(spec)
+		if err != nil {
+			return nil, err
+		}
+		if slices.ContainsFunc(profiles, func(p SocketProfile) bool { return p.Name == profile.Name }) {
+			return nil, fmt.Errorf("duplicate socket profile %s", profile.Name)
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+// sourceBindings returns the bindings of the --source-addr and --bind-interface flags. Each address or interface
+// is a binding of its own, when both are given they are paired by position and must be as many.
+func sourceBindings(addrs, interfaces []string) ([]netapi.SourceBinding, error) {
+	if len(addrs) > 0 && len(interfaces) > 0 && len(addrs) != len(interfaces) {
+		return nil, errors.New("--source-addr and --bind-interface are paired and must be given as many times")
+	}
+	bindings := make([]netapi.SourceBinding, max(len(addrs), len(interfaces)))
+	for i, addr := range addrs {
+		ip, err := netip.ParseAddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source address: %w", err)
+		}
+		bindings[i].Addr = ip
+	}
+	for i, name := range interfaces {
+		bindings[i].Interface = name
+	}
+	return bindings, nil
+}
+
+// Target is a single endpoint probed every round.
+type Target struct {
+	Protocol string               // tcp, udp, http, grpc, quic, twamp, stamp or unix
+	Addr     string               // host:port, or the socket path for unix
+	Profile  SocketProfile        // socket options the probes are sent with
+	Source   netapi.SourceBinding // local address and interface the probes are sent from
+}
+
+// IP families selected with --ip-family.
+const (
+	FamilyV4   = "v4"
+	FamilyV6   = "v6"
+	FamilyBoth = "both"
+)
+
+// validIPFamily checks that family is one of the IP families.
+func validIPFamily(family string) error {
+	switch family {
+	case FamilyV4, FamilyV6, FamilyBoth:
+		return nil
+	}
+	return fmt.Errorf("invalid IP family %q, use v4, v6 or both", family)
+}
+
+// validKernelTimestamps checks that the probes can be timestamped by the kernel when --kernel-timestamps is set,
+// only binary udp probes are.
+func validKernelTimestamps(probe ProbeConfig) error {
+	if probe.KernelTimestamps && (probe.Protocol != "udp" || probe.Wire != netapi.WireBinary) {
+		return errors.New("--kernel-timestamps is only supported with --protocol udp and --wire binary")
+	}
+	return nil
+}
+
+// addrFamily returns the family of ip, v4 for IPv4 addresses mapped into IPv6.
+func addrFamily(ip netip.Addr) string {
+	if ip.Unmap().Is4() {
+		return FamilyV4
+	}
+	return FamilyV6
+}
+
+// wantFamily reports whether addresses of family are probed, every family is when IPFamily is not set.
+func (p ProbeConfig) wantFamily(family string) bool {
+	return p.IPFamily == "" || p.IPFamily == FamilyBoth || p.IPFamily == family
+}
+
+// targets returns the endpoints to probe: every resolved address of the selected families on the configured port
+// and protocol once per socket profile and source binding, followed by the local unix sockets, which have neither.
+// Source addresses are only used for servers of their own family.
+func (p ProbeConfig) targets(addresses []string) []Target {
+	profiles := p.Profiles
+	if len(profiles) == 0 {
+		profiles = []SocketProfile{{}}
+	}
+	sources := p.Sources
+	if len(sources) == 0 {
+		sources = []netapi.SourceBinding{{}}
+	}
+	targets := make([]Target, 0, len(addresses)*len(profiles)*len(sources)+len(p.UnixSockets))
+	for _, source := range sources {
+		for _, profile := range profiles {
+			for _, addr := range addresses {
+				// the addresses come from LookupHost, link-local IPv6 addresses keep their zone
+				ip, err := netip.ParseAddr(addr)
+				if err == nil && !p.wantFamily(addrFamily(ip)) {
+					continue
+				}
+				if err == nil && source.Addr.IsValid() && addrFamily(source.Addr) != addrFamily(ip) {
+					continue
+				}
+				targets = append(targets, Target{Protocol: p.Protocol, Addr: net.JoinHostPort(addr, p.Port), Profile: profile, Source: source})
+			}
+		}
+	}
+	for _, socket := range p.UnixSockets {
+		targets = append(targets, Target{Protocol: "unix", Addr: socket})
+	}
+	return targets
+}
+
+// family returns the metric label of the address family of the target, ipv4 or ipv6, empty for unix sockets.
+func (t Target) family() string {
+	host, _, err := net.SplitHostPort(t.Addr)
+	if err != nil {
+		return ""
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return ""
+	}
+	return "ip" + addrFamily(ip)
+}
+
+// mode returns the metric label describing how connections are used by the probes.
+func (p ProbeConfig) mode() string {
+	if p.Persistent {
+		return "persistent"
+	}
+	return "fresh"
+}
+
+// labelValues returns the values for metricLabels of the probe of target answered by resp.
+func (p ProbeConfig) labelValues(target Target, resp netapi.Response) []string {
+	values := []string{resp.Server, p.mode(), strconv.Itoa(p.PayloadSize), target.Profile.Name, target.Source.String(),
+		target.family()}
+	values = append(values, p.identityValues(resp.ClientIdentity)...)
+	return append(values, p.identityValues(resp.ServerIdentity)...)
+}
+
+// identityFields are the identity fields that can be used as metric labels, in the order of metricLabels.
+var identityFields = []string{"pod", "namespace", "node", "zone"}
+
+// identityValues returns the label values for id, leaving the fields that are not selected empty.
+func (p ProbeConfig) identityValues(id *netapi.Identity) []string {
+	values := make([]string, len(identityFields))
+	if id == nil {
+		return values
+	}
+	fields := map[string]string{"pod": id.Pod, "namespace": id.Namespace, "node": id.Node, "zone": id.Zone}
+	for i, field := range identityFields {
+		if slices.Contains(p.IdentityLabels, field) {
+			values[i] = fields[field]
+		}
+	}
+	return values
+}
+
+// validIdentityLabels checks that every label names an identity field.
+func validIdentityLabels(labels []string) error {
+	for _, label := range labels {
+		if !slices.Contains(identityFields, label) {
+			return fmt.Errorf("invalid identity label %q, use pod, namespace, node or zone", label)
+		}
+	}
+	return nil
+}
@@ -1,6 +1,16 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
 	"github.com/jdambly/kitter/pkg/netapi"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -9,37 +19,300 @@ import (
 // NewCmd
 func NewCmd() *cobra.Command {
 	var port string
+	var protocol string
+	var payloadSize int
+	var unixSocket string
+	var handlerSpec string
+	var middlewareSpecs []string
+	var tlsConfig netapi.TLSConfig
+	var shutdownTimeout time.Duration
+	var config netapi.ServerConfig
+	var httpAddr string
+	var httpProbePort string
+	var grpcPort string
+	var socketSpec string
+	var stampKeyFile string
+	var listenSpecs []string
+	var ready atomic.Bool
 	// create the "server" command
 	cmd := &cobra.Command{
 		Use:   "server",
 		Short: "start the server",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			// make a channel to check if the tcp server is ready or not
-			readyCh := make(chan struct{})
 			// create the new server
-			srv, err := netapi.NewServer("tcp", ":"+port)
+			handler, err := netapi.NewHandler(handlerSpec)
 			if err != nil {
-				log.Fatal().Err(err).Msg("failed to create server")
+				return err
 			}
-
-			// Start the server
-			go func() {
-				log.Info().Msg("Starting TCP server on tcp addr -> :" + port)
-				if err := srv.Run(readyCh); err != nil {
-					log.Fatal().Err(err).Msg("failed to start server")
+			socketOptions, err := netapi.ParseSocketOptions(socketSpec)
+			if err != nil {
+				return err
+			}
+			opts := []netapi.ServerOption{
+				netapi.WithReplyPayloadSize(payloadSize),
+				netapi.WithHandler(handler),
+				netapi.WithMaxConns(config.MaxConns),
+				netapi.WithIdleTimeout(config.IdleTimeout),
+				netapi.WithReadTimeout(config.ReadTimeout),
+				netapi.WithMaxProbeSize(config.MaxProbeSize),
+				netapi.WithRateLimit(config.RateLimit, config.RateBurst),
+				netapi.WithServerIdentity(config.Identity),
+				netapi.WithServerClientLabel(config.ClientLabel),
+				netapi.WithServerSocketOptions(socketOptions),
+			}
+			for _, spec := range middlewareSpecs {
+				middleware, err := netapi.NewMiddleware(spec)
+				if err != nil {
+					return err
+				}
+				opts = append(opts, netapi.WithMiddleware(middleware))
+			}
+			// TLS is turned on by giving the server certificate
+			var reloader *netapi.CertReloader
+			if tlsConfig.CertFile != "" || tlsConfig.KeyFile != "" {
+				reloader, err = netapi.NewCertReloader(tlsConfig)
+				if err != nil {
+					return err
+				}
+			}
+			var stampKey []byte
+			if stampKeyFile != "" {
+				stampKey, err = netapi.ReadSTAMPKey(stampKeyFile)
+				if err != nil {
+					return err
+				}
+			}
+			var listeners []listener
+			if len(listenSpecs) > 0 {
+				// --listen replaces the single listener of --protocol
+				for _, name := range []string{"protocol", "port", "unix-socket"} {
+					if cmd.Flags().Changed(name) {
+						return fmt.Errorf("the --%s flag can not be combined with --listen", name)
+					}
+				}
+				for _, spec := range listenSpecs {
+					l, err := parseListener(spec)
+					if err != nil {
+						return err
+					}
+					listeners = append(listeners, l)
+				}
+			} else {
+				// unix sockets listen on a path instead of a port
+				addr := ":" + port
+				if protocol == "unix" {
+					if unixSocket == "" {
+						return errors.New("the --unix-socket flag is required for the unix protocol")
+					}
+					addr = unixSocket
 				}
-			}()
-			<-readyCh
-			// block with select and wait for channel returns
-			<-cmd.Context().Done()
-			log.Info().Msg("shutting down")
-			return nil
+				listeners = []listener{{protocol: protocol, addr: addr}}
+			}
+			// HTTP probes can be served next to the main listener for paths that only proxy HTTP
+			if httpProbePort != "" && !hasProtocol(listeners, "http") {
+				listeners = append(listeners, listener{protocol: "http", addr: ":" + httpProbePort})
+			}
+			if grpcPort != "" && !hasProtocol(listeners, "grpc") {
+				listeners = append(listeners, listener{protocol: "grpc", addr: ":" + grpcPort})
+			}
+			if err := newServers(listeners, opts, stampKey, reloader); err != nil {
+				return err
+			}
+
+			// the admin server exposes the server metrics, an empty address turns it off
+			if httpAddr != "" {
+				admin := newAdminServer(httpAddr, &ready)
+				go func() {
+					log.Info().Str("address", httpAddr).Msg("Starting admin server")
+					if err := admin.ListenAndServe(); err != http.ErrServerClosed {
+						log.Error().Err(err).Msg("admin server ListenAndServe error")
+					}
+				}()
+				defer func() {
+					_ = admin.Close()
+				}()
+			}
+
+			return serve(cmd.Context(), listeners, shutdownTimeout, &ready)
 		},
 	}
 
 	// add the "port" flag to the "server" command
-	cmd.Flags().StringVarP(&port, "port", "p", "5102", "TCP port to listen on")
+	cmd.Flags().StringVarP(&port, "port", "p", "5102", "port to listen on")
+	cmd.Flags().StringVar(&protocol, "protocol", "tcp", "protocol to listen on (tcp, udp, unix, http, grpc, quic, or twamp and stamp for a TWAMP-Light or STAMP reflector, usually on port 862)")
+	cmd.Flags().StringArrayVar(&listenSpecs, "listen", nil, "endpoint to serve instead of --protocol and --port, proto://addr with an optional ?handler= overriding --handler, as in udp://:5103?handler=echo or unix:///run/kitter.sock, can be repeated")
+	cmd.Flags().StringVar(&httpProbePort, "http-probe-port", "", "also serve HTTP probes on this port next to the --protocol listener")
+	cmd.Flags().StringVar(&grpcPort, "grpc-port", "", "also serve the Kitter gRPC service of pkg/netapi/kitterpb/kitter.proto, with the standard health and reflection services, on this port next to the --protocol listener")
+	cmd.Flags().StringVar(&unixSocket, "unix-socket", "", "socket path to listen on with the unix protocol, @name for the abstract namespace")
+	cmd.Flags().StringVar(&tlsConfig.CertFile, "tls-cert", "", "server certificate, turns on TLS")
+	cmd.Flags().StringVar(&tlsConfig.KeyFile, "tls-key", "", "key of the server certificate")
+	cmd.Flags().StringVar(&tlsConfig.CAFile, "tls-ca", "", "CA bundle used to verify client certificates")
+	cmd.Flags().BoolVar(&tlsConfig.ClientAuth, "tls-client-auth", false, "require and verify client certificates against --tls-ca")
+	cmd.Flags().StringVar(&stampKeyFile, "stamp-key-file", "", "file holding the key the stamp test packets are authenticated with, the unauthenticated mode is used without it")
+	cmd.Flags().StringVar(&handlerSpec, "handler", "timestamp", "handler answering the probes: "+strings.Join(netapi.Handlers(), ", ")+", arguments follow a colon as in delay:10ms")
+	cmd.Flags().StringArrayVar(&middlewareSpecs, "middleware", nil, "middleware wrapping the handler, log or allow:<cidr>[,<cidr>...], can be repeated")
+	cmd.Flags().IntVar(&payloadSize, "payload-size", 0, "size of the payload sent back with every reply, 0 echoes the size of the probe payload")
+	cmd.Flags().StringVar(&socketSpec, "socket-options", "", "options of the server sockets so the replies are marked like the probes, as in dscp=46,priority=6,mark=0x10,nodelay=false,congestion=bbr")
+	cmd.Flags().IntVar(&config.MaxConns, "max-conns", 1024, "maximum number of connections served at once, 0 for no limit")
+	cmd.Flags().DurationVar(&config.IdleTimeout, "idle-timeout", 2*time.Minute, "close connections that send no probe for this long, 0 for no limit")
+	cmd.Flags().DurationVar(&config.ReadTimeout, "read-timeout", 10*time.Second, "close connections that take longer to send a whole probe and read the reply, 0 for no limit")
+	cmd.Flags().IntVar(&config.MaxProbeSize, "max-probe-size", netapi.DefaultMaxProbeSize, "largest text line or frame accepted from a client in bytes")
+	cmd.Flags().Float64Var(&config.RateLimit, "rate-limit", 0, "probes per second answered for a single source IP, 0 for no limit")
+	cmd.Flags().IntVar(&config.RateBurst, "rate-burst", 10, "number of probes a single source IP may send at once above --rate-limit")
+	env := netapi.IdentityFromEnv()
+	cmd.Flags().StringVar(&config.Identity.Pod, "pod-name", env.Pod, "name of the pod the server runs in, defaults to $"+netapi.EnvPodName)
+	cmd.Flags().StringVar(&config.Identity.Namespace, "pod-namespace", env.Namespace, "namespace of the pod the server runs in, defaults to $"+netapi.EnvPodNamespace)
+	cmd.Flags().StringVar(&config.Identity.Node, "node-name", env.Node, "node the server runs on, defaults to $"+netapi.EnvNodeName)
+	cmd.Flags().StringVar(&config.Identity.Zone, "zone", env.Zone, "zone of the node the server runs on, defaults to $"+netapi.EnvZone)
+	cmd.Flags().StringVar(&config.ClientLabel, "client-label", "node", "identity field of the clients the probe metrics are labeled with: pod, namespace, node or zone, empty for none")
+	cmd.Flags().StringVar(&httpAddr, "http-addr", ":9102", "interface:port of the admin server exposing /metrics, /healthz and /readyz, empty to turn it off")
+	cmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "how long to wait for probes in flight to be answered on shutdown")
 
 	// Return the new command
 	return cmd
 }
+
+// listener is a probe server started by the command.
+type listener struct {
+	protocol string
+	addr     string
+	handler  string // spec of the handler of this listener, the --handler one when empty
+	srv      netapi.Server
+}
+
+// parseListener parses a --listen spec, proto://addr with an optional ?handler=<spec> choosing the handler of the
+// listener. The address of a unix listener is the path of the socket, or @name for the abstract namespace.
+func parseListener(spec string) (listener, error) {
+	protocol, rest, ok := strings.Cut(spec, "://")
+	if !ok || protocol == "" {
+		return listener{}, fmt.Errorf("invalid listener %q, use proto://addr", spec)
+	}
+	l := listener{protocol: strings.ToLower(protocol)}
+	addr, query, _ := strings.Cut(rest, "?")
+	if addr == "" {
+		return listener{}, fmt.Errorf("listener %q has no address", spec)
+	}
+	l.addr = addr
+	if query != "" {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			return listener{}, fmt.Errorf("invalid options of listener %q: %w", spec, err)
+		}
+		for key := range values {
+			if key != "handler" {
+				return listener{}, fmt.Errorf("unknown option %q of listener %q, use handler", key, spec)
+			}
+		}
+		l.handler = values.Get("handler")
+	}
+	return l, nil
+}
+
+// newServers creates the server of every listener with opts and the handler of the listener. The STAMP key is only
+// given to the stamp listeners and TLS to the protocols that support it, so one set of flags serves every protocol.
+// TLS without a listener supporting it is an error.
+func newServers(listeners []listener, opts []netapi.ServerOption, stampKey []byte, reloader *netapi.CertReloader) error {
+	if reloader != nil && !slices.ContainsFunc(listeners, func(l listener) bool {
+		return slices.Contains(tlsProtocols, l.protocol)
+	}) {
+		// serving every probe without TLS would go unnoticed
+		return errors.New("TLS is configured but no listener supports it, TLS is only supported over tcp, http, grpc and quic")
+	}
+	for i, l := range listeners {
+		listenerOpts := slices.Clone(opts)
+		if l.handler != "" {
+			handler, err := netapi.NewHandler(l.handler)
+			if err != nil {
+				return fmt.Errorf("listener %s://%s: %w", l.protocol, l.addr, err)
+			}
+			listenerOpts = append(listenerOpts, netapi.WithHandler(handler))
+		}
+		if stampKey != nil && l.protocol == "stamp" {
+			listenerOpts = append(listenerOpts, netapi.WithServerSTAMPKey(stampKey))
+		}
+		if reloader != nil {
+			if slices.Contains(tlsProtocols, l.protocol) {
+				listenerOpts = append(listenerOpts, netapi.WithServerTLS(reloader))
+			} else {
+				log.Warn().Str("protocol", l.protocol).Str("addr", l.addr).Msg("serving without TLS, the protocol does not support it")
+			}
+		}
+		srv, err := netapi.NewServer(l.protocol, l.addr, listenerOpts...)
+		if err != nil {
+			return fmt.Errorf("failed to create %s server on %s: %w", l.protocol, l.addr, err)
+		}
+		listeners[i].srv = srv
+	}
+	return nil
+}
+
+// tlsProtocols are the protocols served with TLS when the server certificate is given.
+var tlsProtocols = []string{"tcp", "http", "grpc", "quic"}
+
+// hasProtocol reports whether one of the listeners serves protocol.
+func hasProtocol(listeners []listener, protocol string) bool {
+	return slices.ContainsFunc(listeners, func(l listener) bool {
+		return l.protocol == protocol
+	})
+}
+
+// bound returns an error naming the first listener that is not listening.
+func bound(listeners []listener) error {
+	for _, l := range listeners {
+		if l.srv.BoundAddr() == nil {
+			return fmt.Errorf("%s server on %s is not listening", l.protocol, l.addr)
+		}
+	}
+	return nil
+}
+
+// serve runs every listener until ctx is done or one of them fails, then shuts them all down, giving the probes in
+// flight up to shutdownTimeout to be answered. ready is set while every listener is accepting probes.
+func serve(ctx context.Context, listeners []listener, shutdownTimeout time.Duration, ready *atomic.Bool) error {
+	// the servers stop accepting on their own once the context is done
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		readyCh := make(chan struct{})
+		go func(l listener) {
+			log.Info().Msg("Starting server on " + l.protocol + " addr -> " + l.addr)
+			err := l.srv.Run(ctx, readyCh)
+			if err != nil {
+				err = fmt.Errorf("%s server on %s: %w", l.protocol, l.addr, err)
+			}
+			errCh <- err
+		}(l)
+		<-readyCh
+	}
+	// a listener that failed to bind closes its readyCh as well, its error is waited for below
+	if err := bound(listeners); err != nil {
+		log.Error().Err(err).Msg("not ready")
+	} else {
+		ready.Store(true)
+	}
+
+	// block until a server fails or the command is cancelled
+	var err error
+	select {
+	case err = <-errCh:
+		if err != nil {
+			log.Error().Err(err).Msg("server failed")
+		}
+	case <-ctx.Done():
+	}
+
+	// stop advertising the pod before draining so no new probes are sent its way
+	ready.Store(false)
+	log.Info().Dur("timeout", shutdownTimeout).Msg("shutting down, draining connections")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, l := range listeners {
+		if l.srv.BoundAddr() == nil {
+			// the listener failed to bind, there is nothing to drain
+			continue
+		}
+		if err := l.srv.Shutdown(shutdownCtx); err != nil {
+			log.Error().Err(err).Str("protocol", l.protocol).Msg("connections were not drained in time")
+		}
+	}
+	return err
+}
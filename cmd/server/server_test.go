@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jdambly/kitter/pkg/netapi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseListener(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected listener
+		err      bool
+	}{
+		{spec: "tcp://:5102", expected: listener{protocol: "tcp", addr: ":5102"}},
+		{spec: "UDP://:5103?handler=echo", expected: listener{protocol: "udp", addr: ":5103", handler: "echo"}},
+		{spec: "http://127.0.0.1:8081?handler=delay:10ms", expected: listener{protocol: "http", addr: "127.0.0.1:8081", handler: "delay:10ms"}},
+		{spec: "unix:///run/kitter.sock", expected: listener{protocol: "unix", addr: "/run/kitter.sock"}},
+		{spec: "unix://@kitter", expected: listener{protocol: "unix", addr: "@kitter"}},
+		{spec: "tcp://[::1]:5102", expected: listener{protocol: "tcp", addr: "[::1]:5102"}},
+		{spec: ":5102", err: true},
+		{spec: "tcp://", err: true},
+		{spec: "tcp://:5102?payload=10", err: true},
+	}
+	for _, tt := range tests {
+		l, err := parseListener(tt.spec)
+		if tt.err {
+			assert.Error(t, err, tt.spec)
+			continue
+		}
+		require.NoError(t, err, tt.spec)
+		assert.Equal(t, tt.expected, l, tt.spec)
+	}
+}
+
+func TestServe(t *testing.T) {
+	var listeners []listener
+	for _, l := range []listener{
+		{protocol: "tcp", addr: "127.0.0.1:0"},
+		{protocol: "udp", addr: "127.0.0.1:0"},
+		{protocol: "unix", addr: filepath.Join(t.TempDir(), "kitter.sock")},
+	} {
+		var err error
+		l.srv, err = netapi.NewServer(l.protocol, l.addr)
+		require.NoError(t, err)
+		listeners = append(listeners, l)
+	}
+
+	var ready atomic.Bool
+	admin := httptest.NewServer(newAdminServer("", &ready).Handler)
+	defer admin.Close()
+	readyz := func() int {
+		resp, err := http.Get(admin.URL + "/readyz")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, readyz())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- serve(ctx, listeners, time.Second, &ready)
+	}()
+	require.Eventually(t, ready.Load, time.Second, 10*time.Millisecond)
+	assert.Equal(t, http.StatusOK, readyz())
+
+	// every listener answers probes in the same process
+	for _, l := range listeners {
+		client, err := netapi.NewClient(l.protocol, l.srv.BoundAddr().String())
+		require.NoError(t, err)
+		require.NoError(t, client.Connect())
+		_, err = client.Probe()
+		assert.NoError(t, err, l.protocol)
+		_ = client.Close()
+	}
+
+	cancel()
+	require.NoError(t, <-errCh)
+	assert.False(t, ready.Load())
+}
+
+func TestNewServersSTAMPKey(t *testing.T) {
+	key := []byte("secret")
+	listeners := []listener{
+		{protocol: "tcp", addr: "127.0.0.1:0"},
+		{protocol: "stamp", addr: "127.0.0.1:0"},
+		{protocol: "twamp", addr: "127.0.0.1:0"},
+		{protocol: "http", addr: "127.0.0.1:0"},
+		{protocol: "grpc", addr: "127.0.0.1:0"},
+	}
+	require.NoError(t, newServers(listeners, nil, key, nil), "only the stamp listener gets the key")
+
+	var ready atomic.Bool
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- serve(ctx, listeners, time.Second, &ready)
+	}()
+	require.Eventually(t, ready.Load, time.Second, 10*time.Millisecond)
+
+	for _, l := range listeners {
+		var opts []netapi.ClientOption
+		if l.protocol == "stamp" {
+			opts = append(opts, netapi.WithSTAMPKey(key))
+		}
+		client, err := netapi.NewClient(l.protocol, l.srv.BoundAddr().String(), opts...)
+		require.NoError(t, err)
+		require.NoError(t, client.Connect())
+		_, err = client.Probe()
+		assert.NoError(t, err, l.protocol)
+		_ = client.Close()
+	}
+
+	// the stamp reflector only answers authenticated test packets
+	_, err := listeners[1].srv.ProcessData(context.Background(), make([]byte, 44))
+	assert.Error(t, err)
+
+	cancel()
+	require.NoError(t, <-errCh)
+}
+
+func TestNewServersTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile := writeTestCert(t, dir)
+	reloader, err := netapi.NewCertReloader(netapi.TLSConfig{CertFile: certFile, KeyFile: filepath.Join(dir, "tls.key")})
+	require.NoError(t, err)
+
+	// TLS must not silently turn into plaintext
+	listeners := []listener{{protocol: "udp", addr: "127.0.0.1:0"}, {protocol: "stamp", addr: "127.0.0.1:0"}}
+	assert.Error(t, newServers(listeners, nil, nil, reloader))
+
+	listeners = []listener{{protocol: "tcp", addr: "127.0.0.1:0"}, {protocol: "udp", addr: "127.0.0.1:0"}}
+	require.NoError(t, newServers(listeners, nil, nil, reloader))
+	assert.NotNil(t, listeners[0].srv)
+	assert.NotNil(t, listeners[1].srv)
+}
+
+func TestServeBindError(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer busy.Close()
+
+	listeners := []listener{
+		{protocol: "udp", addr: "127.0.0.1:0"},
+		{protocol: "tcp", addr: busy.Addr().String()},
+	}
+	require.NoError(t, newServers(listeners, nil, nil, nil))
+
+	// the server is not marked ready while a listener is not listening
+	var ready atomic.Bool
+	assert.Error(t, serve(context.Background(), listeners, time.Second, &ready))
+	assert.Error(t, bound(listeners))
+	assert.False(t, ready.Load())
+}
+
+func TestNewCmdListeners(t *testing.T) {
+	dir := t.TempDir()
+	certFile := writeTestCert(t, dir)
+	keyFile := filepath.Join(dir, "stamp.key")
+	require.NoError(t, os.WriteFile(keyFile, []byte("secret\n"), 0o600))
+	tcpAddr, stampAddr, udpAddr, adminAddr := freeAddr(t, "tcp"), freeAddr(t, "udp"), freeAddr(t, "udp"), freeAddr(t, "tcp")
+
+	// TLS only applies to the tcp listener and the STAMP key to the stamp one
+	cmd := NewCmd()
+	cmd.SetArgs([]string{
+		"--listen", "tcp://" + tcpAddr,
+		"--listen", "stamp://" + stampAddr,
+		"--listen", "udp://" + udpAddr + "?handler=echo",
+		"--tls-cert", certFile,
+		"--tls-key", filepath.Join(dir, "tls.key"),
+		"--stamp-key-file", keyFile,
+		"--http-addr", adminAddr,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- cmd.ExecuteContext(ctx)
+	}()
+	require.Eventually(t, func() bool {
+		resp, err := http.Get("http://" + adminAddr + "/readyz")
+		if err != nil {
+			return false
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	reloader, err := netapi.NewCertReloader(netapi.TLSConfig{CAFile: certFile})
+	require.NoError(t, err)
+	for _, probe := range []struct {
+		protocol string
+		addr     string
+		opts     []netapi.ClientOption
+	}{
+		{protocol: "tcp", addr: tcpAddr, opts: []netapi.ClientOption{netapi.WithTLS(reloader)}},
+		{protocol: "stamp", addr: stampAddr, opts: []netapi.ClientOption{netapi.WithSTAMPKey([]byte("secret"))}},
+		{protocol: "udp", addr: udpAddr},
+	} {
+		client, err := netapi.NewClient(probe.protocol, probe.addr, probe.opts...)
+		require.NoError(t, err)
+		require.NoError(t, client.Connect(), probe.protocol)
+		_, err = client.Probe()
+		assert.NoError(t, err, probe.protocol)
+		_ = client.Close()
+	}
+
+	cancel()
+	require.NoError(t, <-errCh)
+}
+
+// freeAddr returns a loopback address with a port that is free on network.
+func freeAddr(t *testing.T, network string) string {
+	if network == "udp" {
+		conn, err := net.ListenPacket(network, "127.0.0.1:0")
+		require.NoError(t, err)
+		defer conn.Close()
+		return conn.LocalAddr().String()
+	}
+	l, err := net.Listen(network, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key to tls.crt and tls.key in dir and returns
+// the path of the certificate, which is also its own CA.
+func writeTestCert(t *testing.T, dir string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kitter"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "tls.crt")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tls.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile
+}
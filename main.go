@@ -43,14 +43,21 @@ func main() {
 
 	var wg sync.WaitGroup
 
+	wg.Add(1)
 	go func() {
-		defer close(done)
+		defer wg.Done()
+		// wake up main when the command returns on its own, without a signal arriving on a closed channel
+		defer func() {
+			signal.Stop(done)
+			close(done)
+		}()
 
 		// Execute the main command of the application, passing in the version info.
 		cmd.Execute(ctx, cmd.VersionInfo{Version: version, Commit: commit, Date: date})
 	}()
 
 	<-done
+	// cancel the command and wait for it to shut down gracefully
 	cancel()
 	wg.Wait()
 }
@@ -2,43 +2,466 @@ package netapi
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"strings"
 	"time"
+
+	"github.com/rs/zerolog/log"
 )
 
+// Client is an interface that defines methods for connecting to a server and exchanging probe data with it.
+type Client interface {
+	// Connect establishes the connection to the server and returns an error if any issues occur.
+	Connect() error
+
+	// SendData sends data to the server and returns the server's response.
+	SendData(data string) (string, error)
+
+	// Probe sends a single timestamped probe in the negotiated wire format and returns the server's Response
+	// with ClientDone set to the moment the response was received.
+	Probe() (Response, error)
+
+	// Close shuts down the connection to the server.
+	Close() error
+}
+
+// ClientConfig holds the settings shared by every Client implementation.
+type ClientConfig struct {
+	// Wire is the wire format the client offers to the server, WireText or WireBinary.
+	Wire string
+
+	// PayloadSize is the number of padding bytes sent with every probe.
+	PayloadSize int
+
+	// ReplySize is the number of padding bytes binary replies must carry, PayloadSize when it is 0 as servers echo
+	// the probe payload by default. Text replies announce their own size.
+	ReplySize int
+
+	// TLS secures the connection with TLS when it is set. Only TCP, HTTP, gRPC and QUIC clients support it.
+	TLS *CertReloader
+
+	// Identity is sent to the servers with the binary wire format and reported in every Response.
+	Identity Identity
+
+	// HTTPVersion is the version HTTP clients probe with: HTTP1, HTTP2Cleartext or HTTP2.
+	HTTPVersion string
+
+	// GRPCStream makes gRPC clients send their probes on a single bidirectional stream instead of unary RPCs.
+	GRPCStream bool
+
+	// KernelTimestamps makes UDP clients read the kernel timestamps of their binary probes and replies, to report
+	// the RTT without the scheduling delays of the client. It is only supported on Linux, over udp with the binary
+	// wire format, NewClient rejects it for the other protocols and the text wire format.
+	KernelTimestamps bool
+
+	// Socket are the options set on the socket of the client when it is created.
+	Socket SocketOptions
+
+	// Source is the local address and interface the client connects from, chosen by the kernel when it is zero.
+	Source SourceBinding
+
+	// STAMPKey is the key STAMP clients authenticate their test packets with, they use the unauthenticated mode
+	// when it is empty.
+	STAMPKey []byte
+}
+
+// ClientOption changes a setting of the ClientConfig.
+type ClientOption func(*ClientConfig)
+
+// WithWire sets the wire format the client offers to the server.
+func WithWire(wire string) ClientOption {
+	return func(c *ClientConfig) {
+		c.Wire = wire
+	}
+}
+
+// WithPayloadSize sets the number of padding bytes sent with every probe.
+func WithPayloadSize(size int) ClientOption {
+	return func(c *ClientConfig) {
+		c.PayloadSize = size
+	}
+}
+
+// WithReplySize sets the number of padding bytes binary replies must carry, for servers with a reply payload size.
+func WithReplySize(size int) ClientOption {
+	return func(c *ClientConfig) {
+		c.ReplySize = size
+	}
+}
+
+// WithTLS secures the connection to the server with the certificates of reloader.
+func WithTLS(reloader *CertReloader) ClientOption {
+	return func(c *ClientConfig) {
+		c.TLS = reloader
+	}
+}
+
+// WithIdentity sets the Identity the client announces to the servers.
+func WithIdentity(id Identity) ClientOption {
+	return func(c *ClientConfig) {
+		c.Identity = id
+	}
+}
+
+// WithHTTPVersion sets the version HTTP clients probe with.
+func WithHTTPVersion(version string) ClientOption {
+	return func(c *ClientConfig) {
+		c.HTTPVersion = version
+	}
+}
+
+// WithGRPCStream makes gRPC clients send their probes on a single stream when stream is set.
+func WithGRPCStream(stream bool) ClientOption {
+	return func(c *ClientConfig) {
+		c.GRPCStream = stream
+	}
+}
+
+// WithKernelTimestamps makes UDP clients measure the RTT of their probes with kernel timestamps when enabled is set.
+func WithKernelTimestamps(enabled bool) ClientOption {
+	return func(c *ClientConfig) {
+		c.KernelTimestamps = enabled
+	}
+}
+
+// WithSocketOptions sets the options set on the socket of the client, for example the DSCP of its probes.
+func WithSocketOptions(options SocketOptions) ClientOption {
+	return func(c *ClientConfig) {
+		c.Socket = options
+	}
+}
+
+// WithSource makes the client connect from the address and interface of source.
+func WithSource(source SourceBinding) ClientOption {
+	return func(c *ClientConfig) {
+		c.Source = source
+	}
+}
+
+// WithSTAMPKey makes STAMP clients use the authenticated mode with key.
+func WithSTAMPKey(key []byte) ClientOption {
+	return func(c *ClientConfig) {
+		c.STAMPKey = key
+	}
+}
+
+// newClientConfig returns the default ClientConfig with opts applied.
+func newClientConfig(opts ...ClientOption) ClientConfig {
+	config := ClientConfig{
+		Wire:        WireText,
+		HTTPVersion: HTTP1,
+	}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return config
+}
+
 // TCPClient is a struct that represents a TCP Client.
 // It contains the address of the server and a connection to the server.
+// The same client probes unix domain sockets, which are stream oriented as well.
 type TCPClient struct {
 	// addr is the address of the server.
 	addr string
 
+	// network is the network passed to net.Dial, tcp when it is empty.
+	network string
+
+	// config holds the options the client was created with.
+	config ClientConfig
+
 	// conn is a netapi.Conn which represents the Client's connection to the server.
 	conn net.Conn
+
+	// reader buffers the data read from conn.
+	reader *bufio.Reader
+
+	// version is the negotiated frame version, 0 when the text protocol is used.
+	version uint8
+
+	// payload is the padding sent with every probe.
+	payload []byte
+
+	// handshake is the duration of the TLS handshake and connect the duration of the dial, not yet reported by a probe.
+	handshake time.Duration
+	connect   time.Duration
+
+	// firstWrite is the time spent writing the last probe and firstByte the time from then to the first byte of
+	// the reply.
+	firstWrite time.Duration
+	firstByte  time.Duration
+
+	// retransmits is the total number of retransmissions on the connection at the previous TCP_INFO sample.
+	retransmits uint32
+
+	// peer is the identity the server announced in its answer to the hello, nil when it did not.
+	peer *Identity
+
+	// seq is the sequence number of the last probe and probeID identifies the probes of this client.
+	seq     uint32
+	probeID uint64
 }
 
-// NewClient is a factory function that creates a new Client with the provided address. Example address localhost:8080
-func NewClient(addr string) *TCPClient {
-	// Create and return a new TCPClient with the provided address
+// NewTCPClient creates a TCPClient with the default options for the provided address, as NewClient(addr) did before
+// NewClient took a protocol. Example address localhost:8080
+func NewTCPClient(addr string) *TCPClient {
 	return &TCPClient{
-		addr: addr,
+		addr:    addr,
+		config:  newClientConfig(),
+		probeID: newProbeID(),
+	}
+}
+
+// NewClient is a factory function that creates a new Client based on the provided protocol and address.
+// Example address localhost:8080, or /run/kitter.sock and @kitter for unix domain sockets.
+// If an unsupported protocol is provided, it returns an error. NewTCPClient creates a TCP client without options.
+func NewClient(protocol, addr string, opts ...ClientOption) (Client, error) {
+	config := newClientConfig(opts...)
+	switch config.Wire {
+	case WireText, WireBinary:
+	default:
+		return nil, errors.New("invalid wire format given")
+	}
+	if err := validatePayloadSize(config.PayloadSize); err != nil {
+		return nil, err
 	}
+	if err := validatePayloadSize(config.ReplySize); err != nil {
+		return nil, err
+	}
+	if err := config.Identity.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Socket.validate(); err != nil {
+		return nil, err
+	}
+	if config.KernelTimestamps && (strings.ToLower(protocol) != "udp" || config.Wire != WireBinary) {
+		// only the binary UDP probes read the timestamps of the kernel, the other probes would ignore them
+		return nil, errors.New("kernel timestamps are only supported over udp with the binary wire format")
+	}
+	if len(config.STAMPKey) > 0 && strings.ToLower(protocol) != "stamp" {
+		return nil, errors.New("a STAMP key is only supported over stamp")
+	}
+
+	// Convert the protocol to lower case to ensure case-insensitive comparison
+	switch strings.ToLower(protocol) {
+	case "tcp":
+		// Create and return a new TCPClient with the provided address
+		return &TCPClient{
+			addr:    addr,
+			config:  config,
+			payload: newPadding(config.PayloadSize),
+			probeID: newProbeID(),
+		}, nil
+	case "udp":
+		if config.TLS != nil {
+			return nil, errTLSUnsupported
+		}
+		// Create and return a new UDPClient with the provided address
+		return &UDPClient{
+			addr:    addr,
+			config:  config,
+			payload: newPadding(config.PayloadSize),
+			probeID: newProbeID(),
+		}, nil
+	case "unix":
+		if config.TLS != nil {
+			return nil, errTLSUnsupported
+		}
+		// Create and return a new TCPClient dialing the socket
+		return &TCPClient{
+			addr:    addr,
+			network: "unix",
+			config:  config,
+			payload: newPadding(config.PayloadSize),
+			probeID: newProbeID(),
+		}, nil
+	case "http":
+		switch {
+		case config.HTTPVersion == HTTP2 && config.TLS == nil:
+			return nil, errors.New("h2 requires TLS, use h2c without it")
+		case config.HTTPVersion == HTTP2Cleartext && config.TLS != nil:
+			return nil, errors.New("h2c can not be used with TLS, use h2")
+		case config.HTTPVersion != HTTP1 && config.HTTPVersion != HTTP2Cleartext && config.HTTPVersion != HTTP2:
+			return nil, fmt.Errorf("invalid HTTP version %q", config.HTTPVersion)
+		}
+		// Create and return a new HTTPClient with the provided address
+		return &HTTPClient{
+			addr:    addr,
+			config:  config,
+			payload: newPadding(config.PayloadSize),
+		}, nil
+	case "grpc":
+		// Create and return a new GRPCClient with the provided address
+		return &GRPCClient{
+			addr:    addr,
+			config:  config,
+			payload: newPadding(config.PayloadSize),
+			probeID: newProbeID(),
+		}, nil
+	case "quic":
+		// Create and return a new QUICClient with the provided address
+		return &QUICClient{
+			addr:    addr,
+			config:  config,
+			payload: newPadding(config.PayloadSize),
+			probeID: newProbeID(),
+		}, nil
+	case "twamp":
+		if config.TLS != nil {
+			return nil, errTLSUnsupported
+		}
+		// Create and return a new TWAMP-Light session-sender, the test packets have a fixed format
+		return &TWAMPClient{
+			addr:    addr,
+			config:  config,
+			codec:   twampCodec{},
+			padding: twampPadding(config.PayloadSize),
+		}, nil
+	case "stamp":
+		if config.TLS != nil {
+			return nil, errTLSUnsupported
+		}
+		// Create and return a new STAMP session-sender, authenticated test packets have no padding
+		return &TWAMPClient{
+			addr:    addr,
+			config:  config,
+			codec:   stampCodec{key: config.STAMPKey},
+			padding: twampPadding(config.PayloadSize),
+		}, nil
+	}
+	return nil, errors.New("invalid protocol given")
 }
 
 // Connect is a method on the TCPClient struct that establishes a connection to the server.
+// When the binary wire format is configured the client negotiates the frame version with the server and falls back
+// to the text protocol on a new connection if the server does not speak it.
 // It returns an error if any issues occur during the process.
 func (c *TCPClient) Connect() (err error) {
 	// Dial the server
-	c.conn, err = net.Dial("tcp", c.addr)
+	err = c.dial()
 	// If there is an error in dialing, return the error
 	if err != nil {
 		return
 	}
+	if c.config.Wire != WireBinary {
+		return nil
+	}
+
+	c.version, err = c.negotiate()
+	if err != nil {
+		_ = c.conn.Close()
+		return err
+	}
+	if c.version == 0 {
+		// the server only speaks the text protocol and has given up on this connection, start over
+		_ = c.conn.Close()
+		return c.dial()
+	}
 	// Return nil if the connection was successful
 	return nil
 }
 
+// dial opens the TCP connection to the server and does the TLS handshake when TLS is configured.
+func (c *TCPClient) dial() (err error) {
+	network := c.network
+	if network == "" {
+		network = "tcp"
+	}
+	start := time.Now()
+	c.conn, err = c.config.dialer(network).Dial(network, c.addr)
+	if err != nil {
+		return
+	}
+	if err = c.config.Socket.connected(c.conn); err != nil {
+		_ = c.conn.Close()
+		return err
+	}
+	c.connect = time.Since(start)
+	c.retransmits = 0
+	if c.config.TLS != nil {
+		c.handshake, err = c.tlsHandshake()
+		if err != nil {
+			_ = c.conn.Close()
+			return err
+		}
+	}
+	c.reader = bufio.NewReader(c.conn)
+	return nil
+}
+
+// tlsHandshake wraps the connection in TLS and returns how long the handshake took.
+func (c *TCPClient) tlsHandshake() (time.Duration, error) {
+	host, _, err := net.SplitHostPort(c.addr)
+	if err != nil {
+		return 0, err
+	}
+	conn := tls.Client(c.conn, c.config.TLS.ClientConfig(host))
+	c.conn = conn
+
+	err = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	err = conn.Handshake()
+	handshake := time.Since(start)
+	if err != nil {
+		return 0, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	return handshake, conn.SetDeadline(time.Time{})
+}
+
+// negotiate offers the highest frame version to the server and returns the version it accepted.
+// A server that answers with anything but a frame only speaks the text protocol, which is reported as version 0.
+func (c *TCPClient) negotiate() (uint8, error) {
+	err := c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		return 0, err
+	}
+	defer func(conn net.Conn) {
+		_ = conn.SetDeadline(time.Time{})
+	}(c.conn)
+
+	hello := &Frame{
+		Version: CurrentFrameVersion,
+		Type:    FrameHello,
+		Payload: helloPayload,
+	}
+	// the hello carries the identity of the client, the server answers with its own
+	if err := withIdentity(hello, c.config.Identity); err != nil {
+		return 0, err
+	}
+	if err := WriteFrame(c.conn, hello); err != nil {
+		return 0, err
+	}
+
+	binaryFrames, err := peekFrame(c.reader)
+	if errors.Is(err, io.EOF) || (err == nil && !binaryFrames) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	ack, err := ReadFrame(c.reader)
+	if err != nil {
+		return 0, err
+	}
+	if ack.Type != FrameHelloAck || ack.Version > CurrentFrameVersion {
+		return 0, errors.New("invalid reply to hello")
+	}
+	// servers older than the identity exchange answer without one
+	c.peer, err = splitIdentity(ack)
+	if err != nil {
+		return 0, err
+	}
+	return ack.Version, nil
+}
+
 // SendData is a method on the TCPClient struct that sends data to the server.
 // It returns the server's response and an error if any issues occur during the process.
 func (c *TCPClient) SendData(data string) (string, error) {
@@ -46,8 +469,7 @@ func (c *TCPClient) SendData(data string) (string, error) {
 	if c.conn == nil {
 		return "", errors.New("connection not established")
 	}
-	// Create a new reader and writer for the connection
-	reader := bufio.NewReader(c.conn)
+	// Create a new writer for the connection
 	writer := bufio.NewWriter(c.conn)
 
 	// set the timeout on the connection
@@ -57,19 +479,19 @@ func (c *TCPClient) SendData(data string) (string, error) {
 	}
 
 	// Write the data to the connection
-	_, err = writer.WriteString(data + "\n")
-	if err != nil {
-		return "", err
-	}
-
-	err = writer.Flush()
+	err = c.timedWrite(func() error {
+		if _, err := writer.WriteString(data + "\n"); err != nil {
+			return err
+		}
+		return writer.Flush()
+	})
 	// If there is an error in writing, return the error
 	if err != nil {
 		return "", err
 	}
 
 	// Read the response from the connection
-	response, err := reader.ReadBytes('\n')
+	response, err := c.reader.ReadBytes('\n')
 	// If there is an error in reading, return the error
 	if err != nil {
 		return "", err
@@ -79,6 +501,99 @@ func (c *TCPClient) SendData(data string) (string, error) {
 	return strings.Trim(string(response), "\n"), nil
 }
 
+// tcpInfo samples the TCP_INFO of the connection, nil when it can not be read, for example on a unix socket.
+func (c *TCPClient) tcpInfo() *TCPInfo {
+	conn := tcpConn(c.conn)
+	if conn == nil {
+		return nil
+	}
+	info, err := readTCPInfo(conn)
+	if err != nil {
+		log.Debug().Err(err).Str("addr", c.addr).Msg("could not read TCP_INFO")
+		return nil
+	}
+	info.Retransmits = info.TotalRetransmits - c.retransmits
+	c.retransmits = info.TotalRetransmits
+	return info
+}
+
+// timedWrite writes a probe with write and waits for the first byte of the reply, recording how long both took.
+func (c *TCPClient) timedWrite(write func() error) error {
+	start := time.Now()
+	if err := write(); err != nil {
+		return err
+	}
+	wrote := time.Now()
+	c.firstWrite = wrote.Sub(start)
+	if _, err := c.reader.Peek(1); err != nil {
+		return err
+	}
+	c.firstByte = time.Since(wrote)
+	return nil
+}
+
+// Probe is a method on the TCPClient struct that sends a single probe in the negotiated wire format.
+// Every probe reports the time spent writing it and waiting for the first byte of the reply, the first probe on a
+// connection also reports the duration of the dial and of the TLS handshake.
+func (c *TCPClient) Probe() (Response, error) {
+	resp, err := c.probe()
+	if err != nil {
+		return resp, err
+	}
+	resp.FirstWrite = c.firstWrite.Seconds()
+	resp.FirstByte = c.firstByte.Seconds()
+	if c.connect > 0 {
+		resp.Connect = c.connect.Seconds()
+		c.connect = 0
+	}
+	if c.handshake > 0 {
+		resp.TLSHandshake = c.handshake.Seconds()
+		c.handshake = 0
+	}
+	resp.TCPInfo = c.tcpInfo()
+	identify(&resp, c.config.Identity, c.peer)
+	return resp, nil
+}
+
+// probe sends a single probe in the negotiated wire format.
+func (c *TCPClient) probe() (Response, error) {
+	// Check if the connection is established
+	if c.conn == nil {
+		return Response{}, errors.New("connection not established")
+	}
+	c.seq++
+	if c.version == 0 {
+		return textProbe(c.SendData, c.payload)
+	}
+
+	// set the timeout on the connection
+	err := c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		return Response{}, err
+	}
+
+	probe := newProbeFrame(c.version, c.seq, c.probeID, c.payload)
+	probe.ClientTime = time.Now().UnixNano()
+	err = c.timedWrite(func() error {
+		return WriteFrame(c.conn, probe)
+	})
+	if err != nil {
+		return Response{}, err
+	}
+	reply, err := ReadFrame(c.reader)
+	dStamp := time.Now()
+	if err != nil {
+		return Response{}, err
+	}
+	if err := checkReply(probe, reply); err != nil {
+		return Response{}, err
+	}
+	if err := checkReplySize(reply, len(c.payload), c.config.ReplySize); err != nil {
+		return Response{}, err
+	}
+	return frameResponse(reply, c.conn.LocalAddr().String(), c.addr, dStamp), nil
+}
+
 // Close is a method on the TCPClient struct that shuts down the connection to the server.
 // It returns an error if any issues occur during the process.
 func (c *TCPClient) Close() error {
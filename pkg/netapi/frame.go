@@ -0,0 +1,244 @@
+package netapi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The binary wire protocol is a fixed size header followed by an optional payload.
+// Every frame starts with frameMagic, which can never be the first bytes of a text probe (an RFC3339Nano timestamp),
+// so a server can tell the two protocols apart by peeking at the first bytes of a connection or datagram.
+//
+// Header layout, all fields big endian:
+//
+//	0  magic      uint16
+//	2  version    uint8
+//	3  type       uint8
+//	4  flags      uint16
+//	6  headerLen  uint16 size of the header, later versions append fields after serverTime
+//	8  seq        uint32
+//	12 payloadLen uint32
+//	16 probeID    uint64
+//	24 clientTime int64  unix nanoseconds
+//	32 serverTime int64  unix nanoseconds
+//
+// Version 2 appends:
+//
+//	40 serverSendTime int64 unix nanoseconds
+//
+// A frame flagged with FlagIdentity starts its payload with the encoded Identity of the sender, see
+// Identity.MarshalBinary. Clients flag the hello, or their probes when there is no hello, and servers answer
+// a flagged frame with a flagged one.
+const (
+	frameMagic        uint16 = 0x4B54 // "KT"
+	frameHeaderSize          = 40     // size of the header fields every version shares
+	frameHeaderSizeV2        = 48
+	maxHeaderSize            = 1024
+
+	// FrameVersion1 is the first version of the binary wire protocol.
+	FrameVersion1 uint8 = 1
+	// FrameVersion2 adds the time the server sent the reply.
+	FrameVersion2 uint8 = 2
+	// CurrentFrameVersion is the highest version this package speaks.
+	CurrentFrameVersion = FrameVersion2
+
+	// MaxFramePayload is the largest payload a frame may carry.
+	MaxFramePayload = 1 << 20
+)
+
+// Wire formats a Client can use to encode probes.
+const (
+	// WireText is the legacy newline terminated RFC3339Nano timestamp answered with JSON.
+	WireText = "text"
+	// WireBinary is the versioned binary frame format.
+	WireBinary = "binary"
+)
+
+// FrameType identifies the purpose of a Frame.
+type FrameType uint8
+
+const (
+	// FrameHello is sent by a client to offer the highest version it speaks.
+	FrameHello FrameType = iota + 1
+	// FrameHelloAck is the server's answer to FrameHello with the version both sides will use.
+	FrameHelloAck
+	// FrameProbe is a probe sent by the client.
+	FrameProbe
+	// FrameReply is the server's answer to a FrameProbe.
+	FrameReply
+)
+
+// Flags of a Frame.
+const (
+	// FlagIdentity marks a frame whose payload starts with the Identity of the sender.
+	FlagIdentity uint16 = 1 << 0
+)
+
+// helloPayload is carried by FrameHello. The newline makes servers that only speak the text protocol answer
+// with an error straight away instead of waiting for the end of a line that never comes.
+var helloPayload = []byte("\n")
+
+// Frame is a single message of the binary wire protocol.
+type Frame struct {
+	Version    uint8
+	Type       FrameType
+	Flags      uint16
+	Seq        uint32
+	ProbeID    uint64
+	ClientTime int64 // unix nanoseconds when the client sent the probe
+	ServerTime int64 // unix nanoseconds when the server received the probe
+	// ServerSendTime is the unix nanoseconds when the server sent the reply, only carried from version 2 on.
+	ServerSendTime int64
+	Payload        []byte
+}
+
+// headerSize returns the size of the header for the frame version.
+func (f *Frame) headerSize() int {
+	if f.Version >= FrameVersion2 {
+		return frameHeaderSizeV2
+	}
+	return frameHeaderSize
+}
+
+// MarshalBinary encodes the frame into its wire representation.
+func (f *Frame) MarshalBinary() ([]byte, error) {
+	if len(f.Payload) > MaxFramePayload {
+		return nil, fmt.Errorf("frame payload of %d bytes exceeds the maximum of %d", len(f.Payload), MaxFramePayload)
+	}
+	headerLen := f.headerSize()
+	buf := make([]byte, headerLen+len(f.Payload))
+	binary.BigEndian.PutUint16(buf[0:], frameMagic)
+	buf[2] = f.Version
+	buf[3] = uint8(f.Type)
+	binary.BigEndian.PutUint16(buf[4:], f.Flags)
+	binary.BigEndian.PutUint16(buf[6:], uint16(headerLen))
+	binary.BigEndian.PutUint32(buf[8:], f.Seq)
+	binary.BigEndian.PutUint32(buf[12:], uint32(len(f.Payload)))
+	binary.BigEndian.PutUint64(buf[16:], f.ProbeID)
+	binary.BigEndian.PutUint64(buf[24:], uint64(f.ClientTime))
+	binary.BigEndian.PutUint64(buf[32:], uint64(f.ServerTime))
+	if f.Version >= FrameVersion2 {
+		binary.BigEndian.PutUint64(buf[40:], uint64(f.ServerSendTime))
+	}
+	copy(buf[headerLen:], f.Payload)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a frame from a complete wire representation, for example a datagram.
+func (f *Frame) UnmarshalBinary(data []byte) error {
+	if len(data) < frameHeaderSize {
+		return errors.New("frame is shorter than the header")
+	}
+	headerLen, payloadLen, err := f.decodeHeader(data[:frameHeaderSize])
+	if err != nil {
+		return err
+	}
+	if len(data) != headerLen+payloadLen {
+		return fmt.Errorf("frame is %d bytes but the header says %d", len(data), headerLen+payloadLen)
+	}
+	f.decodeExtension(data[frameHeaderSize:headerLen])
+	f.Payload = append([]byte(nil), data[headerLen:]...)
+	return nil
+}
+
+// decodeHeader fills the shared header fields of f and returns the header and payload length announced by it.
+// Versions newer than CurrentFrameVersion are decoded as far as the shared fields go so that a hello can still be
+// answered with a lower version.
+func (f *Frame) decodeHeader(hdr []byte) (int, int, error) {
+	if binary.BigEndian.Uint16(hdr[0:]) != frameMagic {
+		return 0, 0, errors.New("not a kitter frame")
+	}
+	f.Version = hdr[2]
+	if f.Version == 0 {
+		return 0, 0, errors.New("invalid frame version 0")
+	}
+	f.Type = FrameType(hdr[3])
+	f.Flags = binary.BigEndian.Uint16(hdr[4:])
+	headerLen := int(binary.BigEndian.Uint16(hdr[6:]))
+	if headerLen < frameHeaderSize || headerLen > maxHeaderSize {
+		return 0, 0, fmt.Errorf("invalid frame header length %d", headerLen)
+	}
+	f.Seq = binary.BigEndian.Uint32(hdr[8:])
+	payloadLen := binary.BigEndian.Uint32(hdr[12:])
+	if payloadLen > MaxFramePayload {
+		return 0, 0, fmt.Errorf("frame payload of %d bytes exceeds the maximum of %d", payloadLen, MaxFramePayload)
+	}
+	f.ProbeID = binary.BigEndian.Uint64(hdr[16:])
+	f.ClientTime = int64(binary.BigEndian.Uint64(hdr[24:]))
+	f.ServerTime = int64(binary.BigEndian.Uint64(hdr[32:]))
+	return headerLen, int(payloadLen), nil
+}
+
+// decodeExtension decodes the header fields that follow the shared header.
+// Fields added by versions newer than this one are ignored.
+func (f *Frame) decodeExtension(ext []byte) {
+	if f.Version >= FrameVersion2 && len(ext) >= frameHeaderSizeV2-frameHeaderSize {
+		f.ServerSendTime = int64(binary.BigEndian.Uint64(ext[0:]))
+	}
+}
+
+// ReadFrame reads a single frame from a stream.
+func ReadFrame(r io.Reader) (*Frame, error) {
+	_, f, err := readFrameBytes(r, 0)
+	return f, err
+}
+
+// readFrameBytes reads a single frame from a stream and returns both its wire representation and the decoded frame.
+// Frames larger than maxSize bytes are rejected with errProbeTooLarge before their payload is read, 0 does not limit them.
+func readFrameBytes(r io.Reader, maxSize int) ([]byte, *Frame, error) {
+	hdr := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	f := &Frame{}
+	headerLen, payloadLen, err := f.decodeHeader(hdr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if maxSize > 0 && headerLen+payloadLen > maxSize {
+		return nil, nil, errProbeTooLarge
+	}
+	data := make([]byte, headerLen+payloadLen)
+	copy(data, hdr)
+	if _, err := io.ReadFull(r, data[frameHeaderSize:]); err != nil {
+		return nil, nil, err
+	}
+	f.decodeExtension(data[frameHeaderSize:headerLen])
+	f.Payload = data[headerLen:]
+	return data, f, nil
+}
+
+// WriteFrame writes a single frame to a stream.
+func WriteFrame(w io.Writer, f *Frame) error {
+	buf, err := f.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// isFrame reports whether data starts with the frame magic.
+func isFrame(data []byte) bool {
+	return len(data) >= 2 && binary.BigEndian.Uint16(data) == frameMagic
+}
+
+// peekFrame reports whether the next bytes on the reader are a frame, without consuming them.
+func peekFrame(reader *bufio.Reader) (bool, error) {
+	head, err := reader.Peek(2)
+	if err != nil {
+		return false, err
+	}
+	return isFrame(head), nil
+}
+
+// negotiateVersion returns the version both sides speak given the version offered by a peer.
+func negotiateVersion(offered uint8) uint8 {
+	if offered < CurrentFrameVersion {
+		return offered
+	}
+	return CurrentFrameVersion
+}
@@ -0,0 +1,132 @@
+package netapi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_FrameRoundTrip(t *testing.T) {
+	frame := &Frame{
+		Version:    CurrentFrameVersion,
+		Type:       FrameProbe,
+		Flags:      3,
+		Seq:        42,
+		ProbeID:    7,
+		ClientTime: time.Now().UnixNano(),
+		ServerTime: time.Now().Add(time.Millisecond).UnixNano(),
+		Payload:    []byte("payload"),
+	}
+	frame.ServerSendTime = frame.ServerTime + 1000
+	data, err := frame.MarshalBinary()
+	require.NoError(t, err)
+
+	// decode from a datagram
+	decoded := &Frame{}
+	require.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Equal(t, frame, decoded)
+
+	// decode from a stream
+	streamed, err := ReadFrame(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, frame, streamed)
+
+	// version 1 frames do not carry the server send time
+	frame.Version = FrameVersion1
+	data, err = frame.MarshalBinary()
+	require.NoError(t, err)
+	v1 := &Frame{}
+	require.NoError(t, v1.UnmarshalBinary(data))
+	assert.Zero(t, v1.ServerSendTime)
+
+	// a truncated frame is rejected
+	assert.Error(t, decoded.UnmarshalBinary(data[:len(data)-1]))
+	// text probes are not frames
+	assert.False(t, isFrame([]byte(time.Now().Format(time.RFC3339Nano))))
+}
+
+func Test_BinaryProbe(t *testing.T) {
+	srv, err := NewServer("tcp", "127.0.0.1:1126")
+	require.NoError(t, err)
+	readCh := make(chan struct{})
+	go func() {
+		_ = srv.Run(context.Background(), readCh)
+	}()
+	<-readCh
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+
+	client, err := NewClient("tcp", "127.0.0.1:1126", WithWire(WireBinary))
+	require.NoError(t, err)
+	require.NoError(t, client.Connect())
+	defer func(client Client) {
+		_ = client.Close()
+	}(client)
+	assert.Equal(t, CurrentFrameVersion, client.(*TCPClient).version)
+
+	for i := 1; i <= 2; i++ {
+		resp, err := client.Probe()
+		require.NoError(t, err)
+		assert.Equal(t, uint32(i), resp.Seq)
+		assert.NotEmpty(t, resp.ServerTime)
+		assert.NotEmpty(t, resp.ClientDone)
+		assert.NotEmpty(t, resp.ServerSendTime)
+	}
+}
+
+// legacyServer answers like a kitter server that only speaks the text protocol:
+// one line per connection and an error without a newline when the line is not a timestamp.
+func legacyServer(t *testing.T, addr string) net.Listener {
+	l, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer func(conn net.Conn) {
+					_ = conn.Close()
+				}(conn)
+				data, err := bufio.NewReader(conn).ReadBytes('\n')
+				if err != nil {
+					return
+				}
+				resp, err := processTimestamp(&Request{Data: data, Server: addr})
+				if err != nil {
+					_, _ = conn.Write([]byte("failed to process data"))
+					return
+				}
+				_, _ = conn.Write(append(resp, '\n'))
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func Test_BinaryFallbackToText(t *testing.T) {
+	l := legacyServer(t, "127.0.0.1:1127")
+	defer func(l net.Listener) {
+		_ = l.Close()
+	}(l)
+
+	client, err := NewClient("tcp", "127.0.0.1:1127", WithWire(WireBinary))
+	require.NoError(t, err)
+	require.NoError(t, client.Connect())
+	defer func(client Client) {
+		_ = client.Close()
+	}(client)
+	assert.Equal(t, uint8(0), client.(*TCPClient).version)
+
+	resp, err := client.Probe()
+	require.NoError(t, err)
+	assert.NotEmpty(t, resp.ServerTime)
+}
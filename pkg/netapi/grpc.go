@@ -0,0 +1,623 @@
+package netapi
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jdambly/kitter/pkg/netapi/kitterpb"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+// The Kitter gRPC service is defined in kitterpb/kitter.proto, so grpcurl and any other gRPC client can call it:
+//
+//	service Kitter {
+//	  rpc Ping(Frame) returns (Frame);
+//	  rpc PingStream(stream Frame) returns (stream Frame);
+//	}
+//
+// The data of a Frame is a frame of the binary wire protocol, or a text probe and its JSON Response. The servers also
+// serve the standard health and reflection services.
+const (
+	grpcServiceName = "kitter.Kitter"
+	grpcPingMethod  = "/" + grpcServiceName + "/Ping"
+	grpcStreamName  = "PingStream"
+	grpcStreamPath  = "/" + grpcServiceName + "/" + grpcStreamName
+
+	// grpcCodecName is the content subtype of the clients released before the service was defined in protobuf,
+	// application/grpc+kitter.
+	grpcCodecName = "kitter"
+)
+
+//go:generate protoc --go_out=kitterpb --go_opt=paths=source_relative --proto_path=kitterpb kitterpb/kitter.proto
+
+func init() {
+	encoding.RegisterCodec(frameCodec{})
+}
+
+// frameCodec is the codec of the clients released before the service was defined in protobuf. Their messages are
+// the data of a Frame without the protobuf encoding, the servers keep answering them.
+type frameCodec struct{}
+
+// Marshal encodes v, a *kitterpb.Frame.
+func (frameCodec) Marshal(v any) ([]byte, error) {
+	frame, ok := v.(*kitterpb.Frame)
+	if !ok {
+		return nil, fmt.Errorf("kitter codec can not encode %T", v)
+	}
+	return frame.GetData(), nil
+}
+
+// Unmarshal copies data into v, a *kitterpb.Frame, the codec does not own data once it returns.
+func (frameCodec) Unmarshal(data []byte, v any) error {
+	frame, ok := v.(*kitterpb.Frame)
+	if !ok {
+		return fmt.Errorf("kitter codec can not decode into %T", v)
+	}
+	frame.Data = append(frame.Data[:0], data...)
+	return nil
+}
+
+// Name returns the content subtype of the codec.
+func (frameCodec) Name() string {
+	return grpcCodecName
+}
+
+// kitterService is implemented by the servers of the Kitter service.
+type kitterService interface {
+	// ping answers a single probe, it returns nil when the handler does not answer it.
+	ping(ctx context.Context, probe []byte) ([]byte, error)
+	// header returns the metadata sent back to the client with the first reply of an RPC.
+	header() metadata.MD
+}
+
+// kitterServiceDesc describes the Kitter service to grpc.Server.RegisterService.
+var kitterServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcServiceName,
+	HandlerType: (*kitterService)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Ping",
+		Handler:    pingHandler,
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    grpcStreamName,
+		Handler:       pingStreamHandler,
+		ServerStreams: true,
+		ClientStreams: true,
+	}},
+}
+
+// pingStreamDesc describes the PingStream RPC to the clients.
+var pingStreamDesc = kitterServiceDesc.Streams[0]
+
+// pingHandler answers a unary Ping.
+func pingHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	probe := &kitterpb.Frame{}
+	if err := dec(probe); err != nil {
+		return nil, err
+	}
+	if err := grpc.SetHeader(ctx, srv.(kitterService).header()); err != nil {
+		return nil, err
+	}
+	handler := func(ctx context.Context, req any) (any, error) {
+		reply, err := srv.(kitterService).ping(ctx, req.(*kitterpb.Frame).GetData())
+		if err != nil {
+			return nil, err
+		}
+		if reply == nil {
+			// a unary RPC has to be answered, even when the handler drops the probe
+			return nil, status.Error(codes.Aborted, "the probe was not answered")
+		}
+		return &kitterpb.Frame{Data: reply}, nil
+	}
+	if interceptor == nil {
+		return handler(ctx, probe)
+	}
+	return interceptor(ctx, probe, &grpc.UnaryServerInfo{Server: srv, FullMethod: grpcPingMethod}, handler)
+}
+
+// pingStreamHandler answers every probe received on a PingStream until the client closes it.
+func pingStreamHandler(srv any, stream grpc.ServerStream) error {
+	if err := stream.SetHeader(srv.(kitterService).header()); err != nil {
+		return err
+	}
+	for {
+		probe := &kitterpb.Frame{}
+		if err := stream.RecvMsg(probe); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		reply, err := srv.(kitterService).ping(stream.Context(), probe.GetData())
+		if err != nil {
+			return err
+		}
+		if reply == nil {
+			// the handler does not answer this probe
+			continue
+		}
+		if err := stream.SendMsg(&kitterpb.Frame{Data: reply}); err != nil {
+			return err
+		}
+	}
+}
+
+// identityMetadata announces id in the metadata of an RPC.
+func identityMetadata(id Identity) metadata.MD {
+	md := metadata.MD{}
+	for name, value := range map[string]string{
+		headerPod: id.Pod, headerNamespace: id.Namespace, headerNode: id.Node, headerZone: id.Zone,
+	} {
+		if value != "" {
+			md.Set(name, value)
+		}
+	}
+	return md
+}
+
+// identityFromMetadata returns the identity announced in the metadata of an RPC, nil when there is none.
+func identityFromMetadata(md metadata.MD) *Identity {
+	get := func(name string) string {
+		if values := md.Get(name); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	return Identity{
+		Pod:       get(headerPod),
+		Namespace: get(headerNamespace),
+		Node:      get(headerNode),
+		Zone:      get(headerZone),
+	}.ptr()
+}
+
+// GRPCServer is a struct that represents a gRPC probe server.
+// It serves the Kitter service, a unary Ping and a bidirectional PingStream answering the same probes as the TCP
+// server, so probes go through the HTTP/2 multiplexing and flow control the production services use.
+type GRPCServer struct {
+	// Addr is the address where the server is hosted.
+	Addr string
+
+	// Config holds the options the server was created with.
+	Config ServerConfig
+
+	// handler answers the probes, the Handler of the Config wrapped in its Middlewares.
+	handler Handler
+
+	// limiter limits the rate of probes per source IP, nil when the rate is not limited.
+	limiter *rateLimiter
+
+	mu       sync.Mutex
+	server   *grpc.Server
+	health   *health.Server
+	listener net.Listener
+}
+
+// Run is a method on the GRPCServer struct that starts the gRPC server.
+// This function takes a channel and sends a signal when it's ready.
+// It serves probes until ctx is done or the server is shut down.
+func (g *GRPCServer) Run(ctx context.Context, readyCh chan<- struct{}) (err error) {
+	opts := []grpc.ServerOption{
+		// every probe knows the connection it was received on, like the probes of the stream servers
+		grpc.StatsHandler(connTagger{}),
+	}
+	if g.Config.ReadTimeout > 0 {
+		// the HTTP/2 and TLS handshakes have to finish in time, like the first probe on the stream servers
+		opts = append(opts, grpc.ConnectionTimeout(g.Config.ReadTimeout))
+	}
+	if g.Config.IdleTimeout > 0 {
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{MaxConnectionIdle: g.Config.IdleTimeout}))
+	}
+	if g.Config.MaxProbeSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(g.Config.MaxProbeSize))
+	}
+
+	listener, err := g.Config.Socket.listen(ctx, "tcp", g.Addr)
+	if err == nil && g.Config.TLS != nil {
+		var config *tls.Config
+		config, err = g.Config.TLS.ServerConfig()
+		opts = append(opts, grpc.Creds(credentials.NewTLS(config)))
+	}
+	srv := grpc.NewServer(opts...)
+	srv.RegisterService(&kitterServiceDesc, g)
+	// health checks and tools such as grpcurl work without the kitter client
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(grpcServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(srv, healthServer)
+	reflection.Register(srv)
+	if err == nil {
+		if g.Config.MaxConns > 0 {
+			listener = &limitListener{Listener: listener, max: g.Config.MaxConns}
+		}
+		g.mu.Lock()
+		g.server, g.health, g.listener = srv, healthServer, listener
+		g.mu.Unlock()
+	}
+	// Signal that the server is ready to accept connections
+	close(readyCh)
+	if err != nil {
+		if listener != nil {
+			_ = listener.Close()
+		}
+		return
+	}
+
+	// stop serving when the context is done
+	stop := context.AfterFunc(ctx, srv.Stop)
+	defer stop()
+
+	err = srv.Serve(listener)
+	if errors.Is(err, grpc.ErrServerStopped) {
+		return nil
+	}
+	return err
+}
+
+// ping answers a single probe received by either RPC.
+func (g *GRPCServer) ping(ctx context.Context, probe []byte) ([]byte, error) {
+	received := time.Now()
+	info := grpcConnInfo(ctx)
+	if !g.limiter.allow(info.RemoteAddr) {
+		reject(rejectRateLimit)
+		return nil, status.Error(codes.ResourceExhausted, "rate limit exceeded")
+	}
+	reply, err := g.handle(&Request{
+		Data:     probe,
+		Binary:   isFrame(probe),
+		Received: received,
+		Conn:     info,
+		Server:   g.Addr,
+		Config:   g.Config,
+	})
+	if err != nil {
+		log.Debug().Err(err).Str("client", info.RemoteAddr).Uint64("conn", info.ID).Msg("could not process gRPC probe")
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return reply, nil
+}
+
+// header announces the identity of the server to the clients.
+func (g *GRPCServer) header() metadata.MD {
+	return identityMetadata(g.Config.Identity)
+}
+
+// grpcConnInfo returns the ConnInfo of the connection an RPC was received on, with the identity the client announced
+// in its metadata.
+func grpcConnInfo(ctx context.Context) ConnInfo {
+	info, ok := ConnInfoFrom(ctx)
+	if !ok {
+		if p, ok := peer.FromContext(ctx); ok {
+			info.RemoteAddr = p.Addr.String()
+			if p.LocalAddr != nil {
+				info.LocalAddr = p.LocalAddr.String()
+			}
+		}
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		info.Peer = identityFromMetadata(md)
+	}
+	return info
+}
+
+// handle passes req to the handler of the server.
+func (g *GRPCServer) handle(req *Request) ([]byte, error) {
+	return g.Config.handle(g.handler, req)
+}
+
+// BoundAddr returns the address the gRPC Server is listening on.
+func (g *GRPCServer) BoundAddr() net.Addr {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.listener == nil {
+		return nil
+	}
+	return g.listener.Addr()
+}
+
+// Shutdown stops the gRPC Server from accepting connections and waits for the RPCs in flight to finish.
+// Health checks report the server as not serving while it drains. Streams that are still open when ctx is done are
+// cancelled.
+func (g *GRPCServer) Shutdown(ctx context.Context) error {
+	g.mu.Lock()
+	srv, healthServer := g.server, g.health
+	g.mu.Unlock()
+	if srv == nil {
+		return errors.New("server not initialized")
+	}
+	healthServer.Shutdown()
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		srv.Stop()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Close shuts down the gRPC Server
+func (g *GRPCServer) Close() error {
+	g.mu.Lock()
+	srv := g.server
+	g.mu.Unlock()
+	if srv == nil {
+		return errors.New("server not initialized")
+	}
+	srv.Stop()
+	return nil
+}
+
+// ProcessData is a method on the GRPCServer struct that processes a message received by the Kitter service.
+func (g *GRPCServer) ProcessData(ctx context.Context, data []byte) ([]byte, error) {
+	info, _ := ConnInfoFrom(ctx)
+	return g.handle(&Request{
+		Data:   data,
+		Binary: isFrame(data),
+		Conn:   info,
+		Server: g.Addr,
+		Config: g.Config,
+	})
+}
+
+// connTagger adds the ConnInfo of every connection to the context of the RPCs received on it.
+type connTagger struct{}
+
+// TagConn returns ctx carrying the ConnInfo of the connection.
+func (connTagger) TagConn(ctx context.Context, tag *stats.ConnTagInfo) context.Context {
+	return WithConnInfo(ctx, ConnInfo{
+		ID:         nextConnID.Add(1),
+		RemoteAddr: tag.RemoteAddr.String(),
+		LocalAddr:  tag.LocalAddr.String(),
+	})
+}
+
+// HandleConn counts the connections being served.
+func (connTagger) HandleConn(ctx context.Context, s stats.ConnStats) {
+	switch s.(type) {
+	case *stats.ConnBegin:
+		metricAccepted.Inc()
+		metricConnections.Inc()
+	case *stats.ConnEnd:
+		metricConnections.Dec()
+	}
+}
+
+// TagRPC returns ctx unchanged.
+func (connTagger) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+// HandleRPC ignores the RPC stats, the probes are counted by the metrics middleware.
+func (connTagger) HandleRPC(context.Context, stats.RPCStats) {}
+
+// GRPCClient is a struct that represents a gRPC probe client.
+// It sends every probe as a unary Ping, or on a single PingStream when streaming is configured.
+type GRPCClient struct {
+	// addr is the address of the server.
+	addr string
+
+	// config holds the options the client was created with.
+	config ClientConfig
+
+	// conn is the gRPC connection to the server and stream the open PingStream when streaming.
+	conn   *grpc.ClientConn
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+
+	// connect is the time spent opening the connection not yet reported by a probe.
+	connect time.Duration
+
+	// payload is the padding sent with every probe.
+	payload []byte
+
+	// peer is the identity the server announced in its metadata, nil when it did not.
+	peer *Identity
+
+	// local is the local address of the connection, known once the first reply was received.
+	local string
+
+	// seq is the sequence number of the last probe and probeID identifies the probes of this client.
+	seq     uint32
+	probeID uint64
+}
+
+// Connect is a method on the GRPCClient struct that opens the connection to the server and waits for it to be ready,
+// so the time spent connecting is reported apart from the RPCs. When streaming, it also opens the PingStream.
+func (c *GRPCClient) Connect() error {
+	creds := insecure.NewCredentials()
+	if c.config.TLS != nil {
+		host, _, err := net.SplitHostPort(c.addr)
+		if err != nil {
+			return err
+		}
+		creds = credentials.NewTLS(c.config.TLS.ClientConfig(host))
+	}
+	// the address is already resolved, passthrough keeps gRPC from resolving it again
+	conn, err := grpc.NewClient("passthrough:///"+c.addr,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithContextDialer(c.dial),
+	)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn.Connect()
+	for state := conn.GetState(); state != connectivity.Ready; state = conn.GetState() {
+		if !conn.WaitForStateChange(ctx, state) {
+			_ = conn.Close()
+			return fmt.Errorf("connection to %s not ready: %w", c.addr, ctx.Err())
+		}
+	}
+	c.connect = time.Since(start)
+
+	ctx = metadata.NewOutgoingContext(context.Background(), identityMetadata(c.config.Identity))
+	if c.config.GRPCStream {
+		ctx, c.cancel = context.WithCancel(ctx)
+		c.stream, err = conn.NewStream(ctx, &pingStreamDesc, grpcStreamPath)
+		if err != nil {
+			c.cancel()
+			_ = conn.Close()
+			return err
+		}
+	}
+	c.conn = conn
+	return nil
+}
+
+// dial opens the connection to the server with the socket options of the client.
+func (c *GRPCClient) dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := c.config.dialer("tcp").DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.config.Socket.connected(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// SendData is a method on the GRPCClient struct that sends data as a single message and returns the reply.
+func (c *GRPCClient) SendData(data string) (string, error) {
+	reply := &kitterpb.Frame{}
+	if err := c.exchange(&kitterpb.Frame{Data: []byte(data)}, reply); err != nil {
+		return "", err
+	}
+	return string(reply.GetData()), nil
+}
+
+// exchange sends msg to the server and decodes its answer into reply.
+// Unary RPCs and the messages of a stream are given up on after 5 seconds, a stream that timed out is closed.
+func (c *GRPCClient) exchange(msg, reply *kitterpb.Frame) error {
+	if c.conn == nil {
+		return errors.New("connection not established")
+	}
+	if c.stream == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ctx = metadata.NewOutgoingContext(ctx, identityMetadata(c.config.Identity))
+		var header metadata.MD
+		var p peer.Peer
+		err := c.conn.Invoke(ctx, grpcPingMethod, msg, reply, grpc.Header(&header), grpc.Peer(&p))
+		if err == nil {
+			c.learn(header, &p)
+		}
+		return err
+	}
+
+	timer := time.AfterFunc(5*time.Second, c.cancel)
+	defer timer.Stop()
+	if err := c.stream.SendMsg(msg); err != nil {
+		return err
+	}
+	if err := c.stream.RecvMsg(reply); err != nil {
+		return err
+	}
+	if c.peer == nil && c.local == "" {
+		// the header is received before the first reply, so this does not block
+		header, err := c.stream.Header()
+		if err != nil {
+			return err
+		}
+		p, _ := peer.FromContext(c.stream.Context())
+		c.learn(header, p)
+	}
+	return nil
+}
+
+// learn records the identity of the server and the local address of the connection from the first reply.
+func (c *GRPCClient) learn(header metadata.MD, p *peer.Peer) {
+	if c.peer == nil {
+		c.peer = identityFromMetadata(header)
+	}
+	if c.local == "" && p != nil && p.LocalAddr != nil {
+		c.local = p.LocalAddr.String()
+	}
+}
+
+// Probe is a method on the GRPCClient struct that sends a single probe and returns the server's Response.
+// The first probe on a connection also reports the time spent connecting.
+func (c *GRPCClient) Probe() (Response, error) {
+	resp, err := c.probe()
+	if err != nil {
+		return resp, err
+	}
+	if c.connect > 0 {
+		resp.Connect = c.connect.Seconds()
+		c.connect = 0
+	}
+	identify(&resp, c.config.Identity, c.peer)
+	return resp, nil
+}
+
+// probe sends a single probe in the configured wire format.
+func (c *GRPCClient) probe() (Response, error) {
+	c.seq++
+	if c.config.Wire != WireBinary {
+		return textProbe(c.SendData, c.payload)
+	}
+
+	probe := newProbeFrame(CurrentFrameVersion, c.seq, c.probeID, c.payload)
+	probe.ClientTime = time.Now().UnixNano()
+	data, err := probe.MarshalBinary()
+	if err != nil {
+		return Response{}, err
+	}
+	msg := &kitterpb.Frame{}
+	err = c.exchange(&kitterpb.Frame{Data: data}, msg)
+	dStamp := time.Now()
+	if err != nil {
+		return Response{}, err
+	}
+	reply := &Frame{}
+	if err := reply.UnmarshalBinary(msg.GetData()); err != nil {
+		return Response{}, err
+	}
+	if err := checkReply(probe, reply); err != nil {
+		return Response{}, err
+	}
+	if err := checkReplySize(reply, len(c.payload), c.config.ReplySize); err != nil {
+		return Response{}, err
+	}
+	return frameResponse(reply, c.local, c.addr, dStamp), nil
+}
+
+// Close is a method on the GRPCClient struct that closes the stream and the connection to the server.
+func (c *GRPCClient) Close() error {
+	if c.conn == nil {
+		return errors.New("connection not established")
+	}
+	if c.stream != nil {
+		_ = c.stream.CloseSend()
+		c.cancel()
+	}
+	return c.conn.Close()
+}
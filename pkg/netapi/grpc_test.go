@@ -0,0 +1,147 @@
+package netapi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jdambly/kitter/pkg/netapi/kitterpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+)
+
+func Test_GRPCProbe(t *testing.T) {
+	config := writeTestCerts(t, t.TempDir(), 30)
+	reloader, err := NewCertReloader(config)
+	require.NoError(t, err)
+
+	var peers []*Identity
+	record := func(next Handler) Handler {
+		return HandlerFunc(func(req *Request) ([]byte, error) {
+			peers = append(peers, req.Conn.Peer)
+			return next.Handle(req)
+		})
+	}
+	plain, err := NewServer("grpc", "127.0.0.1:0",
+		WithServerIdentity(Identity{Node: "node-1"}), WithMiddleware(record))
+	require.NoError(t, err)
+	startServer(t, plain)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(plain)
+	secure, err := NewServer("grpc", "127.0.0.1:0", WithServerTLS(reloader))
+	require.NoError(t, err)
+	startServer(t, secure)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(secure)
+
+	for _, tt := range []struct {
+		name string
+		srv  Server
+		opts []ClientOption
+	}{
+		{name: "unary", srv: plain, opts: []ClientOption{WithWire(WireBinary)}},
+		{name: "stream", srv: plain, opts: []ClientOption{WithWire(WireBinary), WithGRPCStream(true)}},
+		{name: "text", srv: plain, opts: []ClientOption{WithWire(WireText)}},
+		{name: "tls stream", srv: secure, opts: []ClientOption{WithWire(WireBinary), WithGRPCStream(true), WithTLS(reloader)}},
+	} {
+		opts := append([]ClientOption{WithPayloadSize(16), WithIdentity(Identity{Pod: "client"})}, tt.opts...)
+		client, err := NewClient("grpc", tt.srv.BoundAddr().String(), opts...)
+		require.NoError(t, err, tt.name)
+		require.NoError(t, client.Connect(), tt.name)
+
+		for i := range 2 {
+			resp, err := client.Probe()
+			require.NoError(t, err, tt.name)
+			assert.NotEmpty(t, resp.ServerTime, tt.name)
+			assert.Equal(t, 16, resp.PayloadSize, tt.name)
+			assert.Equal(t, &Identity{Pod: "client"}, resp.ClientIdentity, tt.name)
+			// only the first probe on a connection reports the time spent connecting
+			assert.Equal(t, i == 0, resp.Connect > 0, tt.name)
+			if tt.srv == plain {
+				assert.Equal(t, &Identity{Node: "node-1"}, resp.ServerIdentity, tt.name)
+			}
+		}
+		_ = client.Close()
+	}
+	require.Len(t, peers, 6)
+	for _, id := range peers {
+		assert.Equal(t, &Identity{Pod: "client"}, id, "the identity of the client is known to the handlers")
+	}
+}
+
+func Test_GRPCRateLimit(t *testing.T) {
+	srv, err := NewServer("grpc", "127.0.0.1:0", WithRateLimit(0.001, 1))
+	require.NoError(t, err)
+	startServer(t, srv)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+
+	client, err := NewClient("grpc", srv.BoundAddr().String(), WithWire(WireBinary))
+	require.NoError(t, err)
+	require.NoError(t, client.Connect())
+	defer func(client Client) {
+		_ = client.Close()
+	}(client)
+
+	_, err = client.Probe()
+	require.NoError(t, err)
+	// the burst is used up by the first probe
+	_, err = client.Probe()
+	assert.ErrorContains(t, err, "rate limit")
+}
+
+func Test_GRPCStandardClients(t *testing.T) {
+	srv, err := NewServer("grpc", "127.0.0.1:0")
+	require.NoError(t, err)
+	startServer(t, srv)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+
+	conn, err := grpc.NewClient("passthrough:///"+srv.BoundAddr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer func(conn *grpc.ClientConn) {
+		_ = conn.Close()
+	}(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a plain protobuf client and a client of the kitter codec get the same answer
+	probe := &kitterpb.Frame{Data: []byte(time.Now().Format(time.RFC3339Nano))}
+	for _, opts := range [][]grpc.CallOption{nil, {grpc.CallContentSubtype(grpcCodecName)}} {
+		reply := &kitterpb.Frame{}
+		require.NoError(t, conn.Invoke(ctx, grpcPingMethod, probe, reply, opts...))
+		assert.Contains(t, string(reply.GetData()), "serverTime")
+	}
+
+	health, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: grpcServiceName})
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, health.GetStatus())
+
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	}))
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	var services []string
+	for _, service := range resp.GetListServicesResponse().GetService() {
+		services = append(services, service.GetName())
+	}
+	assert.Contains(t, services, grpcServiceName)
+	require.NoError(t, stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: grpcServiceName},
+	}))
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	assert.NotEmpty(t, resp.GetFileDescriptorResponse().GetFileDescriptorProto(), "the service is described to grpcurl")
+}
@@ -0,0 +1,304 @@
+package netapi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Request is a single probe received by a server.
+type Request struct {
+	// Data is the probe as it was received: a text line, or a complete encoded frame when Binary is set.
+	Data   []byte
+	Binary bool
+
+	// Received is the moment the server read the probe.
+	Received time.Time
+
+	// TTL is the TTL or hop limit of the datagram carrying the probe, 0 when the server does not read it.
+	TTL int
+
+	// Conn identifies the connection the probe was received on and the client that sent it.
+	Conn ConnInfo
+
+	// Server is the address the server was configured to listen on.
+	Server string
+
+	// Config is the configuration of the server that received the probe.
+	Config ServerConfig
+}
+
+// ConnInfo identifies the connection a probe was received on.
+type ConnInfo struct {
+	// ID is unique for every connection accepted by the process, it is 0 for datagrams.
+	ID uint64
+
+	// RemoteAddr is the address of the client and LocalAddr the address of the server end of the connection.
+	RemoteAddr string
+	LocalAddr  string
+
+	// Peer is the identity the client announced in its hello, or on its probes over UDP and QUIC, nil when it did not.
+	Peer *Identity
+}
+
+// nextConnID is the ID of the last connection accepted by the process.
+var nextConnID atomic.Uint64
+
+// newConnInfo returns the ConnInfo of a newly accepted connection.
+func newConnInfo(conn net.Conn) ConnInfo {
+	return ConnInfo{
+		ID:         nextConnID.Add(1),
+		RemoteAddr: conn.RemoteAddr().String(),
+		LocalAddr:  conn.LocalAddr().String(),
+	}
+}
+
+type connInfoKey struct{}
+
+// WithConnInfo returns a copy of ctx carrying info, see Server.ProcessData.
+func WithConnInfo(ctx context.Context, info ConnInfo) context.Context {
+	return context.WithValue(ctx, connInfoKey{}, info)
+}
+
+// ConnInfoFrom returns the ConnInfo carried by ctx, if any.
+func ConnInfoFrom(ctx context.Context) (ConnInfo, bool) {
+	info, ok := ctx.Value(connInfoKey{}).(ConnInfo)
+	return info, ok
+}
+
+// receivedAt returns the time the probe was received, or now if the transport did not record it.
+func (r *Request) receivedAt() time.Time {
+	if r.Received.IsZero() {
+		return time.Now()
+	}
+	return r.Received
+}
+
+// Handler answers the probes received by a server.
+// The reply is written back to the client as is, a nil reply means nothing is sent back.
+type Handler interface {
+	Handle(req *Request) ([]byte, error)
+}
+
+// HandlerFunc is an adapter to allow the use of ordinary functions as a Handler.
+type HandlerFunc func(req *Request) ([]byte, error)
+
+// Handle calls f(req).
+func (f HandlerFunc) Handle(req *Request) ([]byte, error) {
+	return f(req)
+}
+
+// Middleware wraps a Handler to add behavior such as logging, authorization or metrics.
+type Middleware func(next Handler) Handler
+
+// Chain wraps handler with middlewares. The first middleware is the outermost one and sees every request first.
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// HandlerFactory creates a Handler from the argument given after the colon in a handler spec, for example
+// "10ms" in "delay:10ms". The argument is empty when the spec has none.
+type HandlerFactory func(arg string) (Handler, error)
+
+// MiddlewareFactory creates a Middleware from the argument given after the colon in a middleware spec.
+type MiddlewareFactory func(arg string) (Middleware, error)
+
+var (
+	registryMu  sync.RWMutex
+	handlers    = make(map[string]HandlerFactory)
+	middlewares = make(map[string]MiddlewareFactory)
+)
+
+// RegisterHandler makes a handler available by name to NewHandler.
+// It is meant to be called from an init function and panics if the name is registered twice.
+func RegisterHandler(name string, factory HandlerFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, dup := handlers[name]; dup {
+		panic("netapi: RegisterHandler called twice for handler " + name)
+	}
+	handlers[name] = factory
+}
+
+// RegisterMiddleware makes a middleware available by name to NewMiddleware.
+// It is meant to be called from an init function and panics if the name is registered twice.
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, dup := middlewares[name]; dup {
+		panic("netapi: RegisterMiddleware called twice for middleware " + name)
+	}
+	middlewares[name] = factory
+}
+
+// Handlers returns the names of the registered handlers.
+func Handlers() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(handlers))
+	for name := range handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewHandler creates the registered handler named by spec, "name" or "name:arg".
+func NewHandler(spec string) (Handler, error) {
+	name, arg, _ := strings.Cut(spec, ":")
+	registryMu.RLock()
+	factory, ok := handlers[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown handler %q", name)
+	}
+	return factory(arg)
+}
+
+// NewMiddleware creates the registered middleware named by spec, "name" or "name:arg".
+func NewMiddleware(spec string) (Middleware, error) {
+	name, arg, _ := strings.Cut(spec, ":")
+	registryMu.RLock()
+	factory, ok := middlewares[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown middleware %q", name)
+	}
+	return factory(arg)
+}
+
+func init() {
+	RegisterHandler("timestamp", noArg("timestamp", TimestampHandler))
+	RegisterHandler("echo", noArg("echo", EchoHandler))
+	RegisterHandler("discard", noArg("discard", DiscardHandler))
+	RegisterHandler("delay", func(arg string) (Handler, error) {
+		delay, err := time.ParseDuration(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delay %q: %w", arg, err)
+		}
+		return Chain(TimestampHandler, DelayMiddleware(delay)), nil
+	})
+
+	RegisterMiddleware("log", func(string) (Middleware, error) {
+		return LoggingMiddleware, nil
+	})
+	RegisterMiddleware("allow", func(arg string) (Middleware, error) {
+		return AllowMiddleware(strings.Split(arg, ",")...)
+	})
+}
+
+// noArg returns a HandlerFactory for a handler that takes no argument.
+func noArg(name string, handler Handler) HandlerFactory {
+	return func(arg string) (Handler, error) {
+		if arg != "" {
+			return nil, fmt.Errorf("the %s handler takes no argument", name)
+		}
+		return handler, nil
+	}
+}
+
+// TimestampHandler is the default handler. It answers every probe with the server timestamps.
+var TimestampHandler = HandlerFunc(func(req *Request) ([]byte, error) {
+	if !req.Binary {
+		return processTimestamp(req)
+	}
+	frame := &Frame{}
+	if err := frame.UnmarshalBinary(req.Data); err != nil {
+		return nil, err
+	}
+	reply, err := processFrame(frame, req)
+	if err != nil {
+		return nil, err
+	}
+	return reply.MarshalBinary()
+})
+
+// EchoHandler reflects every probe without reading the server clock, so clients only measure the RTT.
+// Binary probes are sent back as replies and text probes as a Response that only carries the client timestamp.
+var EchoHandler = HandlerFunc(func(req *Request) ([]byte, error) {
+	if !req.Binary {
+		stamp, _, err := decodeTextProbe(strings.TrimSuffix(string(req.Data), "\n"))
+		if err != nil {
+			return nil, err
+		}
+		return marshalResponse(Response{ClientTime: stamp})
+	}
+	frame := &Frame{}
+	if err := frame.UnmarshalBinary(req.Data); err != nil {
+		return nil, err
+	}
+	peer, err := splitIdentity(frame)
+	if err != nil {
+		return nil, err
+	}
+	if peer != nil {
+		// the identity of the client must not be reflected as if it was the identity of the server
+		if err := withIdentity(frame, req.Config.Identity); err != nil {
+			return nil, err
+		}
+	}
+	frame.Type = FrameReply
+	return frame.MarshalBinary()
+})
+
+// DiscardHandler reads the probes and never answers them, the server acts as a sink.
+var DiscardHandler = HandlerFunc(func(*Request) ([]byte, error) {
+	return nil, nil
+})
+
+// DelayMiddleware holds every probe for delay before passing it on, to simulate a slow server.
+func DelayMiddleware(delay time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(req *Request) ([]byte, error) {
+			time.Sleep(delay)
+			return next.Handle(req)
+		})
+	}
+}
+
+// LoggingMiddleware logs every probe and the outcome of handling it.
+func LoggingMiddleware(next Handler) Handler {
+	return HandlerFunc(func(req *Request) ([]byte, error) {
+		reply, err := next.Handle(req)
+		log.Debug().Err(err).Str("client", req.Conn.RemoteAddr).Uint64("conn", req.Conn.ID).Bool("binary", req.Binary).
+			Int("size", len(req.Data)).Int("reply", len(reply)).Msg("handled probe")
+		return reply, err
+	})
+}
+
+// AllowMiddleware only answers probes from clients inside one of the CIDRs, other probes are rejected.
+func AllowMiddleware(cidrs ...string) (Middleware, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return func(next Handler) Handler {
+		return HandlerFunc(func(req *Request) ([]byte, error) {
+			host, _, err := net.SplitHostPort(req.Conn.RemoteAddr)
+			if err != nil {
+				host = req.Conn.RemoteAddr
+			}
+			ip := net.ParseIP(host)
+			for _, ipNet := range nets {
+				if ip != nil && ipNet.Contains(ip) {
+					return next.Handle(req)
+				}
+			}
+			return nil, fmt.Errorf("client %s is not allowed", req.Conn.RemoteAddr)
+		})
+	}, nil
+}
@@ -0,0 +1,153 @@
+package netapi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NewHandler(t *testing.T) {
+	for _, spec := range []string{"timestamp", "echo", "discard", "delay:1ms"} {
+		handler, err := NewHandler(spec)
+		require.NoError(t, err, spec)
+		assert.NotNil(t, handler, spec)
+	}
+
+	for _, spec := range []string{"missing", "delay", "delay:soon", "echo:1"} {
+		_, err := NewHandler(spec)
+		assert.Error(t, err, spec)
+	}
+
+	assert.Panics(t, func() {
+		RegisterHandler("echo", noArg("echo", EchoHandler))
+	})
+}
+
+func Test_ChainOrder(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(req *Request) ([]byte, error) {
+				order = append(order, name)
+				return next.Handle(req)
+			})
+		}
+	}
+
+	_, err := Chain(DiscardHandler, mark("first"), mark("second")).Handle(&Request{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first", "second"}, order)
+}
+
+func Test_ServerConfigHandle(t *testing.T) {
+	allow, err := AllowMiddleware("10.0.0.0/8")
+	require.NoError(t, err)
+	config := ServerConfig{Handler: EchoHandler, Middlewares: []Middleware{allow}}
+	req := &Request{Data: []byte("ping\n"), Conn: ConnInfo{RemoteAddr: "10.1.2.3:5000"}}
+
+	// the Handler NewServer built is used as it is
+	reply, err := config.handle(DiscardHandler, req)
+	require.NoError(t, err)
+	assert.Empty(t, reply)
+
+	// servers created without NewServer wrap the Handler of the config in its middlewares
+	reply, err = config.handle(nil, req)
+	require.NoError(t, err)
+	assert.Contains(t, string(reply), "ping", "answered by the echo handler")
+	req.Conn.RemoteAddr = "192.168.1.1:5000"
+	_, err = (&UDPServer{Config: config}).handle(req)
+	assert.Error(t, err)
+}
+
+func Test_AllowMiddleware(t *testing.T) {
+	allow, err := AllowMiddleware("10.0.0.0/8")
+	require.NoError(t, err)
+	handler := Chain(DiscardHandler, allow)
+
+	_, err = handler.Handle(&Request{Conn: ConnInfo{RemoteAddr: "10.1.2.3:5000"}})
+	assert.NoError(t, err)
+	_, err = handler.Handle(&Request{Conn: ConnInfo{RemoteAddr: "192.168.1.1:5000"}})
+	assert.Error(t, err)
+
+	_, err = AllowMiddleware("not a cidr")
+	assert.Error(t, err)
+}
+
+func Test_EchoAndDelayHandlers(t *testing.T) {
+	delay, err := NewHandler("delay:20ms")
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		handler    Handler
+		serverTime bool
+		minRTT     time.Duration
+	}{
+		{handler: EchoHandler},
+		{handler: delay, serverTime: true, minRTT: 20 * time.Millisecond},
+	} {
+		srv, err := NewServer("tcp", "127.0.0.1:1130", WithHandler(tt.handler))
+		require.NoError(t, err)
+		readCh := make(chan struct{})
+		go func() {
+			_ = srv.Run(context.Background(), readCh)
+		}()
+		<-readCh
+
+		for _, wire := range []string{WireText, WireBinary} {
+			client, err := NewClient("tcp", "127.0.0.1:1130", WithWire(wire))
+			require.NoError(t, err)
+			require.NoError(t, client.Connect())
+
+			resp, err := client.Probe()
+			require.NoError(t, err, wire)
+			assert.Equal(t, tt.serverTime, resp.ServerTime != "", wire)
+
+			cStamp, err := time.Parse(time.RFC3339Nano, resp.ClientTime)
+			require.NoError(t, err)
+			dStamp, err := time.Parse(time.RFC3339Nano, resp.ClientDone)
+			require.NoError(t, err)
+			assert.GreaterOrEqual(t, dStamp.Sub(cStamp), tt.minRTT, wire)
+			_ = client.Close()
+		}
+		require.NoError(t, srv.Close())
+	}
+}
+
+func Test_RequestConnInfo(t *testing.T) {
+	conns := make(chan ConnInfo, 4)
+	recorder := HandlerFunc(func(req *Request) ([]byte, error) {
+		conns <- req.Conn
+		return TimestampHandler.Handle(req)
+	})
+	srv, err := NewServer("tcp", "127.0.0.1:0", WithHandler(recorder))
+	require.NoError(t, err)
+	startServer(t, srv)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+
+	var ids []uint64
+	for i := 0; i < 2; i++ {
+		client, err := NewClient("tcp", srv.BoundAddr().String())
+		require.NoError(t, err)
+		require.NoError(t, client.Connect())
+		for probe := 0; probe < 2; probe++ {
+			resp, err := client.Probe()
+			require.NoError(t, err)
+			info := <-conns
+			local := client.(*TCPClient).conn.LocalAddr().String()
+			assert.Equal(t, local, info.RemoteAddr)
+			assert.Equal(t, local, resp.Client)
+			assert.Equal(t, srv.BoundAddr().String(), info.LocalAddr)
+			ids = append(ids, info.ID)
+		}
+		_ = client.Close()
+	}
+	// every connection has its own ID, shared by all of its probes
+	assert.Equal(t, ids[0], ids[1])
+	assert.Equal(t, ids[2], ids[3])
+	assert.NotEqual(t, ids[0], ids[2])
+}
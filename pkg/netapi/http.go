@@ -0,0 +1,458 @@
+package netapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ProbePath is the path HTTP probes are sent to.
+const ProbePath = "/probe"
+
+// HTTP versions an HTTP Client can probe with.
+const (
+	// HTTP1 is HTTP/1.1, over TLS when the client has TLS configured.
+	HTTP1 = "1.1"
+	// HTTP2Cleartext is HTTP/2 without TLS with prior knowledge, h2c.
+	HTTP2Cleartext = "h2c"
+	// HTTP2 is HTTP/2 over TLS, h2. It requires TLS.
+	HTTP2 = "h2"
+)
+
+// The headers an HTTP client announces its Identity in.
+const (
+	headerPod       = "Kitter-Pod"
+	headerNamespace = "Kitter-Namespace"
+	headerNode      = "Kitter-Node"
+	headerZone      = "Kitter-Zone"
+)
+
+// HTTPServer is a struct that represents an HTTP probe server.
+// Every POST to ProbePath carries a text probe in its body and is answered with the same Response JSON as the text
+// protocol, so probes can go through ingress controllers and service mesh sidecars that only proxy HTTP.
+// It speaks HTTP/1.1 and h2c, and h2 as well when TLS is configured.
+type HTTPServer struct {
+	// Addr is the address where the server is hosted.
+	Addr string
+
+	// Config holds the options the server was created with.
+	Config ServerConfig
+
+	// handler answers the probes, the Handler of the Config wrapped in its Middlewares.
+	handler Handler
+
+	// limiter limits the rate of probes per source IP, nil when the rate is not limited.
+	limiter *rateLimiter
+
+	mu       sync.Mutex
+	server   *http.Server
+	listener net.Listener
+}
+
+// Run is a method on the HTTPServer struct that starts the HTTP server.
+// This function takes a channel and sends a signal when it's ready.
+// It serves probes until ctx is done or the server is shut down.
+func (h *HTTPServer) Run(ctx context.Context, readyCh chan<- struct{}) (err error) {
+	srv := &http.Server{
+		Handler:     h,
+		ReadTimeout: h.Config.ReadTimeout,
+		IdleTimeout: h.Config.IdleTimeout,
+		// every probe knows the connection it was received on, like the probes of the stream servers
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return WithConnInfo(ctx, newConnInfo(conn))
+		},
+		Protocols: new(http.Protocols),
+	}
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetUnencryptedHTTP2(true)
+
+	listener, err := h.Config.Socket.listen(ctx, "tcp", h.Addr)
+	if err == nil && h.Config.TLS != nil {
+		srv.TLSConfig, err = h.Config.TLS.ServerConfig()
+		if err == nil {
+			withALPN(srv.TLSConfig, "h2", "http/1.1")
+		}
+		srv.Protocols.SetHTTP2(true)
+	}
+	if err == nil {
+		if h.Config.MaxConns > 0 {
+			listener = &limitListener{Listener: listener, max: h.Config.MaxConns}
+		}
+		h.mu.Lock()
+		h.server, h.listener = srv, listener
+		h.mu.Unlock()
+	}
+	// Signal that the server is ready to accept connections
+	close(readyCh)
+	if err != nil {
+		if listener != nil {
+			_ = listener.Close()
+		}
+		return
+	}
+
+	// stop serving when the context is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = srv.Close()
+	})
+	defer stop()
+
+	if srv.TLSConfig != nil {
+		err = srv.ServeTLS(listener, "", "")
+	} else {
+		err = srv.Serve(listener)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// BoundAddr returns the address the HTTP Server is listening on.
+func (h *HTTPServer) BoundAddr() net.Addr {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.listener == nil {
+		return nil
+	}
+	return h.listener.Addr()
+}
+
+// Shutdown stops the HTTP Server from accepting connections and waits for the probes in flight to be answered.
+func (h *HTTPServer) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	srv := h.server
+	h.mu.Unlock()
+	if srv == nil {
+		return errors.New("server not initialized")
+	}
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		// the probes did not finish in time
+		_ = srv.Close()
+	}
+	return err
+}
+
+// Close shuts down the HTTP Server
+func (h *HTTPServer) Close() error {
+	h.mu.Lock()
+	srv := h.server
+	h.mu.Unlock()
+	if srv == nil {
+		return errors.New("server not initialized")
+	}
+	return srv.Close()
+}
+
+// ServeHTTP answers a single HTTP probe.
+func (h *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
+	if r.URL.Path != ProbePath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "probes must be sent with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	info, _ := ConnInfoFrom(r.Context())
+	if !h.limiter.allow(info.RemoteAddr) {
+		reject(rejectRateLimit)
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	body := io.Reader(r.Body)
+	if h.Config.MaxProbeSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, int64(h.Config.MaxProbeSize))
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			reject(rejectTooLarge)
+			http.Error(w, errProbeTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "failed to read input", http.StatusBadRequest)
+		return
+	}
+	info.Peer = identityFromHeader(r.Header)
+
+	response, err := h.handle(&Request{
+		Data:     data,
+		Received: received,
+		Conn:     info,
+		Server:   h.Addr,
+		Config:   h.Config,
+	})
+	if err != nil {
+		http.Error(w, "failed to process data", http.StatusBadRequest)
+		return
+	}
+	if response == nil {
+		// the handler does not answer this probe
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(response); err != nil {
+		log.Debug().Err(err).Str("client", info.RemoteAddr).Msg("could not write HTTP probe response")
+	}
+}
+
+// handle passes req to the handler of the server.
+func (h *HTTPServer) handle(req *Request) ([]byte, error) {
+	return h.Config.handle(h.handler, req)
+}
+
+// ProcessData is a method on the HTTPServer struct that processes the body of an HTTP probe.
+func (h *HTTPServer) ProcessData(ctx context.Context, data []byte) ([]byte, error) {
+	info, _ := ConnInfoFrom(ctx)
+	return h.handle(&Request{
+		Data:   data,
+		Conn:   info,
+		Server: h.Addr,
+		Config: h.Config,
+	})
+}
+
+// limitListener closes the connections accepted above max, so HTTP servers honor MaxConns like the stream servers.
+type limitListener struct {
+	net.Listener
+	max int
+
+	mu     sync.Mutex
+	active int
+}
+
+// Accept waits for the next connection below the limit.
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		l.mu.Lock()
+		if l.active >= l.max {
+			l.mu.Unlock()
+			reject(rejectMaxConns)
+			_ = conn.Close()
+			continue
+		}
+		l.active++
+		l.mu.Unlock()
+		return &limitConn{Conn: conn, release: l.release}, nil
+	}
+}
+
+// release frees the slot of a closed connection.
+func (l *limitListener) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+}
+
+// limitConn frees its slot in the limitListener once it is closed.
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+// Close closes the connection and frees its slot.
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// setIdentityHeader announces id in the headers of an HTTP probe.
+func setIdentityHeader(header http.Header, id Identity) {
+	for name, value := range map[string]string{
+		headerPod: id.Pod, headerNamespace: id.Namespace, headerNode: id.Node, headerZone: id.Zone,
+	} {
+		if value != "" {
+			header.Set(name, value)
+		}
+	}
+}
+
+// identityFromHeader returns the identity announced in the headers of an HTTP probe, nil when there is none.
+func identityFromHeader(header http.Header) *Identity {
+	return Identity{
+		Pod:       header.Get(headerPod),
+		Namespace: header.Get(headerNamespace),
+		Node:      header.Get(headerNode),
+		Zone:      header.Get(headerZone),
+	}.ptr()
+}
+
+// HTTPClient is a struct that represents an HTTP probe client.
+// Its probes are POSTs of a text probe to the ProbePath of the server, timed phase by phase with httptrace.
+type HTTPClient struct {
+	// addr is the address of the server.
+	addr string
+
+	// config holds the options the client was created with.
+	config ClientConfig
+
+	// client sends the probes, its transport keeps the connection to the server open between probes.
+	client    *http.Client
+	transport *http.Transport
+
+	// payload is the padding sent with every probe.
+	payload []byte
+}
+
+// Connect is a method on the HTTPClient struct that prepares the transport for the configured HTTP version.
+// The connection itself is opened by the first probe, so its phases are part of the measurement.
+func (c *HTTPClient) Connect() error {
+	transport := &http.Transport{
+		Proxy:       http.ProxyFromEnvironment,
+		DialContext: c.dial,
+		Protocols:   new(http.Protocols),
+		// a probe must never wait for a response to another probe
+		MaxConnsPerHost: 1,
+	}
+	switch c.config.HTTPVersion {
+	case HTTP1:
+		transport.Protocols.SetHTTP1(true)
+	case HTTP2Cleartext:
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	case HTTP2:
+		transport.Protocols.SetHTTP2(true)
+	}
+	if c.config.TLS != nil {
+		host, _, err := net.SplitHostPort(c.addr)
+		if err != nil {
+			return err
+		}
+		transport.TLSClientConfig = c.config.TLS.ClientConfig(host)
+	}
+	c.transport = transport
+	c.client = &http.Client{
+		Transport: transport,
+		Timeout:   5 * time.Second,
+	}
+	return nil
+}
+
+// dial opens the connections of the transport with the socket options of the client.
+func (c *HTTPClient) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := c.config.dialer(network).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.config.Socket.connected(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// url returns the URL probes are sent to.
+func (c *HTTPClient) url() string {
+	scheme := "http"
+	if c.config.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + c.addr + ProbePath
+}
+
+// SendData is a method on the HTTPClient struct that POSTs data to the server and returns the body of the response.
+func (c *HTTPClient) SendData(data string) (string, error) {
+	resp, _, err := c.post(context.Background(), data)
+	return resp, err
+}
+
+// post sends data to the server and returns the body of the response and the HTTP protocol used.
+func (c *HTTPClient) post(ctx context.Context, data string) (string, string, error) {
+	if c.client == nil {
+		return "", "", errors.New("connection not established")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url(), bytes.NewBufferString(data))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	setIdentityHeader(req.Header, c.config.Identity)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(resp.Body)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("server answered %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return string(body), resp.Proto, nil
+}
+
+// Probe is a method on the HTTPClient struct that sends a single HTTP probe and reports the time spent connecting,
+// in the TLS handshake and waiting for the first byte of the response. Connect and TLSHandshake are 0 when the
+// probe reused the connection of an earlier one.
+func (c *HTTPClient) Probe() (Response, error) {
+	var connectStart, connectDone, tlsStart, tlsDone, wrote, firstByte time.Time
+	trace := &httptrace.ClientTrace{
+		ConnectStart:         func(string, string) { connectStart = time.Now() },
+		ConnectDone:          func(string, string, error) { connectDone = time.Now() },
+		TLSHandshakeStart:    func() { tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { tlsDone = time.Now() },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { wrote = time.Now() },
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}
+	ctx := httptrace.WithClientTrace(context.Background(), trace)
+
+	var proto string
+	resp, err := textProbe(func(data string) (string, error) {
+		var body string
+		var err error
+		body, proto, err = c.post(ctx, data)
+		return body, err
+	}, c.payload)
+	if err != nil {
+		return resp, err
+	}
+	resp.HTTPProtocol = proto
+	resp.Connect = phase(connectStart, connectDone)
+	resp.TLSHandshake = phase(tlsStart, tlsDone)
+	resp.FirstByte = phase(wrote, firstByte)
+	identify(&resp, c.config.Identity, nil)
+	return resp, nil
+}
+
+// phase returns the duration between start and done in seconds, 0 when the phase did not happen.
+func phase(start, done time.Time) float64 {
+	if start.IsZero() || done.IsZero() {
+		return 0
+	}
+	return done.Sub(start).Seconds()
+}
+
+// Close is a method on the HTTPClient struct that closes the connections to the server.
+func (c *HTTPClient) Close() error {
+	if c.transport == nil {
+		return errors.New("connection not established")
+	}
+	c.transport.CloseIdleConnections()
+	return nil
+}
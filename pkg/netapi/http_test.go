@@ -0,0 +1,96 @@
+package netapi
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_HTTPProbe(t *testing.T) {
+	config := writeTestCerts(t, t.TempDir(), 30)
+	reloader, err := NewCertReloader(config)
+	require.NoError(t, err)
+
+	plain, err := NewServer("http", "127.0.0.1:0", WithServerIdentity(Identity{Node: "node-1"}))
+	require.NoError(t, err)
+	startServer(t, plain)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(plain)
+	secure, err := NewServer("http", "127.0.0.1:0", WithServerTLS(reloader))
+	require.NoError(t, err)
+	startServer(t, secure)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(secure)
+
+	for _, tt := range []struct {
+		version  string
+		srv      Server
+		opts     []ClientOption
+		protocol string
+	}{
+		{version: HTTP1, srv: plain, protocol: "HTTP/1.1"},
+		{version: HTTP2Cleartext, srv: plain, protocol: "HTTP/2.0"},
+		{version: HTTP1, srv: secure, opts: []ClientOption{WithTLS(reloader)}, protocol: "HTTP/1.1"},
+		{version: HTTP2, srv: secure, opts: []ClientOption{WithTLS(reloader)}, protocol: "HTTP/2.0"},
+	} {
+		opts := append([]ClientOption{WithHTTPVersion(tt.version), WithPayloadSize(16)}, tt.opts...)
+		client, err := NewClient("http", tt.srv.BoundAddr().String(), opts...)
+		require.NoError(t, err, tt.version)
+		require.NoError(t, client.Connect())
+
+		resp, err := client.Probe()
+		require.NoError(t, err, tt.version)
+		assert.Equal(t, tt.protocol, resp.HTTPProtocol, tt.version)
+		assert.NotEmpty(t, resp.ServerTime)
+		assert.Equal(t, 16, resp.PayloadSize)
+		assert.Greater(t, resp.Connect, float64(0), tt.version)
+		assert.Greater(t, resp.FirstByte, float64(0), tt.version)
+		assert.Equal(t, tt.srv.(*HTTPServer).Config.TLS != nil, resp.TLSHandshake > 0, tt.version)
+		if tt.srv == plain {
+			assert.Equal(t, &Identity{Node: "node-1"}, resp.ServerIdentity)
+		}
+
+		// the second probe reuses the connection
+		resp, err = client.Probe()
+		require.NoError(t, err, tt.version)
+		assert.Zero(t, resp.Connect, tt.version)
+		assert.Zero(t, resp.TLSHandshake, tt.version)
+		_ = client.Close()
+	}
+
+	_, err = NewClient("http", "127.0.0.1:1", WithHTTPVersion(HTTP2))
+	assert.Error(t, err, "h2 requires TLS")
+	_, err = NewClient("http", "127.0.0.1:1", WithHTTPVersion("3"))
+	assert.Error(t, err)
+}
+
+func Test_HTTPServerRejects(t *testing.T) {
+	srv, err := NewServer("http", "127.0.0.1:0", WithMaxProbeSize(64))
+	require.NoError(t, err)
+	startServer(t, srv)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+	url := "http://" + srv.BoundAddr().String()
+
+	resp, err := http.Get(url + ProbePath)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, err = http.Post(url+"/other", "text/plain", nil)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	client, err := NewClient("http", srv.BoundAddr().String(), WithPayloadSize(128))
+	require.NoError(t, err)
+	require.NoError(t, client.Connect())
+	_, err = client.Probe()
+	assert.ErrorContains(t, err, "413")
+	_ = client.Close()
+}
@@ -0,0 +1,210 @@
+package netapi
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The environment variables Identity is read from. They are meant to be set with the Kubernetes Downward API,
+// the zone is a label of the node and has to be copied into the pod, for example by an init container.
+const (
+	EnvPodName      = "POD_NAME"
+	EnvPodNamespace = "POD_NAMESPACE"
+	EnvNodeName     = "NODE_NAME"
+	EnvZone         = "NODE_ZONE"
+)
+
+// maxIdentityField is the longest value a field of an Identity may have on the wire.
+const maxIdentityField = 255
+
+// Identity describes where one end of a probe runs in a Kubernetes cluster.
+type Identity struct {
+	Pod       string `json:"pod,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Node      string `json:"node,omitempty"`
+	Zone      string `json:"zone,omitempty"`
+}
+
+// IdentityFromEnv returns the Identity found in the Downward API environment variables.
+func IdentityFromEnv() Identity {
+	return Identity{
+		Pod:       os.Getenv(EnvPodName),
+		Namespace: os.Getenv(EnvPodNamespace),
+		Node:      os.Getenv(EnvNodeName),
+		Zone:      os.Getenv(EnvZone),
+	}
+}
+
+// IsZero reports whether no field of the Identity is set.
+func (i Identity) IsZero() bool {
+	return i == Identity{}
+}
+
+// ptr returns a pointer to a copy of the Identity, or nil when it is zero so that it is left out of a Response.
+func (i Identity) ptr() *Identity {
+	if i.IsZero() {
+		return nil
+	}
+	return &i
+}
+
+// fields returns the fields of the Identity in their wire order.
+func (i *Identity) fields() []*string {
+	return []*string{&i.Pod, &i.Namespace, &i.Node, &i.Zone}
+}
+
+// identityFieldNames are the names of the fields of an Identity, in their wire order.
+var identityFieldNames = []string{"pod", "namespace", "node", "zone"}
+
+// field returns the value of the field called name, one of identityFieldNames.
+func (i Identity) field(name string) string {
+	if n := slices.Index(identityFieldNames, name); n >= 0 {
+		return *i.fields()[n]
+	}
+	return ""
+}
+
+// validate checks that the Identity can be carried by a frame.
+func (i Identity) validate() error {
+	for _, field := range i.fields() {
+		if len(*field) > maxIdentityField {
+			return fmt.Errorf("identity field %q is longer than %d bytes", *field, maxIdentityField)
+		}
+	}
+	return nil
+}
+
+// MarshalBinary encodes the Identity as its fields in wire order, every field prefixed by its length in one byte.
+func (i Identity) MarshalBinary() ([]byte, error) {
+	if err := i.validate(); err != nil {
+		return nil, err
+	}
+	var buf []byte
+	for _, field := range i.fields() {
+		buf = append(buf, byte(len(*field)))
+		buf = append(buf, *field...)
+	}
+	return buf, nil
+}
+
+// decodeIdentity decodes an Identity from the start of data and returns the number of bytes it used.
+func decodeIdentity(data []byte) (Identity, int, error) {
+	var id Identity
+	n := 0
+	for _, field := range id.fields() {
+		if n >= len(data) {
+			return id, 0, errors.New("identity is truncated")
+		}
+		size := int(data[n])
+		n++
+		if n+size > len(data) {
+			return id, 0, errors.New("identity is truncated")
+		}
+		*field = string(data[n : n+size])
+		n += size
+	}
+	return id, n, nil
+}
+
+// withIdentity prepends id to the payload of f and flags it. The flag is set even for a zero id, a peer answers a
+// flagged frame with its own identity.
+func withIdentity(f *Frame, id Identity) error {
+	encoded, err := id.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	f.Payload = append(encoded, f.Payload...)
+	f.Flags |= FlagIdentity
+	return nil
+}
+
+// splitIdentity removes the identity from the payload of a flagged frame and returns it.
+// It returns nil when the frame does not carry an identity.
+func splitIdentity(f *Frame) (*Identity, error) {
+	if f.Flags&FlagIdentity == 0 {
+		return nil, nil
+	}
+	id, n, err := decodeIdentity(f.Payload)
+	if err != nil {
+		return nil, err
+	}
+	f.Payload = f.Payload[n:]
+	f.Flags &^= FlagIdentity
+	return &id, nil
+}
+
+// frameIdentity returns the identity carried by the encoded frame data, nil when it carries none.
+func frameIdentity(data []byte) *Identity {
+	if !isFrame(data) {
+		return nil
+	}
+	frame := &Frame{}
+	if err := frame.UnmarshalBinary(data); err != nil {
+		return nil
+	}
+	id, _ := splitIdentity(frame)
+	return id
+}
+
+// announcedPeers remembers the identities that the clients of the servers without a hello announced on their first
+// probes, by the address of the client. The probes only carry the identity until the server answered with its own,
+// the later ones are attributed to the same client. A client is forgotten once it sent no probe for longer than idle.
+type announcedPeers struct {
+	idle time.Duration
+
+	mu     sync.Mutex
+	peers  map[string]*announcedPeer
+	pruned time.Time
+}
+
+// announcedPeer is the identity of a single client and when its last probe was received.
+type announcedPeer struct {
+	id   *Identity
+	seen time.Time
+}
+
+// newAnnouncedPeers creates the identities of the clients of a server, idle clients are forgotten after idle or
+// stampSessionTimeout when it is 0.
+func newAnnouncedPeers(idle time.Duration) *announcedPeers {
+	if idle == 0 {
+		idle = stampSessionTimeout
+	}
+	return &announcedPeers{
+		idle:  idle,
+		peers: make(map[string]*announcedPeer),
+	}
+}
+
+// peer returns the identity the client at addr announced on the probe data received at now or on an earlier one,
+// nil when it announced none.
+func (p *announcedPeers) peer(addr string, data []byte, now time.Time) *Identity {
+	if p == nil {
+		return nil
+	}
+	id := frameIdentity(data)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.Sub(p.pruned) > p.idle {
+		for client, peer := range p.peers {
+			if now.Sub(peer.seen) > p.idle {
+				delete(p.peers, client)
+			}
+		}
+		p.pruned = now
+	}
+	peer, ok := p.peers[addr]
+	if id != nil {
+		// a new client, or a client announcing itself again after a restart
+		p.peers[addr] = &announcedPeer{id: id, seen: now}
+		return id
+	}
+	if !ok || now.Sub(peer.seen) > p.idle {
+		return nil
+	}
+	peer.seen = now
+	return peer.id
+}
@@ -0,0 +1,100 @@
+package netapi
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_IdentityEncoding(t *testing.T) {
+	id := Identity{Pod: "kitter-abc", Namespace: "monitoring", Node: "node-1", Zone: "us-east-1a"}
+	data, err := id.MarshalBinary()
+	require.NoError(t, err)
+	decoded, n, err := decodeIdentity(append(data, "padding"...))
+	require.NoError(t, err)
+	assert.Equal(t, id, decoded)
+	assert.Equal(t, len(data), n)
+
+	_, _, err = decodeIdentity(data[:len(data)-1])
+	assert.Error(t, err)
+
+	_, err = Identity{Pod: strings.Repeat("x", maxIdentityField+1)}.MarshalBinary()
+	assert.Error(t, err)
+}
+
+func Test_IdentityExchange(t *testing.T) {
+	server := Identity{Pod: "server-0", Namespace: "kitter", Node: "node-1", Zone: "zone-a"}
+	client := Identity{Pod: "client-0", Namespace: "kitter", Node: "node-2", Zone: "zone-b"}
+
+	for _, protocol := range []string{"tcp", "udp"} {
+		srv, err := NewServer(protocol, "127.0.0.1:0", WithServerIdentity(server), WithReplyPayloadSize(64))
+		require.NoError(t, err)
+		startServer(t, srv)
+
+		for _, wire := range []string{WireText, WireBinary} {
+			c, err := NewClient(protocol, srv.BoundAddr().String(), WithWire(wire), WithIdentity(client), WithPayloadSize(32), WithReplySize(64))
+			require.NoError(t, err)
+			require.NoError(t, c.Connect())
+			for i := 0; i < 2; i++ {
+				resp, err := c.Probe()
+				require.NoError(t, err, protocol+" "+wire)
+				assert.Equal(t, &client, resp.ClientIdentity, protocol+" "+wire)
+				assert.Equal(t, &server, resp.ServerIdentity, protocol+" "+wire)
+				// the identity is not counted as payload
+				assert.Equal(t, 64, resp.PayloadSize, protocol+" "+wire)
+			}
+			_ = c.Close()
+		}
+		_ = srv.Close()
+	}
+}
+
+func Test_IdentityUnknown(t *testing.T) {
+	srv, err := NewServer("tcp", "127.0.0.1:0", WithHandler(EchoHandler))
+	require.NoError(t, err)
+	startServer(t, srv)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+
+	client := Identity{Pod: "client-0"}
+	c, err := NewClient("tcp", srv.BoundAddr().String(), WithWire(WireBinary), WithIdentity(client))
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer func(c Client) {
+		_ = c.Close()
+	}(c)
+
+	resp, err := c.Probe()
+	require.NoError(t, err)
+	assert.Equal(t, &client, resp.ClientIdentity)
+	assert.Nil(t, resp.ServerIdentity, "a server without an identity must not report one")
+}
+
+func Test_AnnouncedPeers(t *testing.T) {
+	id := Identity{Pod: "client-0", Node: "node-1"}
+	announced := &Frame{Version: CurrentFrameVersion, Type: FrameProbe}
+	require.NoError(t, withIdentity(announced, id))
+	withID, err := announced.MarshalBinary()
+	require.NoError(t, err)
+	withoutID, err := (&Frame{Version: CurrentFrameVersion, Type: FrameProbe}).MarshalBinary()
+	require.NoError(t, err)
+
+	peers := newAnnouncedPeers(time.Minute)
+	now := time.Now()
+	assert.Nil(t, peers.peer("10.0.0.1:1000", withoutID, now))
+	assert.Equal(t, &id, peers.peer("10.0.0.1:1000", withID, now))
+	assert.Equal(t, &id, peers.peer("10.0.0.1:1000", withoutID, now.Add(30*time.Second)), "later probes carry no identity")
+	assert.Nil(t, peers.peer("10.0.0.2:1000", withoutID, now))
+	assert.Nil(t, peers.peer("10.0.0.1:1000", []byte("2006-01-02T15:04:05Z"), now.Add(2*time.Minute)), "the idle client is forgotten")
+	assert.Empty(t, peers.peers)
+	assert.Equal(t, "node-1", id.field("node"))
+	assert.Empty(t, id.field(""))
+
+	// servers without the identities of their clients answer nil
+	var none *announcedPeers
+	assert.Nil(t, none.peer("10.0.0.1:1000", withID, now))
+}
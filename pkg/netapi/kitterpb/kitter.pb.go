@@ -0,0 +1,132 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: kitter.proto
+
+package kitterpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Frame is a probe or its reply.
+type Frame struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// data is a frame of the binary wire protocol, or a text probe and its JSON Response.
+	Data          []byte `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Frame) Reset() {
+	*x = Frame{}
+	mi := &file_kitter_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Frame) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Frame) ProtoMessage() {}
+
+func (x *Frame) ProtoReflect() protoreflect.Message {
+	mi := &file_kitter_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Frame.ProtoReflect.Descriptor instead.
+func (*Frame) Descriptor() ([]byte, []int) {
+	return file_kitter_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Frame) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+var File_kitter_proto protoreflect.FileDescriptor
+
+const file_kitter_proto_rawDesc = "" +
+	"\n" +
+	"\fkitter.proto\x12\x06kitter\"\x1b\n" +
+	"\x05Frame\x12\x12\n" +
+	"\x04data\x18\x01 \x01(\fR\x04data2^\n" +
+	"\x06Kitter\x12$\n" +
+	"\x04Ping\x12\r.kitter.Frame\x1a\r.kitter.Frame\x12.\n" +
+	"\n" +
+	"PingStream\x12\r.kitter.Frame\x1a\r.kitter.Frame(\x010\x01B/Z-github.com/jdambly/kitter/pkg/netapi/kitterpbb\x06proto3"
+
+var (
+	file_kitter_proto_rawDescOnce sync.Once
+	file_kitter_proto_rawDescData []byte
+)
+
+func file_kitter_proto_rawDescGZIP() []byte {
+	file_kitter_proto_rawDescOnce.Do(func() {
+		file_kitter_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_kitter_proto_rawDesc), len(file_kitter_proto_rawDesc)))
+	})
+	return file_kitter_proto_rawDescData
+}
+
+var file_kitter_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_kitter_proto_goTypes = []any{
+	(*Frame)(nil), // 0: kitter.Frame
+}
+var file_kitter_proto_depIdxs = []int32{
+	0, // 0: kitter.Kitter.Ping:input_type -> kitter.Frame
+	0, // 1: kitter.Kitter.PingStream:input_type -> kitter.Frame
+	0, // 2: kitter.Kitter.Ping:output_type -> kitter.Frame
+	0, // 3: kitter.Kitter.PingStream:output_type -> kitter.Frame
+	2, // [2:4] is the sub-list for method output_type
+	0, // [0:2] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_kitter_proto_init() }
+func file_kitter_proto_init() {
+	if File_kitter_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_kitter_proto_rawDesc), len(file_kitter_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_kitter_proto_goTypes,
+		DependencyIndexes: file_kitter_proto_depIdxs,
+		MessageInfos:      file_kitter_proto_msgTypes,
+	}.Build()
+	File_kitter_proto = out.File
+	file_kitter_proto_goTypes = nil
+	file_kitter_proto_depIdxs = nil
+}
@@ -0,0 +1,88 @@
+package netapi
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shutdownPollInterval is how often Shutdown checks for connections that became idle while draining.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// trackedConn is an accepted connection that knows whether it is waiting for the next probe.
+// Idle connections are closed straight away when the server shuts down, busy ones are allowed to finish.
+type trackedConn struct {
+	net.Conn
+	idle atomic.Bool
+}
+
+// connTracker keeps the set of active connections of a stream server.
+type connTracker struct {
+	mu       sync.Mutex
+	conns    map[*trackedConn]struct{}
+	draining bool
+}
+
+// add registers conn and returns false if the server is shutting down and conn must not be served.
+func (c *connTracker) add(conn *trackedConn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.draining {
+		return false
+	}
+	if c.conns == nil {
+		c.conns = make(map[*trackedConn]struct{})
+	}
+	c.conns[conn] = struct{}{}
+	return true
+}
+
+// remove forgets conn once it has been closed.
+func (c *connTracker) remove(conn *trackedConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.conns, conn)
+}
+
+// len returns the number of connections being served.
+func (c *connTracker) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.conns)
+}
+
+// drain stops new connections from being added.
+func (c *connTracker) drain() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.draining = true
+}
+
+// closeIdle closes the connections waiting for a probe and reports whether no connections are left.
+func (c *connTracker) closeIdle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for conn := range c.conns {
+		if conn.idle.Load() {
+			_ = conn.Close()
+		}
+	}
+	return len(c.conns) == 0
+}
+
+// closeAll closes every connection.
+func (c *connTracker) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for conn := range c.conns {
+		_ = conn.Close()
+	}
+}
+
+// isTemporary reports whether an Accept error is worth retrying, for example running out of file descriptors.
+func isTemporary(err error) bool {
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
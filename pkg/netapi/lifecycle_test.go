@@ -0,0 +1,128 @@
+package netapi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer runs srv on a random port and returns the channel receiving the result of Run.
+func startServer(t *testing.T, srv Server) <-chan error {
+	readCh := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Run(context.Background(), readCh)
+	}()
+	<-readCh
+	require.NotNil(t, srv.BoundAddr())
+	return errCh
+}
+
+func Test_BoundAddr(t *testing.T) {
+	for _, protocol := range []string{"tcp", "udp"} {
+		srv, err := NewServer(protocol, "127.0.0.1:0")
+		require.NoError(t, err)
+		assert.Nil(t, srv.BoundAddr(), protocol)
+		errCh := startServer(t, srv)
+
+		client, err := NewClient(protocol, srv.BoundAddr().String())
+		require.NoError(t, err)
+		require.NoError(t, client.Connect())
+		_, err = client.Probe()
+		require.NoError(t, err, protocol)
+		_ = client.Close()
+
+		require.NoError(t, srv.Shutdown(context.Background()))
+		assert.NoError(t, <-errCh, protocol)
+	}
+}
+
+func Test_ShutdownDrainsProbes(t *testing.T) {
+	delay, err := NewHandler("delay:200ms")
+	require.NoError(t, err)
+	srv, err := NewServer("tcp", "127.0.0.1:0", WithHandler(delay))
+	require.NoError(t, err)
+	errCh := startServer(t, srv)
+	addr := srv.BoundAddr().String()
+
+	// an idle connection is closed straight away
+	idle, err := NewClient("tcp", addr, WithWire(WireBinary))
+	require.NoError(t, err)
+	require.NoError(t, idle.Connect())
+	defer func(client Client) {
+		_ = client.Close()
+	}(idle)
+
+	busy, err := NewClient("tcp", addr, WithWire(WireBinary))
+	require.NoError(t, err)
+	require.NoError(t, busy.Connect())
+	defer func(client Client) {
+		_ = client.Close()
+	}(busy)
+	probeErr := make(chan error, 1)
+	go func() {
+		_, err := busy.Probe()
+		probeErr <- err
+	}()
+	// give the probe time to reach the handler
+	time.Sleep(50 * time.Millisecond)
+
+	require.NoError(t, srv.Shutdown(context.Background()))
+	assert.NoError(t, <-probeErr, "the probe in flight must be answered")
+	assert.NoError(t, <-errCh)
+
+	_, err = idle.Probe()
+	assert.Error(t, err)
+
+	// new connections are refused
+	late, err := NewClient("tcp", addr)
+	require.NoError(t, err)
+	assert.Error(t, late.Connect())
+}
+
+func Test_ShutdownTimeout(t *testing.T) {
+	delay, err := NewHandler("delay:1s")
+	require.NoError(t, err)
+	srv, err := NewServer("tcp", "127.0.0.1:0", WithHandler(delay))
+	require.NoError(t, err)
+	errCh := startServer(t, srv)
+
+	client, err := NewClient("tcp", srv.BoundAddr().String())
+	require.NoError(t, err)
+	require.NoError(t, client.Connect())
+	defer func(client Client) {
+		_ = client.Close()
+	}(client)
+	go func() {
+		_, _ = client.Probe()
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, srv.Shutdown(ctx), context.DeadlineExceeded)
+	assert.NoError(t, <-errCh)
+}
+
+func Test_RunStopsWithContext(t *testing.T) {
+	srv, err := NewServer("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	readCh := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Run(ctx, readCh)
+	}()
+	<-readCh
+
+	cancel()
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+}
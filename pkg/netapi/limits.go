@@ -0,0 +1,124 @@
+package netapi
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// errProbeTooLarge is returned when a probe is larger than the MaxProbeSize of the server.
+var errProbeTooLarge = errors.New("probe exceeds the maximum size")
+
+// DefaultMaxProbeSize is large enough for a probe carrying the largest payload in either wire format.
+const DefaultMaxProbeSize = MaxFramePayload + 1024
+
+// rateLimiterSweep is how often the rate limiter forgets the sources that stopped sending probes.
+const rateLimiterSweep = time.Minute
+
+// setReadDeadline sets the read deadline of conn to timeout from now, or clears it when timeout is 0.
+func setReadDeadline(conn net.Conn, timeout time.Duration) error {
+	if timeout <= 0 {
+		return conn.SetReadDeadline(time.Time{})
+	}
+	return conn.SetReadDeadline(time.Now().Add(timeout))
+}
+
+// setDeadline sets the read and write deadlines of conn to timeout from now, or clears them when timeout is 0.
+func setDeadline(conn net.Conn, timeout time.Duration) error {
+	if timeout <= 0 {
+		return conn.SetDeadline(time.Time{})
+	}
+	return conn.SetDeadline(time.Now().Add(timeout))
+}
+
+// readLine reads a newline terminated text probe, returning errProbeTooLarge once it grows past maxSize bytes.
+// A maxSize of 0 does not limit the line.
+func readLine(reader *bufio.Reader, maxSize int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if maxSize > 0 && len(line) > maxSize {
+			return nil, errProbeTooLarge
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return line, err
+		}
+	}
+}
+
+// bucket is the token bucket of a single source.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the rate of probes per source IP with a token bucket per source.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+// newRateLimiter returns a rateLimiter allowing rate probes per second with bursts of burst probes,
+// or nil when rate is 0 and probes are not limited.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		swept:   time.Now(),
+	}
+}
+
+// allow reports whether a probe from the client address may be answered and takes a token for it if so.
+func (l *rateLimiter) allow(client string) bool {
+	if l == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(client)
+	if err != nil {
+		host = client
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[host]
+	if !ok {
+		b = &bucket{tokens: l.burst}
+		l.buckets[host] = b
+	} else {
+		b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep forgets the sources whose bucket has filled up again, so a scan from many addresses does not pin memory.
+// It must be called with mu held.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < rateLimiterSweep {
+		return
+	}
+	l.swept = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for host, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, host)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package netapi
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RateLimiter(t *testing.T) {
+	limiter := newRateLimiter(1, 2)
+	assert.True(t, limiter.allow("10.0.0.1:1000"))
+	assert.True(t, limiter.allow("10.0.0.1:1001"), "the burst is shared by every port of the source")
+	assert.False(t, limiter.allow("10.0.0.1:1002"))
+	assert.True(t, limiter.allow("10.0.0.2:1000"), "every source has its own bucket")
+
+	// no limit
+	assert.Nil(t, newRateLimiter(0, 0))
+	var unlimited *rateLimiter
+	assert.True(t, unlimited.allow("10.0.0.1:1000"))
+}
+
+func Test_ReadLine(t *testing.T) {
+	reader := bufio.NewReaderSize(strings.NewReader("short\n"+strings.Repeat("x", 100)+"\n"), 16)
+	line, err := readLine(reader, 64)
+	require.NoError(t, err)
+	assert.Equal(t, "short\n", string(line))
+
+	_, err = readLine(reader, 64)
+	assert.ErrorIs(t, err, errProbeTooLarge)
+}
+
+func Test_ServerLimits(t *testing.T) {
+	srv, err := NewServer("tcp", "127.0.0.1:0",
+		WithMaxConns(1), WithIdleTimeout(100*time.Millisecond), WithMaxProbeSize(128))
+	require.NoError(t, err)
+	startServer(t, srv)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+	addr := srv.BoundAddr().String()
+
+	first, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(first)
+	// wait for the server to register the connection
+	time.Sleep(20 * time.Millisecond)
+
+	// a second connection is over the limit and closed by the server
+	second, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	require.NoError(t, second.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = second.Read(make([]byte, 1))
+	assert.Error(t, err)
+	_ = second.Close()
+
+	// the first connection sends nothing and is closed once it has been idle too long
+	require.NoError(t, first.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = first.Read(make([]byte, 1))
+	assert.Error(t, err)
+	time.Sleep(20 * time.Millisecond)
+
+	// a probe larger than the limit is rejected
+	client, err := NewClient("tcp", addr, WithPayloadSize(256))
+	require.NoError(t, err)
+	require.NoError(t, client.Connect())
+	_, err = client.Probe()
+	assert.Error(t, err)
+	_ = client.Close()
+
+	_, err = NewServer("tcp", "127.0.0.1:0", WithRateLimit(1, 0))
+	assert.Error(t, err)
+}
+
+func Test_UDPRateLimit(t *testing.T) {
+	srv, err := NewServer("udp", "127.0.0.1:0", WithRateLimit(0.001, 1))
+	require.NoError(t, err)
+	startServer(t, srv)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+
+	conn, err := net.Dial("udp", srv.BoundAddr().String())
+	require.NoError(t, err)
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	buf := make([]byte, maxDatagramSize)
+	for i, answered := range []bool{true, false} {
+		_, err = conn.Write([]byte(time.Now().Format(time.RFC3339Nano)))
+		require.NoError(t, err)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+		_, err = conn.Read(buf)
+		// the burst is used up by the first probe, the second one is dropped
+		assert.Equal(t, answered, err == nil, "probe %d", i)
+	}
+}
@@ -0,0 +1,92 @@
+package netapi
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The reasons a server rejects a connection or a probe, used as the reason label of kitter_server_rejected_total.
+const (
+	rejectMaxConns    = "max_conns"
+	rejectRateLimit   = "rate_limit"
+	rejectTooLarge    = "too_large"
+	rejectIdleTimeout = "idle_timeout"
+	rejectReadTimeout = "read_timeout"
+)
+
+// The metrics of the probes are labeled by client with a field of the identity the clients announce, for example
+// the node or the zone they run in, chosen by the ClientLabel of the server. The addresses of the clients are never
+// used, they change with every pod the clients run in and would create series without bound.
+var (
+	metricRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kitter_server_rejected_total",
+		Help: "connections and probes rejected by the limits of the server",
+	}, []string{"reason"})
+	metricConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "kitter_server_connections",
+		Help: "connections being served",
+	})
+	metricAccepted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "kitter_server_accepted_connections_total",
+		Help: "connections accepted by the server",
+	})
+	metricProbes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kitter_server_probes_total",
+		Help: "probes handled by the server",
+	}, []string{"client"})
+	metricProbeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kitter_server_probe_errors_total",
+		Help: "probes the handler failed to answer",
+	}, []string{"client"})
+	metricParseFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kitter_server_parse_failures_total",
+		Help: "probes with a timestamp or payload that could not be parsed",
+	}, []string{"client"})
+	metricReceivedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kitter_server_received_bytes_total",
+		Help: "bytes of the probes received from the client",
+	}, []string{"client"})
+	metricSentBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kitter_server_sent_bytes_total",
+		Help: "bytes of the replies sent to the client",
+	}, []string{"client"})
+	metricProcessing = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kitter_server_processing_seconds",
+		Help:    "time spent answering a probe",
+		Buckets: prometheus.ExponentialBuckets(1e-6, 4, 12), // 1µs to ~4s
+	}, []string{"client"})
+)
+
+// reject counts a connection or probe rejected for reason.
+func reject(reason string) {
+	metricRejected.WithLabelValues(reason).Inc()
+}
+
+// clientLabel returns the value of the client label of req, the field of the identity of the client chosen by the
+// ClientLabel of the server.
+func clientLabel(req *Request) string {
+	if req.Conn.Peer == nil {
+		return ""
+	}
+	return req.Conn.Peer.field(req.Config.ClientLabel)
+}
+
+// metricsMiddleware records the server metrics of every probe. It is the outermost middleware of every server,
+// so probes rejected by other middlewares are counted as errors.
+func metricsMiddleware(next Handler) Handler {
+	return HandlerFunc(func(req *Request) ([]byte, error) {
+		client := clientLabel(req)
+		start := time.Now()
+		reply, err := next.Handle(req)
+		metricProcessing.WithLabelValues(client).Observe(time.Since(start).Seconds())
+		metricProbes.WithLabelValues(client).Inc()
+		metricReceivedBytes.WithLabelValues(client).Add(float64(len(req.Data)))
+		metricSentBytes.WithLabelValues(client).Add(float64(len(reply)))
+		if err != nil {
+			metricProbeErrors.WithLabelValues(client).Inc()
+		}
+		return reply, err
+	})
+}
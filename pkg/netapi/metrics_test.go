@@ -0,0 +1,61 @@
+package netapi
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ServerMetrics(t *testing.T) {
+	srv, err := NewServer("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startServer(t, srv)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+
+	probes := testutil.ToFloat64(metricProbes.WithLabelValues(""))
+	failures := testutil.ToFloat64(metricParseFailures.WithLabelValues(""))
+	received := testutil.ToFloat64(metricReceivedBytes.WithLabelValues(""))
+
+	client, err := NewClient("tcp", srv.BoundAddr().String())
+	require.NoError(t, err)
+	require.NoError(t, client.Connect())
+	_, err = client.Probe()
+	require.NoError(t, err)
+	_, err = client.SendData("not a timestamp")
+	assert.Error(t, err)
+	_ = client.Close()
+
+	assert.Equal(t, probes+2, testutil.ToFloat64(metricProbes.WithLabelValues("")))
+	assert.Equal(t, failures+1, testutil.ToFloat64(metricParseFailures.WithLabelValues("")))
+	assert.Greater(t, testutil.ToFloat64(metricReceivedBytes.WithLabelValues("")), received)
+}
+
+func Test_ServerMetricsClientLabel(t *testing.T) {
+	for _, protocol := range []string{"tcp", "udp"} {
+		srv, err := NewServer(protocol, "127.0.0.1:0", WithServerClientLabel("node"))
+		require.NoError(t, err)
+		startServer(t, srv)
+
+		node := "node-" + protocol
+		client, err := NewClient(protocol, srv.BoundAddr().String(), WithWire(WireBinary),
+			WithIdentity(Identity{Pod: "client-0", Node: node}))
+		require.NoError(t, err)
+		require.NoError(t, client.Connect())
+		// over udp only the first probe carries the identity, the server remembers it for the second
+		for i := 0; i < 2; i++ {
+			_, err = client.Probe()
+			require.NoError(t, err, protocol)
+		}
+		_ = client.Close()
+		_ = srv.Close()
+
+		assert.Equal(t, float64(2), testutil.ToFloat64(metricProbes.WithLabelValues(node)), protocol)
+	}
+
+	_, err := NewServer("tcp", "127.0.0.1:0", WithServerClientLabel("ip"))
+	assert.Error(t, err)
+}
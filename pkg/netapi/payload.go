@@ -0,0 +1,65 @@
+package netapi
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// paddingPattern is repeated to fill probe payloads. It has no spaces or newlines so it can be carried by the
+// text protocol as well.
+var paddingPattern = []byte("kitter")
+
+// newPadding returns a payload of size bytes.
+func newPadding(size int) []byte {
+	if size <= 0 {
+		return nil
+	}
+	return bytes.Repeat(paddingPattern, size/len(paddingPattern)+1)[:size]
+}
+
+// validatePayloadSize checks that size can be carried by a probe.
+func validatePayloadSize(size int) error {
+	if size < 0 || size > MaxFramePayload {
+		return fmt.Errorf("payload size must be between 0 and %d bytes", MaxFramePayload)
+	}
+	return nil
+}
+
+// replyPayload returns the payload the server sends back: the configured size, or the size of the probe payload
+// when no size is configured.
+func replyPayload(configured int, probe []byte) []byte {
+	if configured > 0 {
+		return newPadding(configured)
+	}
+	return probe
+}
+
+// encodeTextProbe builds a text probe. Without a payload it is the bare timestamp legacy servers understand,
+// with a payload the timestamp is followed by the payload length and the payload itself.
+func encodeTextProbe(stamp string, payload []byte) string {
+	if len(payload) == 0 {
+		return stamp
+	}
+	return stamp + " " + strconv.Itoa(len(payload)) + " " + string(payload)
+}
+
+// decodeTextProbe splits a text probe into the timestamp and payload and checks the payload length.
+func decodeTextProbe(str string) (string, []byte, error) {
+	parts := strings.SplitN(str, " ", 3)
+	switch len(parts) {
+	case 1:
+		return parts[0], nil, nil
+	case 3:
+		size, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid payload length %q", parts[1])
+		}
+		if len(parts[2]) != size {
+			return "", nil, fmt.Errorf("payload is %d bytes, expected %d", len(parts[2]), size)
+		}
+		return parts[0], []byte(parts[2]), nil
+	}
+	return "", nil, fmt.Errorf("malformed probe with %d fields", len(parts))
+}
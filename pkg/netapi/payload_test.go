@@ -0,0 +1,67 @@
+package netapi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DecodeTextProbe(t *testing.T) {
+	stamp := time.Now().Format(time.RFC3339Nano)
+
+	got, payload, err := decodeTextProbe(encodeTextProbe(stamp, newPadding(10)))
+	require.NoError(t, err)
+	assert.Equal(t, stamp, got)
+	assert.Len(t, payload, 10)
+
+	// legacy probes carry only the timestamp
+	got, payload, err = decodeTextProbe(stamp)
+	require.NoError(t, err)
+	assert.Equal(t, stamp, got)
+	assert.Empty(t, payload)
+
+	// the payload must match the announced length
+	_, _, err = decodeTextProbe(stamp + " 10 kitter")
+	assert.Error(t, err)
+}
+
+func Test_ProbePayloadSize(t *testing.T) {
+	srv, err := NewServer("tcp", "127.0.0.1:1128", WithReplyPayloadSize(1400))
+	require.NoError(t, err)
+	readCh := make(chan struct{})
+	go func() {
+		_ = srv.Run(context.Background(), readCh)
+	}()
+	<-readCh
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+
+	for _, wire := range []string{WireText, WireBinary} {
+		client, err := NewClient("tcp", "127.0.0.1:1128", WithWire(wire), WithPayloadSize(1200), WithReplySize(1400))
+		require.NoError(t, err)
+		require.NoError(t, client.Connect())
+
+		resp, err := client.Probe()
+		require.NoError(t, err, wire)
+		assert.Equal(t, 1400, resp.PayloadSize, wire)
+		assert.Empty(t, resp.Payload, wire)
+		_ = client.Close()
+	}
+
+	// binary replies of another size than expected are errors, as truncated text replies are
+	client, err := NewClient("tcp", "127.0.0.1:1128", WithWire(WireBinary), WithPayloadSize(1200))
+	require.NoError(t, err)
+	require.NoError(t, client.Connect())
+	_, err = client.Probe()
+	assert.Error(t, err)
+	_ = client.Close()
+
+	_, err = NewClient("tcp", "127.0.0.1:1128", WithPayloadSize(-1))
+	assert.Error(t, err)
+	_, err = NewClient("tcp", "127.0.0.1:1128", WithReplySize(-1))
+	assert.Error(t, err)
+}
@@ -0,0 +1,102 @@
+package netapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// newProbeID returns a random identifier for the probes sent by a single client.
+func newProbeID() uint64 {
+	return rand.Uint64()
+}
+
+// textProbe sends a legacy text probe carrying payload using send and decodes the JSON response.
+// ClientDone is set to the moment the response was received.
+func textProbe(send func(data string) (string, error), payload []byte) (Response, error) {
+	var resp Response
+	data, err := send(encodeTextProbe(time.Now().Format(time.RFC3339Nano), payload))
+	dStamp := time.Now()
+	if err != nil {
+		return resp, err
+	}
+	if err := json.Unmarshal([]byte(data), &resp); err != nil {
+		return resp, err
+	}
+	if len(resp.Payload) != resp.PayloadSize {
+		return resp, fmt.Errorf("reply payload is %d bytes, expected %d", len(resp.Payload), resp.PayloadSize)
+	}
+	resp.Payload = ""
+	resp.ClientDone = dStamp.Format(time.RFC3339Nano)
+	return resp, nil
+}
+
+// newProbeFrame creates the probe frame for seq. The ClientTime is set by the caller right before it is sent.
+func newProbeFrame(version uint8, seq uint32, probeID uint64, payload []byte) *Frame {
+	return &Frame{
+		Version: version,
+		Type:    FrameProbe,
+		Seq:     seq,
+		ProbeID: probeID,
+		Payload: payload,
+	}
+}
+
+// identify fills the identities of a Response: self is the identity of the client and peer the identity the server
+// announced on the connection, text responses carry the identity of the server already.
+func identify(resp *Response, self Identity, peer *Identity) {
+	resp.ClientIdentity = self.ptr()
+	if resp.ServerIdentity == nil && peer != nil {
+		resp.ServerIdentity = peer.ptr()
+	}
+}
+
+// checkReply verifies that reply answers probe.
+func checkReply(probe, reply *Frame) error {
+	if reply.Type != FrameReply {
+		return fmt.Errorf("unexpected frame type %d in reply", reply.Type)
+	}
+	if reply.Seq != probe.Seq || reply.ProbeID != probe.ProbeID {
+		return fmt.Errorf("reply for probe %d/%d does not match probe %d/%d", reply.ProbeID, reply.Seq, probe.ProbeID, probe.Seq)
+	}
+	return nil
+}
+
+// checkReplySize verifies that the payload of reply is replySize bytes, or sent bytes when replySize is 0 as the
+// servers echo the probe payload by default.
+func checkReplySize(reply *Frame, sent, replySize int) error {
+	if replySize == 0 {
+		replySize = sent
+	}
+	if len(reply.Payload) != replySize {
+		return fmt.Errorf("reply payload is %d bytes, expected %d", len(reply.Payload), replySize)
+	}
+	return nil
+}
+
+// frameResponse converts a reply frame into a Response, the same struct the text protocol returns.
+// done is the moment the reply was received by the client.
+func frameResponse(reply *Frame, client, server string, done time.Time) Response {
+	cStamp := time.Unix(0, reply.ClientTime)
+	resp := Response{
+		ClientTime: cStamp.Format(time.RFC3339Nano),
+		Client:     client,
+		Server:     server,
+		ClientDone: done.Format(time.RFC3339Nano),
+		Seq:        reply.Seq,
+		ProbeID:    reply.ProbeID,
+		// the frame header already guarantees the payload length
+		PayloadSize: len(reply.Payload),
+	}
+	// handlers that do not read the server clock leave the server timestamps unset
+	if reply.ServerTime != 0 {
+		sStamp := time.Unix(0, reply.ServerTime)
+		resp.ServerTime = sStamp.Format(time.RFC3339Nano)
+		resp.Latency = sStamp.Sub(cStamp).Seconds()
+	}
+	if reply.Version >= FrameVersion2 && reply.ServerSendTime != 0 {
+		resp.ServerSendTime = time.Unix(0, reply.ServerSendTime).Format(time.RFC3339Nano)
+	}
+	return resp
+}
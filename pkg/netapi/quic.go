@@ -0,0 +1,600 @@
+package netapi
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog/log"
+)
+
+// quicALPN is the application protocol QUIC probes are negotiated with.
+const quicALPN = "kitter"
+
+// The application error codes a QUIC server closes connections with.
+const (
+	quicNoError  quic.ApplicationErrorCode = 0
+	quicRejected quic.ApplicationErrorCode = 1
+)
+
+// quicSessionCache keeps the session tickets of every QUIC server probed, so a new connection to a server that was
+// probed before resumes the session and sends its first probe as 0-RTT data.
+var quicSessionCache = tls.NewLRUClientSessionCache(1024)
+
+// QUICServer is a struct that represents a QUIC probe server.
+// Every probe is sent on its own stream, in either wire format, and answered like a probe of the TCP server.
+// The server accepts 0-RTT data, so clients resuming a session have their first probe answered within one round trip.
+// QUIC is always encrypted: without TLS configured the server presents a self-signed certificate.
+type QUICServer struct {
+	// Addr is the address where the server is hosted.
+	Addr string
+
+	// Config holds the options the server was created with.
+	Config ServerConfig
+
+	// handler answers the probes, the Handler of the Config wrapped in its Middlewares.
+	handler Handler
+
+	// limiter limits the rate of probes per source IP, nil when the rate is not limited.
+	limiter *rateLimiter
+
+	// peers are the identities the clients announced on their probes, there is no hello on QUIC connections.
+	peers *announcedPeers
+
+	mu        sync.Mutex
+	conn      net.PacketConn
+	transport *quic.Transport
+	listener  *quic.EarlyListener
+	conns     map[*quic.Conn]struct{}
+	draining  bool
+
+	// streams counts the probes being answered.
+	streams sync.WaitGroup
+}
+
+// Run is a method on the QUICServer struct that starts the QUIC server.
+// This function takes a channel and sends a signal when it's ready.
+// It accepts connections until ctx is done or the server is shut down.
+func (q *QUICServer) Run(ctx context.Context, readyCh chan<- struct{}) (err error) {
+	tlsConf, err := q.tlsConfig()
+	if err != nil {
+		close(readyCh)
+		return err
+	}
+	conn, err := q.Config.Socket.listenPacket(ctx, "udp", q.Addr)
+	if err != nil {
+		close(readyCh)
+		return err
+	}
+	transport := &quic.Transport{Conn: conn}
+	listener, err := transport.ListenEarly(tlsConf, &quic.Config{
+		Allow0RTT:            true,
+		MaxIdleTimeout:       q.Config.IdleTimeout,
+		HandshakeIdleTimeout: q.Config.ReadTimeout,
+	})
+	if err != nil {
+		_ = transport.Close()
+		_ = conn.Close()
+		close(readyCh)
+		return err
+	}
+	q.mu.Lock()
+	q.conn, q.transport, q.listener = conn, transport, listener
+	q.conns = make(map[*quic.Conn]struct{})
+	q.mu.Unlock()
+	// Signal that the server is ready to accept connections
+	close(readyCh)
+
+	// stop accepting when the context is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = listener.Close()
+	})
+	defer stop()
+
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) {
+				return nil
+			}
+			return err
+		}
+		if !q.add(conn) {
+			continue
+		}
+		go q.handleConnection(conn)
+	}
+}
+
+// tlsConfig returns the TLS config of the server, with a self-signed certificate when no TLS is configured.
+func (q *QUICServer) tlsConfig() (*tls.Config, error) {
+	var config *tls.Config
+	var err error
+	if q.Config.TLS != nil {
+		config, err = q.Config.TLS.ServerConfig()
+	} else {
+		config, err = selfSignedConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+	withALPN(config, quicALPN)
+	return config, nil
+}
+
+// add tracks an accepted connection and reports whether it may be served.
+// Connections above MaxConns, or accepted while the server is draining, are closed straight away.
+func (q *QUICServer) add(conn *quic.Conn) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.draining || (q.Config.MaxConns > 0 && len(q.conns) >= q.Config.MaxConns) {
+		if !q.draining {
+			reject(rejectMaxConns)
+		}
+		_ = conn.CloseWithError(quicRejected, "too many connections")
+		return false
+	}
+	q.conns[conn] = struct{}{}
+	return true
+}
+
+// remove forgets a closed connection.
+func (q *QUICServer) remove(conn *quic.Conn) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.conns, conn)
+}
+
+// handleConnection answers the probes on every stream the client opens until the connection is closed.
+func (q *QUICServer) handleConnection(conn *quic.Conn) {
+	info := ConnInfo{
+		ID:         nextConnID.Add(1),
+		RemoteAddr: conn.RemoteAddr().String(),
+		LocalAddr:  conn.LocalAddr().String(),
+	}
+	metricAccepted.Inc()
+	metricConnections.Inc()
+	log.Debug().Uint64("conn", info.ID).Str("client", info.RemoteAddr).Bool("0rtt", conn.ConnectionState().Used0RTT).
+		Msg("accepted connection")
+	defer func() {
+		metricConnections.Dec()
+		q.remove(conn)
+		log.Debug().Uint64("conn", info.ID).Msg("closed connection")
+	}()
+
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			// the client closed the connection, it timed out or the server is shutting down
+			return
+		}
+		q.streams.Add(1)
+		go func() {
+			defer q.streams.Done()
+			q.handleStream(stream, info)
+		}()
+	}
+}
+
+// handleStream answers the single probe sent on stream.
+func (q *QUICServer) handleStream(stream *quic.Stream, info ConnInfo) {
+	defer func(stream *quic.Stream) {
+		_ = stream.Close()
+	}(stream)
+	if err := setStreamDeadline(stream, q.Config.ReadTimeout); err != nil {
+		return
+	}
+	if !q.limiter.allow(info.RemoteAddr) {
+		reject(rejectRateLimit)
+		stream.CancelRead(quic.StreamErrorCode(quicRejected))
+		return
+	}
+
+	reader := bufio.NewReader(stream)
+	binary, err := peekFrame(reader)
+	var data []byte
+	if err == nil && binary {
+		data, _, err = readFrameBytes(reader, q.Config.MaxProbeSize)
+	} else if err == nil {
+		data, err = readLine(reader, q.Config.MaxProbeSize)
+		if errors.Is(err, io.EOF) && len(data) > 0 {
+			// the client closed its side of the stream instead of ending the line
+			err = nil
+		}
+	}
+	if err != nil {
+		if !closedError(err) {
+			readError(err)
+			log.Error().Err(err).Uint64("conn", info.ID).Msg("could not read probe from client")
+		}
+		return
+	}
+
+	received := time.Now()
+	info.Peer = q.peers.peer(info.RemoteAddr, data, received)
+	reply, err := q.handle(&Request{
+		Data:     data,
+		Binary:   binary,
+		Received: received,
+		Conn:     info,
+		Server:   q.Addr,
+		Config:   q.Config,
+	})
+	if err != nil {
+		log.Error().Err(err).Uint64("conn", info.ID).Msg("could not process probe from client")
+		return
+	}
+	if reply == nil {
+		// the handler does not answer this probe
+		return
+	}
+	if !binary {
+		reply = append(reply, '\n')
+	}
+	if _, err := stream.Write(reply); err != nil {
+		log.Debug().Err(err).Uint64("conn", info.ID).Msg("could not write probe reply")
+	}
+}
+
+// setStreamDeadline sets the deadline of stream to timeout from now, or clears it when timeout is 0.
+func setStreamDeadline(stream *quic.Stream, timeout time.Duration) error {
+	if timeout <= 0 {
+		return stream.SetDeadline(time.Time{})
+	}
+	return stream.SetDeadline(time.Now().Add(timeout))
+}
+
+// handle passes req to the handler of the server.
+func (q *QUICServer) handle(req *Request) ([]byte, error) {
+	return q.Config.handle(q.handler, req)
+}
+
+// BoundAddr returns the address the QUIC Server is listening on.
+func (q *QUICServer) BoundAddr() net.Addr {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.listener == nil {
+		return nil
+	}
+	return q.listener.Addr()
+}
+
+// Shutdown stops the QUIC Server from accepting connections and waits for the probes in flight to be answered
+// before closing the connections. The connections are closed anyway once ctx is done.
+func (q *QUICServer) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	listener := q.listener
+	q.draining = true
+	q.mu.Unlock()
+	if listener == nil {
+		return errors.New("server not initialized")
+	}
+	_ = listener.Close()
+
+	done := make(chan struct{})
+	go func() {
+		q.streams.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	q.closeConns(quicNoError, "server shutting down")
+	if closeErr := q.closeTransport(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// closeTransport stops the transport and closes its socket, the transport does not own a socket it was given.
+func (q *QUICServer) closeTransport() error {
+	err := q.transport.Close()
+	if closeErr := q.conn.Close(); err == nil && !errors.Is(closeErr, net.ErrClosed) {
+		err = closeErr
+	}
+	return err
+}
+
+// closeConns closes every connection being served.
+func (q *QUICServer) closeConns(code quic.ApplicationErrorCode, reason string) {
+	q.mu.Lock()
+	conns := make([]*quic.Conn, 0, len(q.conns))
+	for conn := range q.conns {
+		conns = append(conns, conn)
+	}
+	q.mu.Unlock()
+	for _, conn := range conns {
+		_ = conn.CloseWithError(code, reason)
+	}
+}
+
+// Close shuts down the QUIC Server and every connection.
+func (q *QUICServer) Close() error {
+	q.mu.Lock()
+	listener := q.listener
+	q.draining = true
+	q.mu.Unlock()
+	if listener == nil {
+		return errors.New("server not initialized")
+	}
+	_ = listener.Close()
+	q.closeConns(quicNoError, "server closed")
+	return q.closeTransport()
+}
+
+// ProcessData is a method on the QUICServer struct that processes the data received on a stream.
+func (q *QUICServer) ProcessData(ctx context.Context, data []byte) ([]byte, error) {
+	info, _ := ConnInfoFrom(ctx)
+	return q.handle(&Request{
+		Data:   data,
+		Binary: isFrame(data),
+		Conn:   info,
+		Server: q.Addr,
+		Config: q.Config,
+	})
+}
+
+// selfSignedConfig returns a server TLS config with a certificate generated for this process.
+func selfSignedConfig() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "kitter"},
+		DNSNames:     []string{"kitter"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: key}},
+	}, nil
+}
+
+// QUICClient is a struct that represents a QUIC probe client.
+// It keeps one connection to the server and sends every probe on a new stream. The first probe on a connection
+// resuming an earlier session is sent as 0-RTT data.
+type QUICClient struct {
+	// addr is the address of the server.
+	addr string
+
+	// config holds the options the client was created with.
+	config ClientConfig
+
+	// conn is the QUIC connection to the server.
+	conn *quic.Conn
+
+	// transport sends the packets of conn on socket, a UDP socket with the socket options of the client.
+	transport *quic.Transport
+	socket    net.PacketConn
+
+	// handshake is closed once the handshake of conn finished, handshakeTime is how long it took.
+	handshake     chan struct{}
+	handshakeTime time.Duration
+
+	// reported is set once the handshake was reported by a probe.
+	reported bool
+
+	// peer is the identity the server announced in its reply to a probe, nil until it did.
+	peer *Identity
+
+	// payload is the padding sent with every probe.
+	payload []byte
+
+	// seq is the sequence number of the last probe and probeID identifies the probes of this client.
+	seq     uint32
+	probeID uint64
+}
+
+// Connect is a method on the QUICClient struct that starts the connection to the server.
+// When the session of an earlier connection can be resumed it returns before the handshake finished, so the first
+// probe is sent as 0-RTT data.
+func (c *QUICClient) Connect() error {
+	host, _, err := net.SplitHostPort(c.addr)
+	if err != nil {
+		return err
+	}
+	var tlsConf *tls.Config
+	if c.config.TLS != nil {
+		tlsConf = c.config.TLS.ClientConfig(host)
+	} else {
+		// QUIC is always encrypted, without TLS configured the server presents a self-signed certificate
+		tlsConf = &tls.Config{InsecureSkipVerify: true} // #nosec G402 -- the probe only measures latency
+	}
+	tlsConf.NextProtos = []string{quicALPN}
+	tlsConf.ClientSessionCache = quicSessionCache
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	raddr, err := net.ResolveUDPAddr("udp", c.addr)
+	if err != nil {
+		return err
+	}
+	network := "udp6"
+	if raddr.IP.To4() != nil {
+		network = "udp4"
+	}
+	socket, err := c.config.listenPacket(ctx, network)
+	if err != nil {
+		return err
+	}
+	transport := &quic.Transport{Conn: socket}
+	start := time.Now()
+	conn, err := transport.DialEarly(ctx, raddr, tlsConf, &quic.Config{})
+	if err != nil {
+		_ = transport.Close()
+		_ = socket.Close()
+		return err
+	}
+	c.transport, c.socket = transport, socket
+	c.watchHandshake(conn, start)
+	return nil
+}
+
+// watchHandshake records how long the handshake of conn takes.
+func (c *QUICClient) watchHandshake(conn *quic.Conn, start time.Time) {
+	handshake := make(chan struct{})
+	c.conn, c.handshake, c.reported = conn, handshake, false
+	go func() {
+		select {
+		case <-conn.HandshakeComplete():
+			c.handshakeTime = time.Since(start)
+		case <-conn.Context().Done():
+		}
+		close(handshake)
+	}()
+}
+
+// exchange sends data on a new stream and returns everything the server answered with.
+func (c *QUICClient) exchange(data []byte) ([]byte, error) {
+	if c.conn == nil {
+		return nil, errors.New("connection not established")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := c.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write(data); err != nil {
+		return nil, err
+	}
+	// the probe is complete, the server answers once it read it
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(stream)
+}
+
+// send sends data and retries it on the 1-RTT connection when the server rejected the 0-RTT data.
+func (c *QUICClient) send(data []byte) ([]byte, error) {
+	reply, err := c.exchange(data)
+	if !errors.Is(err, quic.Err0RTTRejected) {
+		return reply, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	next, err := c.conn.NextConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = next
+	return c.exchange(data)
+}
+
+// SendData is a method on the QUICClient struct that sends data on a new stream and returns the server's response.
+func (c *QUICClient) SendData(data string) (string, error) {
+	reply, err := c.send([]byte(data + "\n"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(reply), "\n"), nil
+}
+
+// Probe is a method on the QUICClient struct that sends a single probe on a new stream.
+// The RTT of the Response is the stream RTT, the first probe on a connection also reports the handshake time and
+// whether the probe was sent as 0-RTT data.
+func (c *QUICClient) Probe() (Response, error) {
+	resp, err := c.probe()
+	if err != nil {
+		return resp, err
+	}
+	if !c.reported {
+		<-c.handshake
+		resp.QUICHandshake = c.handshakeTime.Seconds()
+		resp.ZeroRTT = c.conn.ConnectionState().Used0RTT
+		c.reported = true
+	}
+	identify(&resp, c.config.Identity, c.peer)
+	return resp, nil
+}
+
+// probe sends a single probe in the configured wire format.
+func (c *QUICClient) probe() (Response, error) {
+	c.seq++
+	if c.config.Wire != WireBinary {
+		return textProbe(c.SendData, c.payload)
+	}
+	if c.conn == nil {
+		return Response{}, errors.New("connection not established")
+	}
+
+	probe := newProbeFrame(CurrentFrameVersion, c.seq, c.probeID, c.payload)
+	if c.peer == nil {
+		// there is no hello, the identities are exchanged on the probes until the server answered with its own
+		if err := withIdentity(probe, c.config.Identity); err != nil {
+			return Response{}, err
+		}
+	}
+	probe.ClientTime = time.Now().UnixNano()
+	data, err := probe.MarshalBinary()
+	if err != nil {
+		return Response{}, err
+	}
+	data, err = c.send(data)
+	dStamp := time.Now()
+	if err != nil {
+		return Response{}, err
+	}
+	reply := &Frame{}
+	if err := reply.UnmarshalBinary(data); err != nil {
+		return Response{}, err
+	}
+	if err := checkReply(probe, reply); err != nil {
+		return Response{}, err
+	}
+	peer, err := splitIdentity(reply)
+	if err != nil {
+		return Response{}, err
+	}
+	if peer != nil {
+		c.peer = peer
+	}
+	if err := checkReplySize(reply, len(c.payload), c.config.ReplySize); err != nil {
+		return Response{}, err
+	}
+	return frameResponse(reply, c.conn.LocalAddr().String(), c.addr, dStamp), nil
+}
+
+// Close is a method on the QUICClient struct that closes the connection to the server.
+func (c *QUICClient) Close() error {
+	if c.conn == nil {
+		return errors.New("connection not established")
+	}
+	err := c.conn.CloseWithError(quicNoError, "")
+	// the transport does not own the socket it was given
+	_ = c.transport.Close()
+	_ = c.socket.Close()
+	return err
+}
@@ -0,0 +1,70 @@
+package netapi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_QUICProbe(t *testing.T) {
+	srv, err := NewServer("quic", "127.0.0.1:0", WithServerIdentity(Identity{Node: "node-1"}))
+	require.NoError(t, err)
+	startServer(t, srv)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+	addr := srv.BoundAddr().String()
+
+	for i, wire := range []string{WireBinary, WireText, WireBinary} {
+		client, err := NewClient("quic", addr, WithWire(wire), WithPayloadSize(16), WithIdentity(Identity{Pod: "client"}))
+		require.NoError(t, err)
+		require.NoError(t, client.Connect())
+
+		resp, err := client.Probe()
+		require.NoError(t, err, wire)
+		assert.NotEmpty(t, resp.ServerTime)
+		assert.Equal(t, 16, resp.PayloadSize)
+		assert.Greater(t, resp.QUICHandshake, float64(0))
+		// the first connection has no session to resume, the next ones send their first probe as 0-RTT data
+		assert.Equal(t, i > 0, resp.ZeroRTT, "connection %d", i)
+		assert.Equal(t, &Identity{Pod: "client"}, resp.ClientIdentity)
+		assert.Equal(t, &Identity{Node: "node-1"}, resp.ServerIdentity)
+
+		// the handshake is only reported once per connection
+		resp, err = client.Probe()
+		require.NoError(t, err, wire)
+		assert.Zero(t, resp.QUICHandshake)
+		assert.False(t, resp.ZeroRTT)
+		_ = client.Close()
+	}
+}
+
+func Test_QUICShutdown(t *testing.T) {
+	srv, err := NewServer("quic", "127.0.0.1:0", WithMaxConns(1))
+	require.NoError(t, err)
+	errCh := startServer(t, srv)
+
+	client, err := NewClient("quic", srv.BoundAddr().String(), WithWire(WireBinary))
+	require.NoError(t, err)
+	require.NoError(t, client.Connect())
+	_, err = client.Probe()
+	require.NoError(t, err)
+
+	// the second connection is over the limit
+	second, err := NewClient("quic", srv.BoundAddr().String(), WithWire(WireBinary))
+	require.NoError(t, err)
+	if second.Connect() == nil {
+		_, err = second.Probe()
+		assert.Error(t, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, srv.Shutdown(ctx))
+	require.NoError(t, <-errCh)
+	_, err = client.Probe()
+	assert.Error(t, err, "the connection is closed by the shutdown")
+}
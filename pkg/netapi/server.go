@@ -2,37 +2,71 @@ package netapi
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/rs/zerolog/log"
+	"io"
 	"net"
+	"os"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 )
 
 // Server is an interface that defines methods for running and closing a server.
 type Server interface {
-	// Run starts the server and returns an error if any issues occur during the startup process.
-	Run(readyCh chan<- struct{}) error
+	// Run starts the server and closes readyCh once it is listening. It blocks until ctx is done or the server is
+	// shut down, which both return nil, and returns an error if the server could not start or failed while running.
+	Run(ctx context.Context, readyCh chan<- struct{}) error
 
-	// Close shuts down the server and returns an error if any issues occur during the shutdown process.
+	// Shutdown stops accepting new probes and waits for the probes in flight to be answered. Idle connections are
+	// closed straight away. If ctx is done first the remaining connections are closed and the ctx error is returned.
+	Shutdown(ctx context.Context) error
+
+	// Close shuts down the server and its connections immediately and returns an error if any issues occur during
+	// the shutdown process.
 	Close() error
 
+	// BoundAddr returns the address the server is listening on, nil before it is ready.
+	// It reports the real port when the server was created with port 0.
+	BoundAddr() net.Addr
+
 	// ProcessData processes the data received from a Client connection and returns the response data and an error.
-	// The implementation of this method can be overridden in different projects to provide custom data processing.
-	ProcessData(data []byte) ([]byte, error)
+	// The data is passed to the Handler of the server, see WithHandler to provide custom data processing.
+	// The connection the data was received on is taken from ctx, see WithConnInfo.
+	ProcessData(ctx context.Context, data []byte) ([]byte, error)
 }
 
 // TCPServer is a struct that represents a TCP server.
 // It contains the address of the server and a Listener from the netapi package
 // that listens for incoming connections on the address.
+// The same server handles unix domain sockets, which are stream oriented as well.
 type TCPServer struct {
 	// Addr is the address where the server is hosted.
-	Addr   string
-	Client string
+	Addr string
+
+	// network is the network passed to net.Listen, tcp when it is empty.
+	network string
+
+	// handler answers the probes, the Handler of the Config wrapped in its Middlewares.
+	handler Handler
+
+	// Config holds the options the server was created with.
+	Config ServerConfig
 
 	// server is a netapi.Listener which accepts incoming connections on the Addr.
 	server net.Listener
+	mu     sync.Mutex
+
+	// conns are the connections being served.
+	conns connTracker
+
+	// limiter limits the rate of probes per source IP, nil when the rate is not limited.
+	limiter *rateLimiter
 }
 
 type Response struct {
@@ -43,118 +77,714 @@ type Response struct {
 	Latency    float64 `json:"latency"`
 	ClientDone string  `json:"clientDone"`
 	RTT        float64 `json:"RTT"`
+	Seq        uint32  `json:"seq,omitempty"`
+	ProbeID    uint64  `json:"probeId,omitempty"`
+
+	// ServerSendTime is the moment the server sent the response. Together with ClientTime, ServerTime and
+	// ClientDone it forms the four timestamps of an NTP style exchange.
+	ServerSendTime string `json:"serverSendTime,omitempty"`
+	// ClockOffset is the estimated offset of the server clock from the client clock in seconds.
+	ClockOffset float64 `json:"clockOffset,omitempty"`
+	// NetworkRTT is the RTT in seconds without the time the server spent processing the probe.
+	NetworkRTT float64 `json:"networkRTT,omitempty"`
+	// ForwardDelay and ReverseDelay are the client to server and server to client delays in seconds
+	// corrected for the clock offset.
+	ForwardDelay float64 `json:"forwardDelay,omitempty"`
+	ReverseDelay float64 `json:"reverseDelay,omitempty"`
+
+	// Payload is the padding sent back by the server and PayloadSize the length it announced for it.
+	// The client clears Payload once the length has been checked.
+	Payload     string `json:"payload,omitempty"`
+	PayloadSize int    `json:"payloadSize,omitempty"`
+
+	// TLSHandshake is the duration of the TLS handshake in seconds, set on the first probe of a TLS connection.
+	TLSHandshake float64 `json:"tlsHandshake,omitempty"`
+
+	// Connect is the time spent opening the connection, FirstWrite the time spent writing the probe and FirstByte
+	// the time from sending the probe to the first byte of the reply, all in seconds. Close is the time spent closing
+	// the connection after the probe, it is set by the caller closing it. HTTPProtocol is the protocol of an HTTP
+	// probe, for example HTTP/2.0.
+	Connect      float64 `json:"connect,omitempty"`
+	FirstWrite   float64 `json:"firstWrite,omitempty"`
+	FirstByte    float64 `json:"firstByte,omitempty"`
+	Close        float64 `json:"close,omitempty"`
+	HTTPProtocol string  `json:"httpProtocol,omitempty"`
+
+	// QUICHandshake is the duration of the QUIC handshake in seconds and ZeroRTT reports whether the probe was sent
+	// as 0-RTT data on a resumed session, both set on the first probe of a QUIC connection.
+	QUICHandshake float64 `json:"quicHandshake,omitempty"`
+	ZeroRTT       bool    `json:"zeroRTT,omitempty"`
+
+	// KernelRTT is the time in seconds from the kernel sending the probe to the kernel receiving the reply, without
+	// the delays of the client process. It is only set by UDP clients with kernel timestamps enabled, and left unset
+	// when the kernel did not stamp both packets, which happens to the first packets after timestamps are enabled.
+	KernelRTT float64 `json:"kernelRTT,omitempty"`
+
+	// TCPInfo is the state of the connection sampled by TCP clients after the probe, on Linux only.
+	TCPInfo *TCPInfo `json:"tcpInfo,omitempty"`
+
+	// TWAMP holds the fields of the reflected packet of a TWAMP-Light probe.
+	TWAMP *TWAMPResult `json:"twamp,omitempty"`
+
+	// ClientIdentity and ServerIdentity describe where the two ends of the probe run, they are nil when unknown.
+	ClientIdentity *Identity `json:"clientIdentity,omitempty"`
+	ServerIdentity *Identity `json:"serverIdentity,omitempty"`
+}
+
+// ServerConfig holds the settings shared by every Server implementation.
+type ServerConfig struct {
+	// PayloadSize is the size of the payload sent back with every reply. When it is 0 the server echoes a payload
+	// of the same size as the probe payload.
+	PayloadSize int
+
+	// TLS secures the connections with TLS when it is set. Only TCP, HTTP, gRPC and QUIC servers support it.
+	TLS *CertReloader
+
+	// Handler answers the probes, TimestampHandler when it is nil.
+	Handler Handler
+
+	// Middlewares wrap the Handler, the first one sees every probe first.
+	Middlewares []Middleware
+
+	// MaxConns is the maximum number of connections served at once, connections above it are closed straight away.
+	// It is not limited when it is 0.
+	MaxConns int
+
+	// IdleTimeout is how long a connection may wait for its next probe and ReadTimeout how long a probe may take to
+	// arrive in full once it has started and to be answered. They are not limited when they are 0.
+	IdleTimeout time.Duration
+	ReadTimeout time.Duration
+
+	// MaxProbeSize is the largest text line or frame accepted from a client in bytes, 0 only applies the
+	// MaxFramePayload limit of the protocol.
+	MaxProbeSize int
+
+	// RateLimit is the number of probes per second answered for a single source IP with bursts of up to RateBurst
+	// probes. Probes are not limited when it is 0.
+	RateLimit float64
+	RateBurst int
+
+	// Identity is sent to the clients so they can label their metrics with where the server runs.
+	Identity Identity
+
+	// ClientLabel is the field of the identity of the clients, pod, namespace, node or zone, the metrics of the probes
+	// are labeled with. The client label is empty when ClientLabel is, and for clients that announce no identity.
+	ClientLabel string
+
+	// Socket are the options set on the sockets of the server, so the replies are marked like the probes.
+	Socket SocketOptions
+
+	// STAMPKey is the key STAMP reflectors authenticate the test packets with, they use the unauthenticated mode
+	// when it is empty.
+	STAMPKey []byte
+}
+
+// handler returns the Handler wrapped in the Middlewares and the server metrics.
+func (c ServerConfig) handler() Handler {
+	handler := c.Handler
+	if handler == nil {
+		handler = TimestampHandler
+	}
+	return metricsMiddleware(Chain(handler, c.Middlewares...))
+}
+
+// handle passes req to handler, the Handler NewServer built for the server. Servers that were not created by
+// NewServer have none and answer with the Handler of the config, wrapped the same way.
+func (c ServerConfig) handle(handler Handler, req *Request) ([]byte, error) {
+	if handler == nil {
+		handler = c.handler()
+	}
+	return handler.Handle(req)
+}
+
+// ServerOption changes a setting of the ServerConfig.
+type ServerOption func(*ServerConfig)
+
+// WithReplyPayloadSize sets the size of the payload the server sends back with every reply.
+func WithReplyPayloadSize(size int) ServerOption {
+	return func(c *ServerConfig) {
+		c.PayloadSize = size
+	}
+}
+
+// WithServerTLS secures the connections to the server with the certificates of reloader.
+func WithServerTLS(reloader *CertReloader) ServerOption {
+	return func(c *ServerConfig) {
+		c.TLS = reloader
+	}
+}
+
+// WithHandler sets the Handler that answers the probes.
+func WithHandler(handler Handler) ServerOption {
+	return func(c *ServerConfig) {
+		c.Handler = handler
+	}
+}
+
+// WithMiddleware adds middlewares around the Handler.
+func WithMiddleware(middlewares ...Middleware) ServerOption {
+	return func(c *ServerConfig) {
+		c.Middlewares = append(c.Middlewares, middlewares...)
+	}
+}
+
+// WithMaxConns sets the maximum number of connections served at once.
+func WithMaxConns(n int) ServerOption {
+	return func(c *ServerConfig) {
+		c.MaxConns = n
+	}
+}
+
+// WithIdleTimeout sets how long a connection may wait for its next probe before it is closed.
+func WithIdleTimeout(timeout time.Duration) ServerOption {
+	return func(c *ServerConfig) {
+		c.IdleTimeout = timeout
+	}
+}
+
+// WithReadTimeout sets how long a probe may take to arrive in full and be answered before the connection is closed.
+func WithReadTimeout(timeout time.Duration) ServerOption {
+	return func(c *ServerConfig) {
+		c.ReadTimeout = timeout
+	}
+}
+
+// WithMaxProbeSize sets the largest text line or frame accepted from a client.
+func WithMaxProbeSize(size int) ServerOption {
+	return func(c *ServerConfig) {
+		c.MaxProbeSize = size
+	}
+}
+
+// WithRateLimit limits the probes answered for a single source IP to rate per second with bursts of burst probes.
+func WithRateLimit(rate float64, burst int) ServerOption {
+	return func(c *ServerConfig) {
+		c.RateLimit = rate
+		c.RateBurst = burst
+	}
+}
+
+// WithServerIdentity sets the Identity the server sends to its clients.
+func WithServerIdentity(id Identity) ServerOption {
+	return func(c *ServerConfig) {
+		c.Identity = id
+	}
+}
+
+// WithServerClientLabel labels the metrics of the probes with the field of the identity of the clients called field.
+func WithServerClientLabel(field string) ServerOption {
+	return func(c *ServerConfig) {
+		c.ClientLabel = field
+	}
+}
+
+// WithServerSocketOptions sets the options set on the sockets of the server, for example the DSCP of its replies.
+func WithServerSocketOptions(options SocketOptions) ServerOption {
+	return func(c *ServerConfig) {
+		c.Socket = options
+	}
+}
+
+// WithServerSTAMPKey makes STAMP reflectors use the authenticated mode with key.
+func WithServerSTAMPKey(key []byte) ServerOption {
+	return func(c *ServerConfig) {
+		c.STAMPKey = key
+	}
+}
+
+// validate checks that the settings of the config make sense.
+func (c ServerConfig) validate() error {
+	if err := validatePayloadSize(c.PayloadSize); err != nil {
+		return err
+	}
+	if err := c.Identity.validate(); err != nil {
+		return err
+	}
+	if err := c.Socket.validate(); err != nil {
+		return err
+	}
+	if c.ClientLabel != "" && !slices.Contains(identityFieldNames, c.ClientLabel) {
+		return fmt.Errorf("invalid client label %q, use pod, namespace, node or zone", c.ClientLabel)
+	}
+	if c.MaxConns < 0 || c.MaxProbeSize < 0 || c.IdleTimeout < 0 || c.ReadTimeout < 0 || c.RateLimit < 0 {
+		return errors.New("server limits must not be negative")
+	}
+	if c.RateLimit > 0 && c.RateBurst < 1 {
+		return errors.New("the rate limit burst must be at least 1")
+	}
+	return nil
 }
 
 // NewServer is a factory function that creates a new Server based on the provided protocol and address.
-// Currently, it only supports TCP. If an unsupported protocol is provided, it returns an error.
-func NewServer(protocol, addr string) (Server, error) {
+// It supports TCP, UDP, unix domain sockets, HTTP, gRPC, QUIC, TWAMP-Light and STAMP reflectors. For unix the address is
+// the path of the socket, or a name starting with "@" for the Linux abstract namespace. If an unsupported protocol is
+// provided, it returns an error.
+func NewServer(protocol, addr string, opts ...ServerOption) (Server, error) {
+	var config ServerConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	if len(config.STAMPKey) > 0 && strings.ToLower(protocol) != "stamp" {
+		return nil, errors.New("a STAMP key is only supported over stamp")
+	}
+
 	// Convert the protocol to lower case to ensure case-insensitive comparison
 	switch strings.ToLower(protocol) {
 	case "tcp":
 		// If the protocol is TCP, create and return a new TCPServer with the provided address
 		return &TCPServer{
-			Addr: addr,
+			Addr:    addr,
+			Config:  config,
+			handler: config.handler(),
+			limiter: newRateLimiter(config.RateLimit, config.RateBurst),
 		}, nil
 	case "udp":
-		//  todo If the protocol is UDP implement it
+		if config.TLS != nil {
+			return nil, errTLSUnsupported
+		}
+		// If the protocol is UDP, create and return a new UDPServer with the provided address
+		return &UDPServer{
+			Addr:    addr,
+			Config:  config,
+			handler: config.handler(),
+			limiter: newRateLimiter(config.RateLimit, config.RateBurst),
+			peers:   newAnnouncedPeers(config.IdleTimeout),
+		}, nil
+	case "twamp":
+		if config.TLS != nil {
+			return nil, errTLSUnsupported
+		}
+		// TWAMP-Light reflectors are UDP servers answering in the format of the test packets
+		return &UDPServer{
+			Addr:    addr,
+			Config:  config,
+			handler: config.reflectorHandler(&reflector{codec: twampCodec{}}),
+			ttl:     true,
+			limiter: newRateLimiter(config.RateLimit, config.RateBurst),
+		}, nil
+	case "stamp":
+		if config.TLS != nil {
+			return nil, errTLSUnsupported
+		}
+		// STAMP reflectors are stateful, they number the reflected packets of every session on their own
+		return &UDPServer{
+			Addr:   addr,
+			Config: config,
+			handler: config.reflectorHandler(&reflector{
+				codec:    stampCodec{key: config.STAMPKey},
+				sessions: newReflectorSessions(config.IdleTimeout),
+			}),
+			ttl:     true,
+			limiter: newRateLimiter(config.RateLimit, config.RateBurst),
+		}, nil
+	case "unix":
+		if config.TLS != nil {
+			return nil, errTLSUnsupported
+		}
+		// If the protocol is unix, create and return a new TCPServer listening on the socket
+		return &TCPServer{
+			Addr:    addr,
+			Config:  config,
+			network: "unix",
+			handler: config.handler(),
+			limiter: newRateLimiter(config.RateLimit, config.RateBurst),
+		}, nil
+	case "http":
+		// If the protocol is HTTP, create and return a new HTTPServer with the provided address
+		return &HTTPServer{
+			Addr:    addr,
+			Config:  config,
+			handler: config.handler(),
+			limiter: newRateLimiter(config.RateLimit, config.RateBurst),
+		}, nil
+	case "grpc":
+		// If the protocol is gRPC, create and return a new GRPCServer with the provided address
+		return &GRPCServer{
+			Addr:    addr,
+			Config:  config,
+			handler: config.handler(),
+			limiter: newRateLimiter(config.RateLimit, config.RateBurst),
+		}, nil
+	case "quic":
+		// If the protocol is QUIC, create and return a new QUICServer with the provided address
+		return &QUICServer{
+			Addr:    addr,
+			Config:  config,
+			handler: config.handler(),
+			limiter: newRateLimiter(config.RateLimit, config.RateBurst),
+			peers:   newAnnouncedPeers(config.IdleTimeout),
+		}, nil
 	}
-	// If the protocol is neither TCP nor UDP, return an error
+	// If the protocol is not supported, return an error
 	return nil, errors.New("invalid protocol given")
 }
 
 // Run is a method on the TCPServer struct that starts the TCP server.
 // This function takes a channel and sends a signal when it's ready
-// It listens for incoming connections on the server's address and accepts them.
-// If there is an error in listening or accepting connections, it returns the error.
-func (t *TCPServer) Run(readyCh chan<- struct{}) (err error) {
-	// Listen on the TCP network at the server's address
-	t.server, err = net.Listen("tcp", t.Addr)
+// It listens for incoming connections on the server's address and accepts them until ctx is done or the server is
+// shut down. If there is an error in listening or accepting connections, it returns the error.
+func (t *TCPServer) Run(ctx context.Context, readyCh chan<- struct{}) (err error) {
+	var server net.Listener
+	network := t.network
+	if network == "" {
+		network = "tcp"
+	}
+	if network == "unix" {
+		err = removeStaleSocket(t.Addr)
+	}
+	// Listen on the network at the server's address
+	if err == nil {
+		server, err = t.Config.Socket.listen(ctx, network, t.Addr)
+	}
+	if err == nil && t.Config.TLS != nil {
+		// wrap the listener so every accepted connection does a TLS handshake
+		var tlsConfig *tls.Config
+		tlsConfig, err = t.Config.TLS.ServerConfig()
+		if err == nil {
+			server = tls.NewListener(server, tlsConfig)
+		}
+	}
+	if err == nil {
+		t.mu.Lock()
+		t.server = server
+		t.mu.Unlock()
+	}
 	// Signal that the server is ready to accept connections
 	close(readyCh)
 	// If there is an error in listening, return the error
 	if err != nil {
 		return
 	}
+
+	// stop accepting when the context is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = server.Close()
+	})
+	defer stop()
+
 	// Handle connections
-	err = t.handleConnections()
-	return err
+	return t.handleConnections(server)
+}
+
+// BoundAddr returns the address the TCP Server is listening on.
+func (t *TCPServer) BoundAddr() net.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.server == nil {
+		return nil
+	}
+	return t.server.Addr()
+}
+
+// Shutdown stops the TCP Server from accepting connections and drains the active ones.
+func (t *TCPServer) Shutdown(ctx context.Context) error {
+	t.conns.drain()
+	t.mu.Lock()
+	server := t.server
+	t.mu.Unlock()
+	if server != nil {
+		if err := server.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if t.conns.closeIdle() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			t.conns.closeAll()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
 }
 
 // Close shuts down the TCP Server
 func (t *TCPServer) Close() (err error) {
-	if t.server == nil {
+	t.mu.Lock()
+	server := t.server
+	t.mu.Unlock()
+	if server == nil {
 		return errors.New("server not initialized")
 	}
-	return t.server.Close()
+	t.conns.drain()
+	t.conns.closeAll()
+	err = server.Close()
+	if errors.Is(err, net.ErrClosed) {
+		// the server was already stopped through its context
+		return nil
+	}
+	return err
 }
 
 // handleConnections is a method on the TCPServer struct that accepts incoming connections and handles them concurrently.
-func (t *TCPServer) handleConnections() (err error) {
+// It returns nil once the listener is closed by Shutdown, Close or the context of Run.
+func (t *TCPServer) handleConnections(server net.Listener) error {
 	for {
 		// Accept a new connection
-		conn, err := t.server.Accept()
-		if err != nil || conn == nil {
-			// If there is an error in accepting the connection or the connection is nil, create a new error and break the loop
-			err = errors.New("could not accept connection")
-			break
+		conn, err := server.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			if isTemporary(err) {
+				// back off and try again, the condition usually clears up
+				log.Error().Err(err).Msg("could not accept connection, retrying")
+				time.Sleep(shutdownPollInterval)
+				continue
+			}
+			return fmt.Errorf("could not accept connection: %w", err)
+		}
+
+		if t.Config.MaxConns > 0 && t.conns.len() >= t.Config.MaxConns {
+			// connections are only added by this loop, the handlers removing theirs at any time can only lower the count,
+			// so the limit cannot be overrun
+			reject(rejectMaxConns)
+			_ = conn.Close()
+			continue
+		}
+		tracked := &trackedConn{Conn: conn}
+		if !t.conns.add(tracked) {
+			// the server is shutting down
+			_ = conn.Close()
+			continue
 		}
 
+		metricAccepted.Inc()
+
 		// Handle the connection concurrently
-		go t.handleConnection(conn)
+		go t.handleConnection(tracked)
 	}
-	return
 }
 
 // handleConnection is a method on the TCPServer struct that handles a single connection.
-// It reads data from the connection, processes it using the ProcessData method, and writes the response back to the connection.
-func (t *TCPServer) handleConnection(conn net.Conn) {
+// It peeks at the first bytes to find out whether the client speaks the binary frame protocol or the legacy text
+// protocol and then answers probes until the client closes the connection. Clients may send a single probe per
+// connection or keep the connection open and send one probe after another.
+func (t *TCPServer) handleConnection(conn *trackedConn) {
+	info := newConnInfo(conn)
+	log.Debug().Uint64("conn", info.ID).Str("client", info.RemoteAddr).Msg("accepted connection")
 	// Close the connection when the function returns
-	defer func(conn net.Conn) {
+	metricConnections.Inc()
+	defer func(conn *trackedConn) {
 		_ = conn.Close()
+		t.conns.remove(conn)
+		metricConnections.Dec()
+		log.Debug().Uint64("conn", info.ID).Str("client", info.RemoteAddr).Msg("closed connection")
 	}(conn)
-	// get the Client address
-	t.Client = conn.LocalAddr().String()
-
 	// Create a new reader and writer for the connection
 	reader := bufio.NewReader(conn)
 	writer := bufio.NewWriter(conn)
 
-	// Read data from the connection
-	data, err := reader.ReadBytes('\n')
-	if err != nil {
-		// If there is an error in reading, write an error message back to the connection and return
-		_, _ = writer.WriteString("failed to read input")
-		_ = writer.Flush()
+	if err := t.awaitProbe(conn, reader); err != nil {
 		return
 	}
-
-	// Process the data
-	response, err := t.ProcessData(data)
+	binaryFrames, err := peekFrame(reader)
 	if err != nil {
-		// If there is an error in processing the data, write an error message back to the connection and return
-		_, _ = writer.WriteString("failed to process data")
-		_ = writer.Flush()
+		// the client went away before sending anything
+		return
+	}
+	if binaryFrames {
+		t.handleFrames(conn, reader, writer, info)
 		return
 	}
+	t.handleText(conn, reader, writer, info)
+}
+
+// awaitProbe waits up to the IdleTimeout for the next probe to start and then gives it the ReadTimeout to arrive in
+// full and be answered. The connection counts as idle while it waits, so Shutdown can close it.
+func (t *TCPServer) awaitProbe(conn *trackedConn, reader *bufio.Reader) error {
+	if reader.Buffered() == 0 {
+		conn.idle.Store(true)
+		err := setReadDeadline(conn, t.Config.IdleTimeout)
+		if err == nil {
+			_, err = reader.Peek(1)
+		}
+		conn.idle.Store(false)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			reject(rejectIdleTimeout)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return setDeadline(conn, t.Config.ReadTimeout)
+}
+
+// readError counts the rejections behind an error reading a probe.
+func readError(err error) {
+	switch {
+	case errors.Is(err, errProbeTooLarge):
+		reject(rejectTooLarge)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		reject(rejectReadTimeout)
+	}
+}
+
+// closedError reports whether err is the normal end of a connection: the client closing it, or the server closing it
+// because it was idle or shutting down.
+func closedError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed)
+}
+
+// newRequest wraps the data of a probe received on the connection described by info for the handler.
+func (t *TCPServer) newRequest(data []byte, binary bool, info ConnInfo) *Request {
+	return &Request{
+		Data:     data,
+		Binary:   binary,
+		Received: time.Now(),
+		Conn:     info,
+		Server:   t.Addr,
+		Config:   t.Config,
+	}
+}
 
-	// Write the response back to the connection
-	_, _ = writer.Write(response)
-	_, _ = writer.WriteString("\n")
-	_ = writer.Flush()
+// handle passes req to the handler of the server.
+func (t *TCPServer) handle(req *Request) ([]byte, error) {
+	return t.Config.handle(t.handler, req)
+}
+
+// handleText answers newline terminated text probes from the client using the handler.
+func (t *TCPServer) handleText(conn *trackedConn, reader *bufio.Reader, writer *bufio.Writer, info ConnInfo) {
+	for {
+		// Read data from the connection
+		err := t.awaitProbe(conn, reader)
+		if err != nil {
+			return
+		}
+		data, err := readLine(reader, t.Config.MaxProbeSize)
+		if err != nil {
+			// The client closing the connection, or the server closing it on shutdown, is the normal end of the loop
+			if closedError(err) {
+				return
+			}
+			readError(err)
+			// If there is an error in reading, write an error message back to the connection and return
+			_, _ = writer.WriteString("failed to read input")
+			_ = writer.Flush()
+			return
+		}
+		if !t.limiter.allow(info.RemoteAddr) {
+			// the connection is closed so a flooding client has to reconnect
+			reject(rejectRateLimit)
+			return
+		}
+
+		// Process the data
+		response, err := t.handle(t.newRequest(data, false, info))
+		if err != nil {
+			// If there is an error in processing the data, write an error message back to the connection and return
+			_, _ = writer.WriteString("failed to process data")
+			_ = writer.Flush()
+			return
+		}
+		if response == nil {
+			// the handler does not answer this probe
+			continue
+		}
+
+		// Write the response back to the connection
+		_, _ = writer.Write(response)
+		_, _ = writer.WriteString("\n")
+		if err := writer.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// handleFrames answers binary frames from client until the client closes the connection or sends an invalid frame.
+// The version hello is answered here so that every handler can be used with negotiating clients.
+func (t *TCPServer) handleFrames(conn *trackedConn, reader *bufio.Reader, writer *bufio.Writer, info ConnInfo) {
+	for {
+		err := t.awaitProbe(conn, reader)
+		if err != nil {
+			return
+		}
+		data, frame, err := readFrameBytes(reader, t.Config.MaxProbeSize)
+		if err != nil {
+			if !closedError(err) {
+				readError(err)
+				log.Error().Err(err).Msg("could not read frame from client")
+			}
+			return
+		}
+		if frame.Type != FrameHello && !t.limiter.allow(info.RemoteAddr) {
+			// the connection is closed so a flooding client has to reconnect
+			reject(rejectRateLimit)
+			return
+		}
+
+		var reply []byte
+		if frame.Type == FrameHello {
+			var ack *Frame
+			ack, info.Peer, err = helloAck(frame, t.Config.Identity)
+			if err == nil {
+				reply, err = ack.MarshalBinary()
+			}
+			if info.Peer != nil {
+				log.Debug().Uint64("conn", info.ID).Any("peer", info.Peer).Msg("client announced its identity")
+			}
+		} else {
+			reply, err = t.handle(t.newRequest(data, true, info))
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("could not process frame from client")
+			return
+		}
+		if reply == nil {
+			// the handler does not answer this probe
+			continue
+		}
+
+		if _, err := writer.Write(reply); err != nil {
+			return
+		}
+		if err := writer.Flush(); err != nil {
+			return
+		}
+	}
 }
 
 // ProcessData is a method on the TCPServer struct that processes the data received from a Client connection.
-func (t *TCPServer) ProcessData(data []byte) ([]byte, error) {
+func (t *TCPServer) ProcessData(ctx context.Context, data []byte) ([]byte, error) {
+	info, _ := ConnInfoFrom(ctx)
+	return t.handle(&Request{
+		Data:   data,
+		Conn:   info,
+		Server: t.Addr,
+		Config: t.Config,
+	})
+}
+
+// processTimestamp parses the client timestamp in a text probe and builds the JSON encoded Response.
+// It is shared by every transport so that they all report latency the same way.
+func processTimestamp(req *Request) ([]byte, error) {
 	// server response time
-	sStamp := time.Now()
+	sStamp := req.receivedAt()
 	// data should be a time.RFC3339Nano string
 	// this is the client timestamp
-	str := strings.TrimSuffix(string(data), "\n") // remove newline from the data
-	log.Info().Str("data", str).Msg("")
-	cStamp, err := time.Parse(time.RFC3339Nano, str)
+	str := strings.TrimSuffix(string(req.Data), "\n") // remove newline from the data
+	stamp, payload, err := decodeTextProbe(str)
+	if err != nil {
+		message := "Could not parse payload from client"
+		log.Error().Err(err).Str("client", req.Conn.RemoteAddr).Msg(message)
+		metricParseFailures.WithLabelValues(clientLabel(req)).Inc()
+		return []byte(message), err
+	}
+	log.Info().Str("data", stamp).Int("payload", len(payload)).Msg("")
+	cStamp, err := time.Parse(time.RFC3339Nano, stamp)
 	if err != nil {
 		message := "Could not parse timestamp from client"
-		log.Error().Err(err).Msg(message)
+		log.Error().Err(err).Str("client", req.Conn.RemoteAddr).Msg(message)
+		metricParseFailures.WithLabelValues(clientLabel(req)).Inc()
 		return []byte(message), err
 	}
 	// Calculate the one way latency
@@ -163,11 +793,23 @@ func (t *TCPServer) ProcessData(data []byte) ([]byte, error) {
 	resp := Response{
 		ServerTime: sStamp.Format(time.RFC3339Nano),
 		ClientTime: cStamp.Format(time.RFC3339Nano),
-		Client:     t.Client,
-		Server:     t.Addr,
+		Client:     req.Conn.RemoteAddr,
+		Server:     req.Server,
 		Latency:    latency.Seconds(),
+		// text probes can not carry the identity of the client, the server always sends its own
+		ServerIdentity: req.Config.Identity.ptr(),
 	}
-	// convert to json
+	if reply := replyPayload(req.Config.PayloadSize, payload); len(reply) > 0 {
+		resp.Payload = string(reply)
+		resp.PayloadSize = len(reply)
+	}
+	// stamp the send time as late as possible
+	resp.ServerSendTime = time.Now().Format(time.RFC3339Nano)
+	return marshalResponse(resp)
+}
+
+// marshalResponse converts resp to json.
+func marshalResponse(resp Response) ([]byte, error) {
 	respBytes, err := json.Marshal(resp)
 	if err != nil {
 		log.Error().Err(err).Msg("could not marshal response")
@@ -176,3 +818,61 @@ func (t *TCPServer) ProcessData(data []byte) ([]byte, error) {
 
 	return respBytes, nil
 }
+
+// helloAck answers a hello with the highest version both sides speak and returns the identity the client announced.
+// A hello carrying an identity is answered with id, the identity of the server.
+func helloAck(hello *Frame, id Identity) (*Frame, *Identity, error) {
+	peer, err := splitIdentity(hello)
+	if err != nil {
+		return nil, nil, err
+	}
+	ack := &Frame{
+		Version: negotiateVersion(hello.Version),
+		Type:    FrameHelloAck,
+	}
+	if peer != nil {
+		if err := withIdentity(ack, id); err != nil {
+			return nil, nil, err
+		}
+	}
+	return ack, peer, nil
+}
+
+// processFrame answers a single frame of the binary protocol.
+// A hello is answered with the highest version both sides speak and a probe is reflected with the server timestamp.
+func processFrame(frame *Frame, req *Request) (*Frame, error) {
+	// server response time
+	sStamp := req.receivedAt()
+	switch frame.Type {
+	case FrameHello:
+		ack, _, err := helloAck(frame, req.Config.Identity)
+		return ack, err
+	case FrameProbe:
+		if frame.Version > CurrentFrameVersion {
+			return nil, fmt.Errorf("unsupported frame version %d", frame.Version)
+		}
+		peer, err := splitIdentity(frame)
+		if err != nil {
+			return nil, err
+		}
+		reply := &Frame{
+			Version:    frame.Version,
+			Type:       FrameReply,
+			Seq:        frame.Seq,
+			ProbeID:    frame.ProbeID,
+			ClientTime: frame.ClientTime,
+			ServerTime: sStamp.UnixNano(),
+			Payload:    replyPayload(req.Config.PayloadSize, frame.Payload),
+		}
+		if peer != nil {
+			// clients without a hello ask for the identity of the server on their probes
+			if err := withIdentity(reply, req.Config.Identity); err != nil {
+				return nil, err
+			}
+		}
+		// stamp the send time as late as possible, version 1 frames can not carry it
+		reply.ServerSendTime = time.Now().UnixNano()
+		return reply, nil
+	}
+	return nil, fmt.Errorf("unexpected frame type %d", frame.Type)
+}
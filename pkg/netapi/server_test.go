@@ -1,7 +1,9 @@
 package netapi
 
 import (
+	"context"
 	"encoding/json"
+	"runtime"
 	"testing"
 	"time"
 
@@ -19,7 +21,7 @@ func Test_ProcessData(t *testing.T) {
 
 	// Run the server in Goroutine to stop tests from blocking test execution.
 	go func() {
-		err := srv.Run(readCh)
+		err := srv.Run(context.Background(), readCh)
 		assert.NoError(t, err)
 	}()
 	<-readCh // make sure the server is really started so that we don't have race conditions
@@ -30,15 +32,15 @@ func Test_ProcessData(t *testing.T) {
 
 	// Create an instance of JitterServer
 	tcp := &TCPServer{
-		Addr:   "localhost",
-		Client: "0.0.0.0",
+		Addr: "localhost",
 	}
+	ctx := WithConnInfo(context.Background(), ConnInfo{ID: 1, RemoteAddr: "10.0.0.1:5000", LocalAddr: "10.0.0.2:5102"})
 
 	// Generate a test timestamp, subtracting 10 milliseconds to simulate a delay
 	testTimestamp := time.Now().Add(-10 * time.Millisecond).Format(time.RFC3339Nano)
 
 	// Call ProcessData
-	respBytes, err := tcp.ProcessData([]byte(testTimestamp))
+	respBytes, err := tcp.ProcessData(ctx, []byte(testTimestamp))
 	require.NoError(t, err, "ProcessData failed")
 
 	// Unmarshal the response
@@ -48,4 +50,113 @@ func Test_ProcessData(t *testing.T) {
 	// Validate the response
 	assert.NotEqual(t, resp.ClientTime, resp.ServerTime)
 	assert.GreaterOrEqual(t, float64(10), resp.Latency)
+	assert.Equal(t, "10.0.0.1:5000", resp.Client)
+}
+
+func Test_PersistentConnection(t *testing.T) {
+	srv, err := NewServer("tcp", "127.0.0.1:1125")
+	require.NoError(t, err, "error creating TCP server")
+	readCh := make(chan struct{})
+
+	go func() {
+		_ = srv.Run(context.Background(), readCh)
+	}()
+	<-readCh
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+
+	client, err := NewClient("tcp", "127.0.0.1:1125")
+	require.NoError(t, err)
+	require.NoError(t, client.Connect())
+	defer func(client Client) {
+		_ = client.Close()
+	}(client)
+
+	// the server must keep answering on the same connection
+	for i := 0; i < 3; i++ {
+		stamp := time.Now().Format(time.RFC3339Nano)
+		data, err := client.SendData(stamp)
+		require.NoError(t, err, "SendData failed on probe %d", i)
+
+		var resp Response
+		require.NoError(t, json.Unmarshal([]byte(data), &resp))
+		assert.Equal(t, stamp, resp.ClientTime)
+		// the server reports the address of the client, not its own
+		assert.Equal(t, client.(*TCPClient).conn.LocalAddr().String(), resp.Client)
+	}
+}
+
+func Test_NewTCPClient(t *testing.T) {
+	srv, err := NewServer("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startServer(t, srv)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+
+	client := NewTCPClient(srv.BoundAddr().String())
+	require.NoError(t, client.Connect())
+	defer func(client Client) {
+		_ = client.Close()
+	}(client)
+	resp, err := client.Probe()
+	require.NoError(t, err)
+	assert.NotEmpty(t, resp.ServerTime)
+}
+
+func Test_ProbePhases(t *testing.T) {
+	srv, err := NewServer("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startServer(t, srv)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+
+	for _, wire := range []string{WireBinary, WireText} {
+		client, err := NewClient("tcp", srv.BoundAddr().String(), WithWire(wire))
+		require.NoError(t, err)
+		require.NoError(t, client.Connect())
+
+		resp, err := client.Probe()
+		require.NoError(t, err, wire)
+		assert.Greater(t, resp.Connect, float64(0), wire)
+		assert.Greater(t, resp.FirstWrite, float64(0), wire)
+		assert.Greater(t, resp.FirstByte, float64(0), wire)
+
+		// the dial is only reported by the first probe on the connection
+		resp, err = client.Probe()
+		require.NoError(t, err, wire)
+		assert.Zero(t, resp.Connect, wire)
+		assert.Greater(t, resp.FirstByte, float64(0), wire)
+		_ = client.Close()
+	}
+}
+
+func Test_ProbeTCPInfo(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("TCP_INFO is only read on Linux")
+	}
+	srv, err := NewServer("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startServer(t, srv)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+
+	client, err := NewClient("tcp", srv.BoundAddr().String(), WithWire(WireBinary))
+	require.NoError(t, err)
+	require.NoError(t, client.Connect())
+	defer func(client Client) {
+		_ = client.Close()
+	}(client)
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Probe()
+		require.NoError(t, err)
+		require.NotNil(t, resp.TCPInfo, "probe %d", i)
+		assert.Greater(t, resp.TCPInfo.RTT, float64(0))
+		assert.Greater(t, resp.TCPInfo.CongestionWindow, uint32(0))
+		assert.Zero(t, resp.TCPInfo.Retransmits, "nothing is lost on loopback")
+	}
 }
@@ -0,0 +1,145 @@
+package netapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SocketOptions are the IP and TCP options set on the sockets of the probes when they are created, so the probes
+// can check the QoS policies of the network. The zero value leaves every option at its default.
+type SocketOptions struct {
+	// DSCP is the Differentiated Services Code Point of the packets from 0 to 63, written to the upper six bits of
+	// the IPv4 TOS or IPv6 traffic class.
+	DSCP int
+
+	// Priority is the SO_PRIORITY of the socket, the queue its packets are put in on the host. Linux only.
+	Priority int
+
+	// Mark is the SO_MARK of the socket, matched by the routing and firewall rules of the host. Linux only, it
+	// needs CAP_NET_ADMIN.
+	Mark uint32
+
+	// Nagle turns TCP_NODELAY off so small writes are coalesced, Go turns it on for every TCP connection.
+	Nagle bool
+
+	// Congestion is the TCP congestion control algorithm, for example cubic or bbr, the kernel default when it is
+	// empty. Linux only.
+	Congestion string
+}
+
+// ParseSocketOptions parses a comma separated list of key=value socket options, as in dscp=46,nodelay=false.
+// The keys are dscp, priority, mark, nodelay and congestion.
+func ParseSocketOptions(spec string) (SocketOptions, error) {
+	var o SocketOptions
+	if spec == "" {
+		return o, nil
+	}
+	for _, option := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(option, "=")
+		if !ok {
+			return o, fmt.Errorf("invalid socket option %q, use key=value", option)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		var err error
+		switch key {
+		case "dscp":
+			o.DSCP, err = strconv.Atoi(value)
+		case "priority":
+			o.Priority, err = strconv.Atoi(value)
+		case "mark":
+			var mark uint64
+			mark, err = strconv.ParseUint(value, 0, 32)
+			o.Mark = uint32(mark)
+		case "nodelay":
+			var noDelay bool
+			noDelay, err = strconv.ParseBool(value)
+			o.Nagle = !noDelay
+		case "congestion":
+			o.Congestion = value
+		default:
+			return o, fmt.Errorf("unknown socket option %q, use dscp, priority, mark, nodelay or congestion", key)
+		}
+		if err != nil {
+			return o, fmt.Errorf("invalid value for socket option %s: %w", key, err)
+		}
+	}
+	return o, o.validate()
+}
+
+// validate checks that the options can be set on a socket.
+func (o SocketOptions) validate() error {
+	if o.DSCP < 0 || o.DSCP > 63 {
+		return errors.New("the DSCP must be between 0 and 63")
+	}
+	if o.Priority < 0 {
+		return errors.New("the socket priority must not be negative")
+	}
+	return nil
+}
+
+// listen creates a listener whose socket and accepted connections have the options.
+func (o SocketOptions) listen(ctx context.Context, network, addr string) (net.Listener, error) {
+	config := net.ListenConfig{Control: o.control}
+	listener, err := config.Listen(ctx, network, addr)
+	if err != nil || !o.Nagle {
+		return listener, err
+	}
+	return &socketListener{Listener: listener, options: o}, nil
+}
+
+// listenPacket creates a packet socket with the options.
+func (o SocketOptions) listenPacket(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	config := net.ListenConfig{Control: o.control}
+	return config.ListenPacket(ctx, network, addr)
+}
+
+// control sets the options on a socket before it is bound or connected, unix sockets are left alone.
+func (o SocketOptions) control(network, _ string, c syscall.RawConn) error {
+	if strings.HasPrefix(network, "unix") {
+		return nil
+	}
+	var err error
+	if ctrlErr := c.Control(func(fd uintptr) {
+		err = o.set(fd, network)
+	}); ctrlErr != nil {
+		return ctrlErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set socket options: %w", err)
+	}
+	return nil
+}
+
+// connected sets the options Go overrides once a TCP connection is established.
+func (o SocketOptions) connected(conn net.Conn) error {
+	if tcp := tcpConn(conn); tcp != nil && o.Nagle {
+		return tcp.SetNoDelay(false)
+	}
+	return nil
+}
+
+// socketListener sets the socket options Go overrides on the connections it accepts.
+type socketListener struct {
+	net.Listener
+	options SocketOptions
+}
+
+// Accept waits for the next connection and sets the options on it. The connection is served with the defaults when
+// they cannot be set, failing the Accept would stop the server.
+func (l *socketListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.options.connected(conn); err != nil {
+		log.Error().Err(err).Msg("failed to set socket options on accepted connection")
+	}
+	return conn, nil
+}
@@ -0,0 +1,46 @@
+package netapi
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// set sets the options on the socket fd of network.
+func (o SocketOptions) set(fd uintptr, network string) error {
+	s := int(fd)
+	if o.DSCP != 0 {
+		tos := o.DSCP << 2
+		if strings.HasSuffix(network, "6") {
+			if err := unix.SetsockoptInt(s, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos); err != nil {
+				return err
+			}
+			// dual stack sockets send IPv4 packets as well, which take the TOS, IPv6 only sockets refuse it
+			_ = unix.SetsockoptInt(s, unix.IPPROTO_IP, unix.IP_TOS, tos)
+		} else if err := unix.SetsockoptInt(s, unix.IPPROTO_IP, unix.IP_TOS, tos); err != nil {
+			return err
+		}
+	}
+	// the TOS sets the priority as well, so the priority is set after it
+	if o.Priority != 0 {
+		if err := unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_PRIORITY, o.Priority); err != nil {
+			return err
+		}
+	}
+	if o.Mark != 0 {
+		if err := unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_MARK, int(o.Mark)); err != nil {
+			return err
+		}
+	}
+	if o.Congestion != "" && strings.HasPrefix(network, "tcp") {
+		if err := unix.SetsockoptString(s, unix.IPPROTO_TCP, unix.TCP_CONGESTION, o.Congestion); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindToDevice binds the socket fd to the network interface name.
+func bindToDevice(fd uintptr, name string) error {
+	return unix.BindToDevice(int(fd), name)
+}
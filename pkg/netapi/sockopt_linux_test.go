@@ -0,0 +1,61 @@
+package netapi
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func Test_SocketOptions(t *testing.T) {
+	options := SocketOptions{DSCP: 46, Priority: 3, Nagle: true, Congestion: "reno"}
+	for _, protocol := range []string{"tcp", "udp"} {
+		srv, err := NewServer(protocol, "127.0.0.1:0", WithServerSocketOptions(options))
+		require.NoError(t, err)
+		startServer(t, srv)
+		defer func(srv Server) {
+			_ = srv.Close()
+		}(srv)
+
+		client, err := NewClient(protocol, srv.BoundAddr().String(), WithWire(WireBinary), WithSocketOptions(options))
+		require.NoError(t, err)
+		require.NoError(t, client.Connect())
+		defer func(client Client) {
+			_ = client.Close()
+		}(client)
+		_, err = client.Probe()
+		require.NoError(t, err, protocol)
+
+		var conn net.Conn
+		switch c := client.(type) {
+		case *TCPClient:
+			conn = c.conn
+		case *UDPClient:
+			conn = c.conn
+		}
+		raw, err := conn.(interface {
+			SyscallConn() (syscall.RawConn, error)
+		}).SyscallConn()
+		require.NoError(t, err)
+		require.NoError(t, raw.Control(func(fd uintptr) {
+			tos, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS)
+			assert.NoError(t, err)
+			assert.Equal(t, 46<<2, tos, protocol)
+			priority, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_PRIORITY)
+			assert.NoError(t, err)
+			assert.Equal(t, 3, priority, protocol)
+			if protocol != "tcp" {
+				return
+			}
+			noDelay, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_NODELAY)
+			assert.NoError(t, err)
+			assert.Zero(t, noDelay)
+			congestion, err := unix.GetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION)
+			assert.NoError(t, err)
+			assert.Equal(t, "reno", congestion)
+		}))
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package netapi
+
+import "errors"
+
+// set fails when any option is given, the socket options are only set on Linux.
+func (o SocketOptions) set(uintptr, string) error {
+	if o.DSCP != 0 || o.Priority != 0 || o.Mark != 0 || o.Congestion != "" {
+		return errors.ErrUnsupported
+	}
+	return nil
+}
+
+// bindToDevice fails, sockets are only bound to an interface on Linux.
+func bindToDevice(uintptr, string) error {
+	return errors.ErrUnsupported
+}
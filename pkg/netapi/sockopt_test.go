@@ -0,0 +1,32 @@
+package netapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseSocketOptions(t *testing.T) {
+	options, err := ParseSocketOptions("dscp=46,priority=6,mark=0x10,nodelay=false,congestion=bbr")
+	require.NoError(t, err)
+	assert.Equal(t, SocketOptions{DSCP: 46, Priority: 6, Mark: 16, Nagle: true, Congestion: "bbr"}, options)
+
+	// spaces around the keys and values are ignored
+	options, err = ParseSocketOptions("dscp= 46, nodelay = false ,congestion= reno")
+	require.NoError(t, err)
+	assert.Equal(t, SocketOptions{DSCP: 46, Nagle: true, Congestion: "reno"}, options)
+
+	options, err = ParseSocketOptions("")
+	require.NoError(t, err)
+	assert.Zero(t, options)
+
+	for _, spec := range []string{"dscp", "dscp=64", "priority=-1", "mark=x", "nodelay=maybe", "tos=4"} {
+		_, err := ParseSocketOptions(spec)
+		assert.Error(t, err, spec)
+	}
+	_, err = ParseSocketOptions(" dscp =x")
+	assert.EqualError(t, err, `invalid value for socket option dscp: strconv.Atoi: parsing "x": invalid syntax`)
+	_, err = ParseSocketOptions(" tos =4")
+	assert.ErrorContains(t, err, `unknown socket option "tos"`)
+}
@@ -0,0 +1,93 @@
+package netapi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+)
+
+// SourceBinding is the local end the connections of a client are opened from, to probe over a given interface of a
+// host with several of them. The zero value lets the kernel choose the source by the routing table.
+type SourceBinding struct {
+	// Addr is the local address of the connections, any address when it is not valid.
+	Addr netip.Addr
+
+	// Interface is the network interface the sockets are bound to with SO_BINDTODEVICE, so they only send and
+	// receive over it whatever the routing table says. Linux only.
+	Interface string
+}
+
+// IsZero reports whether b leaves the choice of the source to the kernel.
+func (b SourceBinding) IsZero() bool {
+	return b == SourceBinding{}
+}
+
+// String returns the interface of b, or its address when it is only bound to an address.
+func (b SourceBinding) String() string {
+	if b.Interface != "" || !b.Addr.IsValid() {
+		return b.Interface
+	}
+	return b.Addr.String()
+}
+
+// localAddr returns the local address of a socket on network bound to b, nil for any address.
+func (b SourceBinding) localAddr(network string) net.Addr {
+	if !b.Addr.IsValid() {
+		return nil
+	}
+	ip, zone := b.Addr.AsSlice(), b.Addr.Zone()
+	switch {
+	case strings.HasPrefix(network, "tcp"):
+		return &net.TCPAddr{IP: ip, Zone: zone}
+	case strings.HasPrefix(network, "udp"):
+		return &net.UDPAddr{IP: ip, Zone: zone}
+	}
+	return nil
+}
+
+// control binds a socket to the interface of b, unix sockets are left alone.
+func (b SourceBinding) control(network, _ string, c syscall.RawConn) error {
+	if b.Interface == "" || strings.HasPrefix(network, "unix") {
+		return nil
+	}
+	var err error
+	if ctrlErr := c.Control(func(fd uintptr) {
+		err = bindToDevice(fd, b.Interface)
+	}); ctrlErr != nil {
+		return ctrlErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to bind to interface %s: %w", b.Interface, err)
+	}
+	return nil
+}
+
+// control sets the socket options of the client on a socket and binds it to the source interface.
+func (c ClientConfig) control(network, address string, raw syscall.RawConn) error {
+	if err := c.Socket.control(network, address, raw); err != nil {
+		return err
+	}
+	return c.Source.control(network, address, raw)
+}
+
+// dialer returns a net.Dialer that opens the connections of the client to network from its source with its socket
+// options.
+func (c ClientConfig) dialer(network string) *net.Dialer {
+	return &net.Dialer{
+		LocalAddr: c.Source.localAddr(network),
+		Control:   c.control,
+	}
+}
+
+// listenPacket creates the packet socket of a client on network, bound to its source with its socket options.
+func (c ClientConfig) listenPacket(ctx context.Context, network string) (net.PacketConn, error) {
+	addr := ":0"
+	if c.Source.Addr.IsValid() {
+		addr = net.JoinHostPort(c.Source.Addr.String(), "0")
+	}
+	config := net.ListenConfig{Control: c.control}
+	return config.ListenPacket(ctx, network, addr)
+}
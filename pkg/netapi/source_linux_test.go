@@ -0,0 +1,40 @@
+package netapi
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SourceBinding(t *testing.T) {
+	// the whole 127.0.0.0/8 is on the loopback interface on Linux
+	source := SourceBinding{Addr: netip.MustParseAddr("127.0.0.2"), Interface: "lo"}
+	assert.Equal(t, "lo", source.String())
+	for _, protocol := range []string{"tcp", "udp", "http", "grpc", "quic"} {
+		srv, err := NewServer(protocol, "127.0.0.1:0")
+		require.NoError(t, err)
+		startServer(t, srv)
+		defer func(srv Server) {
+			_ = srv.Close()
+		}(srv)
+
+		client, err := NewClient(protocol, srv.BoundAddr().String(), WithWire(WireBinary), WithSource(source))
+		require.NoError(t, err)
+		require.NoError(t, client.Connect(), protocol)
+		resp, err := client.Probe()
+		require.NoError(t, err, protocol)
+		_ = client.Close()
+
+		host, _, err := net.SplitHostPort(resp.Client)
+		require.NoError(t, err, protocol)
+		assert.Equal(t, "127.0.0.2", host, protocol)
+	}
+
+	// the interface does not exist
+	client, err := NewClient("tcp", "127.0.0.1:1", WithSource(SourceBinding{Interface: "kitter-missing0"}))
+	require.NoError(t, err)
+	assert.ErrorContains(t, client.Connect(), "kitter-missing0")
+}
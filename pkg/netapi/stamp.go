@@ -0,0 +1,228 @@
+package netapi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// STAMP (RFC 8762) standardizes TWAMP-Light. In the unauthenticated mode its test packets are TWAMP-Light test
+// packets of at least stampPacketSize bytes, the padding of the sender is zero. In the authenticated mode the fields
+// are spread out and the packets end with an HMAC, all fields big endian.
+//
+// Authenticated test packet of the session-sender:
+//
+//	0  seq           uint32
+//	4  MBZ           12 bytes
+//	16 timestamp     NTP
+//	24 errorEstimate uint16
+//	26 MBZ           70 bytes
+//	96 HMAC          16 bytes
+//
+// Authenticated test packet of the session-reflector:
+//
+//	0  seq                 uint32
+//	4  MBZ                 12 bytes
+//	16 timestamp           NTP
+//	24 errorEstimate       uint16
+//	26 MBZ                 6 bytes
+//	32 receiveTimestamp    NTP
+//	40 MBZ                 8 bytes
+//	48 senderSeq           uint32
+//	52 MBZ                 12 bytes
+//	64 senderTimestamp     NTP
+//	72 senderErrorEstimate uint16
+//	74 MBZ                 6 bytes
+//	80 senderTTL           uint8
+//	81 MBZ                 15 bytes
+//	96 HMAC                16 bytes
+//
+// The HMAC is the HMAC-SHA-256 of the fields before it with the key shared by the sender and the reflector,
+// truncated to 16 bytes.
+const (
+	stampPacketSize     = 44
+	stampAuthPacketSize = 112
+	stampHMACOffset     = 96
+
+	// STAMPPort is the port assigned to STAMP.
+	STAMPPort = 862
+
+	// stampSessionTimeout is how long a reflector remembers an idle session when the server has no IdleTimeout.
+	stampSessionTimeout = 10 * time.Minute
+)
+
+// stampCodec encodes the STAMP test packets in the unauthenticated mode, or the authenticated mode when key is set.
+type stampCodec struct {
+	key []byte
+}
+
+// ReadSTAMPKey reads the key of the authenticated STAMP mode from the file at path. A single trailing newline, \n or
+// \r\n, is not part of the key, every other byte is, so binary keys are read as they are.
+func ReadSTAMPKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read STAMP key: %w", err)
+	}
+	key, ok := bytes.CutSuffix(data, []byte("\n"))
+	if ok {
+		// the newline of a file written on Windows
+		key, _ = bytes.CutSuffix(key, []byte("\r"))
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("STAMP key file %s is empty", path)
+	}
+	return key, nil
+}
+
+// hmac returns the truncated HMAC of the fields of an authenticated packet.
+func (c stampCodec) hmac(packet []byte) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(packet[:stampHMACOffset])
+	return mac.Sum(nil)[:stampAuthPacketSize-stampHMACOffset]
+}
+
+// sign writes the HMAC of the authenticated packet buf.
+func (c stampCodec) sign(buf []byte) []byte {
+	copy(buf[stampHMACOffset:], c.hmac(buf))
+	return buf
+}
+
+// verify checks the size and the HMAC of the authenticated packet data.
+func (c stampCodec) verify(data []byte) error {
+	if len(data) < stampAuthPacketSize {
+		return fmt.Errorf("authenticated STAMP packet of %d bytes is shorter than the minimum of %d", len(data), stampAuthPacketSize)
+	}
+	if !hmac.Equal(data[stampHMACOffset:stampAuthPacketSize], c.hmac(data)) {
+		return errors.New("invalid HMAC of authenticated STAMP packet")
+	}
+	return nil
+}
+
+func (c stampCodec) marshalSender(p *TWAMPSenderPacket) ([]byte, error) {
+	if len(c.key) == 0 {
+		padded := *p
+		padded.Padding = make([]byte, max(len(p.Padding), stampPacketSize-twampSenderHeaderSize))
+		copy(padded.Padding, p.Padding)
+		return padded.MarshalBinary()
+	}
+	buf := make([]byte, stampAuthPacketSize)
+	binary.BigEndian.PutUint32(buf[0:], p.Seq)
+	binary.BigEndian.PutUint64(buf[16:], uint64(p.Timestamp))
+	binary.BigEndian.PutUint16(buf[24:], uint16(p.ErrorEstimate))
+	return c.sign(buf), nil
+}
+
+func (c stampCodec) unmarshalSender(data []byte) (TWAMPSenderPacket, error) {
+	var p TWAMPSenderPacket
+	if len(c.key) == 0 {
+		if len(data) < stampPacketSize {
+			return p, fmt.Errorf("STAMP test packet of %d bytes is shorter than the minimum of %d", len(data), stampPacketSize)
+		}
+		return p, p.UnmarshalBinary(data)
+	}
+	if err := c.verify(data); err != nil {
+		return p, err
+	}
+	p.Seq = binary.BigEndian.Uint32(data[0:])
+	p.Timestamp = NTPTimestamp(binary.BigEndian.Uint64(data[16:]))
+	p.ErrorEstimate = ErrorEstimate(binary.BigEndian.Uint16(data[24:]))
+	return p, nil
+}
+
+func (c stampCodec) marshalReflector(p *TWAMPReflectorPacket) ([]byte, error) {
+	if len(c.key) == 0 {
+		return p.MarshalBinary()
+	}
+	buf := make([]byte, stampAuthPacketSize)
+	binary.BigEndian.PutUint32(buf[0:], p.Seq)
+	binary.BigEndian.PutUint64(buf[16:], uint64(p.Timestamp))
+	binary.BigEndian.PutUint16(buf[24:], uint16(p.ErrorEstimate))
+	binary.BigEndian.PutUint64(buf[32:], uint64(p.ReceiveTimestamp))
+	binary.BigEndian.PutUint32(buf[48:], p.SenderSeq)
+	binary.BigEndian.PutUint64(buf[64:], uint64(p.SenderTimestamp))
+	binary.BigEndian.PutUint16(buf[72:], uint16(p.SenderErrorEstimate))
+	buf[80] = p.SenderTTL
+	return c.sign(buf), nil
+}
+
+func (c stampCodec) unmarshalReflector(data []byte) (TWAMPReflectorPacket, error) {
+	var p TWAMPReflectorPacket
+	if len(c.key) == 0 {
+		if len(data) < stampPacketSize {
+			return p, fmt.Errorf("STAMP reflected packet of %d bytes is shorter than the minimum of %d", len(data), stampPacketSize)
+		}
+		return p, p.UnmarshalBinary(data)
+	}
+	if err := c.verify(data); err != nil {
+		return p, err
+	}
+	p.Seq = binary.BigEndian.Uint32(data[0:])
+	p.Timestamp = NTPTimestamp(binary.BigEndian.Uint64(data[16:]))
+	p.ErrorEstimate = ErrorEstimate(binary.BigEndian.Uint16(data[24:]))
+	p.ReceiveTimestamp = NTPTimestamp(binary.BigEndian.Uint64(data[32:]))
+	p.SenderSeq = binary.BigEndian.Uint32(data[48:])
+	p.SenderTimestamp = NTPTimestamp(binary.BigEndian.Uint64(data[64:]))
+	p.SenderErrorEstimate = ErrorEstimate(binary.BigEndian.Uint16(data[72:]))
+	p.SenderTTL = data[80]
+	return p, nil
+}
+
+// reflectorSessions numbers the reflected packets of every session on its own, so the sender can tell the test
+// packets lost on the way to the reflector from the reflected packets lost on the way back. A session is identified
+// by the address of its sender and forgotten once it was idle for longer than idle.
+type reflectorSessions struct {
+	idle time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*reflectorSession
+	pruned   time.Time
+}
+
+// reflectorSession is the state of a single session: the sequence number of the next reflected packet and when the
+// last test packet was received.
+type reflectorSession struct {
+	next uint32
+	seen time.Time
+}
+
+// newReflectorSessions creates the sessions of a stateful reflector, idle sessions are forgotten after idle or
+// stampSessionTimeout when it is 0.
+func newReflectorSessions(idle time.Duration) *reflectorSessions {
+	if idle == 0 {
+		idle = stampSessionTimeout
+	}
+	return &reflectorSessions{
+		idle:     idle,
+		sessions: make(map[string]*reflectorSession),
+	}
+}
+
+// next returns the sequence number of the packet reflected to addr for a test packet received at now.
+func (s *reflectorSessions) next(addr string, now time.Time) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.pruned) > s.idle {
+		for sender, session := range s.sessions {
+			if now.Sub(session.seen) > s.idle {
+				delete(s.sessions, sender)
+			}
+		}
+		s.pruned = now
+	}
+	session, ok := s.sessions[addr]
+	if !ok || now.Sub(session.seen) > s.idle {
+		// a new session, or a sender reusing the address of a session that timed out
+		session = &reflectorSession{}
+		s.sessions[addr] = session
+	}
+	seq := session.next
+	session.next++
+	session.seen = now
+	return seq
+}
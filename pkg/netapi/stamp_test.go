@@ -0,0 +1,163 @@
+package netapi
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_STAMPCodec(t *testing.T) {
+	now := NewNTPTimestamp(time.Now())
+	test := TWAMPSenderPacket{Seq: 7, Timestamp: now, ErrorEstimate: twampErrorEstimate}
+	reflected := TWAMPReflectorPacket{Seq: 2, Timestamp: now + 2, ErrorEstimate: twampErrorEstimate,
+		ReceiveTimestamp: now + 1, SenderSeq: 7, SenderTimestamp: now, SenderErrorEstimate: twampErrorEstimate,
+		SenderTTL: 255}
+
+	// the unauthenticated mode pads the test packets to the minimum size
+	codec := stampCodec{}
+	data, err := codec.marshalSender(&test)
+	require.NoError(t, err)
+	assert.Len(t, data, 44)
+	decoded, err := codec.unmarshalSender(data)
+	require.NoError(t, err)
+	assert.Equal(t, test.Seq, decoded.Seq)
+	assert.Equal(t, test.Timestamp, decoded.Timestamp)
+	_, err = codec.unmarshalSender(data[:41])
+	assert.Error(t, err)
+
+	codec = stampCodec{key: []byte("secret")}
+	data, err = codec.marshalSender(&test)
+	require.NoError(t, err)
+	assert.Len(t, data, 112)
+	decoded, err = codec.unmarshalSender(data)
+	require.NoError(t, err)
+	assert.Equal(t, test, decoded)
+
+	data, err = codec.marshalReflector(&reflected)
+	require.NoError(t, err)
+	assert.Len(t, data, 112)
+	decodedReflected, err := codec.unmarshalReflector(data)
+	require.NoError(t, err)
+	assert.Equal(t, reflected, decodedReflected)
+
+	_, err = stampCodec{key: []byte("other")}.unmarshalReflector(data)
+	assert.Error(t, err, "the key does not match")
+	data[48]++
+	_, err = codec.unmarshalReflector(data)
+	assert.Error(t, err, "the packet was modified")
+	_, err = codec.unmarshalReflector(data[:96])
+	assert.Error(t, err)
+}
+
+func Test_ReadSTAMPKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(path, []byte("secret\n"), 0o600))
+	key, err := ReadSTAMPKey(path)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret"), key)
+
+	for _, binary := range [][]byte{{' ', 1, 2, '\t'}, {'\n', 0, '\n', '\n'}} {
+		require.NoError(t, os.WriteFile(path, binary, 0o600))
+		key, err = ReadSTAMPKey(path)
+		require.NoError(t, err)
+		assert.Equal(t, bytes.TrimSuffix(binary, []byte("\n")), key, "only the trailing newline is removed")
+	}
+	require.NoError(t, os.WriteFile(path, []byte("secret\r\n"), 0o600))
+	key, err = ReadSTAMPKey(path)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret"), key)
+	require.NoError(t, os.WriteFile(path, []byte("secret\r"), 0o600))
+	key, err = ReadSTAMPKey(path)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret\r"), key, "a carriage return without a newline is part of the key")
+
+	require.NoError(t, os.WriteFile(path, []byte("\n"), 0o600))
+	_, err = ReadSTAMPKey(path)
+	assert.Error(t, err)
+	_, err = ReadSTAMPKey(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
+
+func Test_ReflectorSessions(t *testing.T) {
+	sessions := newReflectorSessions(time.Minute)
+	now := time.Now()
+	assert.Equal(t, uint32(0), sessions.next("10.0.0.1:1000", now))
+	assert.Equal(t, uint32(1), sessions.next("10.0.0.1:1000", now))
+	assert.Equal(t, uint32(0), sessions.next("10.0.0.2:1000", now), "every session is numbered on its own")
+	assert.Equal(t, uint32(2), sessions.next("10.0.0.1:1000", now.Add(30*time.Second)))
+
+	// the idle session is forgotten, the active one is kept
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, uint32(3), sessions.next("10.0.0.1:1000", now.Add(-time.Minute)))
+	assert.Equal(t, uint32(0), sessions.next("10.0.0.3:1000", now))
+	assert.Len(t, sessions.sessions, 2)
+	assert.Equal(t, uint32(0), sessions.next("10.0.0.2:1000", now))
+}
+
+func Test_TWAMPCountLosses(t *testing.T) {
+	client := &TWAMPClient{}
+	losses := func(seq, senderSeq uint32) [2]uint32 {
+		forward, reverse := client.countLosses(&TWAMPReflectorPacket{Seq: seq, SenderSeq: senderSeq})
+		return [2]uint32{forward, reverse}
+	}
+	assert.Equal(t, [2]uint32{0, 0}, losses(0, 0))
+	assert.Equal(t, [2]uint32{2, 0}, losses(1, 3), "test packets 1 and 2 did not reach the reflector")
+	assert.Equal(t, [2]uint32{0, 1}, losses(3, 5), "reflected packet 2 did not reach the client")
+	assert.Equal(t, [2]uint32{0, 0}, losses(2, 4), "the late reflected packet was already counted")
+	assert.Equal(t, [2]uint32{0, 0}, losses(0, 6), "the reflector restarted")
+	assert.Equal(t, [2]uint32{1, 0}, losses(1, 8))
+
+	// a stateless reflector copies the sequence numbers, every loss is a reverse loss
+	client = &TWAMPClient{}
+	assert.Equal(t, [2]uint32{0, 0}, losses(0, 0))
+	assert.Equal(t, [2]uint32{0, 2}, losses(3, 3))
+}
+
+func Test_STAMPProbe(t *testing.T) {
+	for _, key := range [][]byte{nil, []byte("secret")} {
+		srv, err := NewServer("stamp", "127.0.0.1:0", WithServerSTAMPKey(key))
+		require.NoError(t, err)
+		startServer(t, srv)
+
+		client, err := NewClient("stamp", srv.BoundAddr().String(), WithSTAMPKey(key))
+		require.NoError(t, err)
+		require.NoError(t, client.Connect())
+
+		resp, err := client.Probe()
+		require.NoError(t, err)
+		assert.NotEmpty(t, resp.ServerTime)
+		require.NotNil(t, resp.TWAMP)
+		assert.Equal(t, uint32(0), resp.TWAMP.ReflectorSeq)
+
+		// skipped sequence numbers look like test packets lost on the way to the reflector
+		client.(*TWAMPClient).seq += 2
+		resp, err = client.Probe()
+		require.NoError(t, err)
+		assert.Equal(t, uint32(3), resp.Seq)
+		assert.Equal(t, uint32(1), resp.TWAMP.ReflectorSeq)
+		assert.Equal(t, uint32(2), resp.TWAMP.ForwardLost)
+		assert.Zero(t, resp.TWAMP.ReverseLost)
+
+		_ = client.Close()
+		_ = srv.Close()
+	}
+
+	// the reflector drops test packets authenticated with another key
+	srv, err := NewServer("stamp", "127.0.0.1:0", WithServerSTAMPKey([]byte("secret")))
+	require.NoError(t, err)
+	test, err := stampCodec{key: []byte("other")}.marshalSender(&TWAMPSenderPacket{})
+	require.NoError(t, err)
+	_, err = srv.ProcessData(context.Background(), test)
+	assert.Error(t, err)
+
+	_, err = NewServer("twamp", "127.0.0.1:0", WithServerSTAMPKey([]byte("secret")))
+	assert.Error(t, err)
+	_, err = NewClient("udp", "127.0.0.1:862", WithSTAMPKey([]byte("secret")))
+	assert.Error(t, err)
+}
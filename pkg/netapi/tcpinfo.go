@@ -0,0 +1,33 @@
+package netapi
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// TCPInfo is a sample of the state the kernel keeps for a TCP connection, read with the TCP_INFO socket option.
+type TCPInfo struct {
+	// RTT is the smoothed round trip time and RTTVar its variation, both in seconds.
+	RTT    float64 `json:"rtt"`
+	RTTVar float64 `json:"rttVar"`
+
+	// Retransmits is the number of segments retransmitted since the previous sample on the connection, or since it
+	// was opened for the first sample. TotalRetransmits counts every retransmission on the connection.
+	Retransmits      uint32 `json:"retransmits"`
+	TotalRetransmits uint32 `json:"totalRetransmits"`
+
+	// Lost is the number of segments currently considered lost.
+	Lost uint32 `json:"lost"`
+
+	// CongestionWindow is the send congestion window in segments.
+	CongestionWindow uint32 `json:"congestionWindow"`
+}
+
+// tcpConn returns the TCP connection underneath conn, nil when it is not one.
+func tcpConn(conn net.Conn) *net.TCPConn {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcp, _ := conn.(*net.TCPConn)
+	return tcp
+}
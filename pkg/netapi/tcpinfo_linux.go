@@ -0,0 +1,34 @@
+package netapi
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// readTCPInfo samples the TCP_INFO of conn.
+func readTCPInfo(conn *net.TCPConn) (*TCPInfo, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var info *unix.TCPInfo
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+	// the kernel reports the round trip times in microseconds
+	return &TCPInfo{
+		RTT:              float64(info.Rtt) / 1e6,
+		RTTVar:           float64(info.Rttvar) / 1e6,
+		TotalRetransmits: info.Total_retrans,
+		Lost:             info.Lost,
+		CongestionWindow: info.Snd_cwnd,
+	}, nil
+}
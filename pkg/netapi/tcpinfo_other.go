@@ -0,0 +1,13 @@
+//go:build !linux
+
+package netapi
+
+import (
+	"errors"
+	"net"
+)
+
+// readTCPInfo fails, TCP_INFO is only read on Linux.
+func readTCPInfo(*net.TCPConn) (*TCPInfo, error) {
+	return nil, errors.ErrUnsupported
+}
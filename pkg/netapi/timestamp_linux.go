@@ -0,0 +1,87 @@
+package netapi
+
+import (
+	"errors"
+	"net"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// timestampFlags turns on software timestamps of the datagrams received and sent on a socket. The transmit
+// timestamps are queued on the error queue without a copy of the datagram.
+const timestampFlags = unix.SOF_TIMESTAMPING_SOFTWARE | unix.SOF_TIMESTAMPING_RX_SOFTWARE |
+	unix.SOF_TIMESTAMPING_TX_SOFTWARE | unix.SOF_TIMESTAMPING_OPT_TSONLY
+
+// timestampOOBSize is large enough for the control messages carrying a timestamp and the extended error.
+const timestampOOBSize = 256
+
+// enableTimestamps turns on kernel RX and TX timestamps on conn.
+func enableTimestamps(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TIMESTAMPING, timestampFlags)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// txTimestamp returns the time the kernel sent the last datagram written to conn, read from its error queue. It
+// does not wait for the timestamp, so it is read once the reply arrived, when the kernel has long queued it. The
+// timestamps of earlier datagrams left on the queue are drained. The time is zero when no timestamp is queued, for
+// example when the driver does not support transmit timestamps.
+func txTimestamp(conn *net.UDPConn) (time.Time, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return time.Time{}, err
+	}
+	var stamp time.Time
+	var recvErr error
+	oob := make([]byte, timestampOOBSize)
+	err = raw.Control(func(fd uintptr) {
+		for {
+			_, oobn, _, _, err := unix.Recvmsg(int(fd), nil, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+			if errors.Is(err, unix.EAGAIN) {
+				return
+			}
+			if err != nil {
+				recvErr = err
+				return
+			}
+			if ts, ok := rxTimestamp(oob[:oobn]); ok {
+				stamp = ts
+			}
+		}
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return stamp, recvErr
+}
+
+// rxTimestamp returns the software timestamp carried by the control messages oob, false when there is none.
+func rxTimestamp(oob []byte) (time.Time, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}, false
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level != unix.SOL_SOCKET || msg.Header.Type != unix.SCM_TIMESTAMPING {
+			continue
+		}
+		if len(msg.Data) < int(unsafe.Sizeof(unix.ScmTimestamping{})) {
+			return time.Time{}, false
+		}
+		// the first timestamp is the software one, the others are set by hardware timestamping
+		ts := (*unix.ScmTimestamping)(unsafe.Pointer(&msg.Data[0])).Ts[0]
+		return time.Unix(ts.Unix()), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,84 @@
+package netapi
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func Test_KernelTimestamps(t *testing.T) {
+	srv, err := NewServer("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startServer(t, srv)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+
+	client, err := NewClient("udp", srv.BoundAddr().String(), WithWire(WireBinary), WithKernelTimestamps(true))
+	require.NoError(t, err)
+	require.NoError(t, client.Connect())
+	defer func(client Client) {
+		_ = client.Close()
+	}(client)
+
+	// the kernel turns receive timestamps on lazily, so the first replies may not be stamped
+	stamped := 0
+	for i := 0; i < 20 && stamped < 3; i++ {
+		resp, err := client.Probe()
+		require.NoError(t, err)
+		if resp.KernelRTT == 0 {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		stamped++
+		// the kernel sends the probe after the client stamped it and receives the reply before the client reads it
+		sent, err := time.Parse(time.RFC3339Nano, resp.ClientTime)
+		require.NoError(t, err)
+		done, err := time.Parse(time.RFC3339Nano, resp.ClientDone)
+		require.NoError(t, err)
+		assert.Greater(t, resp.KernelRTT, float64(0), "probe %d", i)
+		assert.LessOrEqual(t, resp.KernelRTT, done.Sub(sent).Seconds(), "probe %d", i)
+	}
+	assert.Equal(t, 3, stamped)
+
+	_, err = NewClient("tcp", "127.0.0.1:1", WithWire(WireBinary), WithKernelTimestamps(true))
+	assert.Error(t, err)
+	_, err = NewClient("udp", "127.0.0.1:1", WithWire(WireText), WithKernelTimestamps(true))
+	assert.Error(t, err, "text probes are not timestamped")
+}
+
+func Test_KernelTimestampsMissing(t *testing.T) {
+	srv, err := NewServer("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startServer(t, srv)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+
+	client, err := NewClient("udp", srv.BoundAddr().String(), WithWire(WireBinary), WithKernelTimestamps(true))
+	require.NoError(t, err)
+	require.NoError(t, client.Connect())
+	defer func(client Client) {
+		_ = client.Close()
+	}(client)
+
+	// only receive timestamps, like a driver that does not stamp the datagrams it sends
+	raw, err := client.(*UDPClient).conn.(*net.UDPConn).SyscallConn()
+	require.NoError(t, err)
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		require.NoError(t, unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TIMESTAMPING,
+			unix.SOF_TIMESTAMPING_SOFTWARE|unix.SOF_TIMESTAMPING_RX_SOFTWARE))
+	}))
+
+	for i := range 3 {
+		start := time.Now()
+		resp, err := client.Probe()
+		require.NoError(t, err, "the probe is answered without the transmit timestamp")
+		assert.Zero(t, resp.KernelRTT, "probe %d", i)
+		assert.Less(t, time.Since(start), time.Second, "the probe does not wait for the transmit timestamp")
+	}
+}
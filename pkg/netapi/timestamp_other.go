@@ -0,0 +1,27 @@
+//go:build !linux
+
+package netapi
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// timestampOOBSize is 0 where the kernel timestamps are not supported.
+const timestampOOBSize = 0
+
+// enableTimestamps fails, kernel timestamps are only supported on Linux.
+func enableTimestamps(*net.UDPConn) error {
+	return errors.ErrUnsupported
+}
+
+// txTimestamp fails, kernel timestamps are only supported on Linux.
+func txTimestamp(*net.UDPConn) (time.Time, error) {
+	return time.Time{}, errors.ErrUnsupported
+}
+
+// rxTimestamp never finds a timestamp, kernel timestamps are only supported on Linux.
+func rxTimestamp([]byte) (time.Time, bool) {
+	return time.Time{}, false
+}
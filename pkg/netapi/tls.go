@@ -0,0 +1,195 @@
+package netapi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// errTLSUnsupported is returned for the protocols that are not secured with TLS.
+var errTLSUnsupported = errors.New("TLS is only supported over tcp, http, grpc and quic")
+
+// TLSConfig holds the files used to secure the probe traffic with TLS.
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM encoded certificate and key presented to the peer.
+	// They are required for a server and turn on mutual TLS for a client.
+	CertFile string
+	KeyFile  string
+
+	// CAFile is the PEM encoded bundle used to verify the peer. A client uses the system roots when it is empty.
+	CAFile string
+
+	// ClientAuth makes a server require and verify client certificates against CAFile.
+	ClientAuth bool
+
+	// ServerName is the name a client verifies the server certificate against.
+	// When it is empty the host of the address being probed is used.
+	ServerName string
+}
+
+// CertReloader loads the certificates of a TLSConfig from disk and loads them again when the files change,
+// so certificates rotated by tools like cert-manager are picked up without a restart.
+// It is safe for concurrent use and is meant to be shared by every server or client of a process.
+type CertReloader struct {
+	config TLSConfig
+
+	mu      sync.Mutex
+	modTime time.Time
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+// NewCertReloader creates a CertReloader and loads the files of config for the first time.
+func NewCertReloader(config TLSConfig) (*CertReloader, error) {
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, errors.New("a TLS certificate and key must be given together")
+	}
+	if config.ClientAuth && config.CAFile == "" {
+		return nil, errors.New("a TLS CA is required to verify client certificates")
+	}
+	r := &CertReloader{
+		config: config,
+	}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// latestModTime returns the most recent modification time of the configured files.
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.config.CertFile, r.config.KeyFile, r.config.CAFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load reads the configured files and replaces the current certificate and CA pool.
+// It must be called with mu held or before the reloader is shared.
+func (r *CertReloader) load(modTime time.Time) error {
+	var cert *tls.Certificate
+	if r.config.CertFile != "" {
+		pair, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+		if err != nil {
+			return fmt.Errorf("could not load TLS certificate: %w", err)
+		}
+		cert = &pair
+	}
+
+	var pool *x509.CertPool
+	if r.config.CAFile != "" {
+		pem, err := os.ReadFile(r.config.CAFile)
+		if err != nil {
+			return fmt.Errorf("could not read TLS CA: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in TLS CA")
+		}
+	}
+
+	r.cert = cert
+	r.pool = pool
+	r.modTime = modTime
+	return nil
+}
+
+// current returns the certificate and CA pool, reloading them first if the files changed on disk.
+// When a reload fails, for example because only half of the files have been rotated yet, the previous
+// certificates are kept and the reload is tried again on the next call.
+func (r *CertReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime, err := r.latestModTime()
+	if err == nil && modTime.After(r.modTime) {
+		err = r.load(modTime)
+		if err == nil {
+			log.Info().Msg("reloaded TLS certificates")
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("could not reload TLS certificates, keeping the previous ones")
+	}
+	return r.cert, r.pool
+}
+
+// ServerConfig returns the tls.Config for a server. The certificates are looked up on every handshake.
+func (r *CertReloader) ServerConfig() (*tls.Config, error) {
+	if r.config.CertFile == "" {
+		return nil, errors.New("a TLS certificate and key are required for the server")
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if r.config.ClientAuth {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = pool
+			}
+			return config, nil
+		},
+	}, nil
+}
+
+// withALPN makes a server config returned by ServerConfig offer the application protocols protos.
+func withALPN(config *tls.Config, protos ...string) {
+	config.NextProtos = protos
+	getConfig := config.GetConfigForClient
+	if getConfig == nil {
+		return
+	}
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		config, err := getConfig(hello)
+		if err == nil {
+			config.NextProtos = protos
+		}
+		return config, err
+	}
+}
+
+// ClientConfig returns the tls.Config for a client connecting to host.
+func (r *CertReloader) ClientConfig(host string) *tls.Config {
+	cert, pool := r.current()
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    pool,
+		ServerName: r.config.ServerName,
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+		// the zone of a link-local address is local to the client, certificates are issued for the address alone
+		if addr, err := netip.ParseAddr(host); err == nil {
+			config.ServerName = addr.WithZone("").String()
+		}
+	}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	return config
+}
@@ -0,0 +1,154 @@
+package netapi
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCerts writes a CA and a certificate for 127.0.0.1 signed by it to dir and returns the TLSConfig for them.
+func writeTestCerts(t *testing.T, dir string, serial int64) TLSConfig {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "kitter test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial + 1),
+		Subject:      pkix.Name{CommonName: "kitter"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	config := TLSConfig{
+		CertFile: filepath.Join(dir, "tls.crt"),
+		KeyFile:  filepath.Join(dir, "tls.key"),
+		CAFile:   filepath.Join(dir, "ca.crt"),
+	}
+	writePEM(t, config.CAFile, "CERTIFICATE", caDER)
+	writePEM(t, config.CertFile, "CERTIFICATE", der)
+	writePEM(t, config.KeyFile, "EC PRIVATE KEY", keyDER)
+	return config
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	require.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+}
+
+func Test_MutualTLSProbe(t *testing.T) {
+	config := writeTestCerts(t, t.TempDir(), 1)
+	config.ClientAuth = true
+	reloader, err := NewCertReloader(config)
+	require.NoError(t, err)
+
+	srv, err := NewServer("tcp", "127.0.0.1:1129", WithServerTLS(reloader))
+	require.NoError(t, err)
+	readCh := make(chan struct{})
+	go func() {
+		_ = srv.Run(context.Background(), readCh)
+	}()
+	<-readCh
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+
+	client, err := NewClient("tcp", "127.0.0.1:1129", WithWire(WireBinary), WithTLS(reloader))
+	require.NoError(t, err)
+	require.NoError(t, client.Connect())
+	defer func(client Client) {
+		_ = client.Close()
+	}(client)
+
+	resp, err := client.Probe()
+	require.NoError(t, err)
+	assert.Greater(t, resp.TLSHandshake, float64(0))
+
+	// the handshake is only reported once per connection
+	resp, err = client.Probe()
+	require.NoError(t, err)
+	assert.Zero(t, resp.TLSHandshake)
+
+	// a client without a certificate is rejected
+	anonymous, err := NewCertReloader(TLSConfig{CAFile: config.CAFile})
+	require.NoError(t, err)
+	client, err = NewClient("tcp", "127.0.0.1:1129", WithTLS(anonymous))
+	require.NoError(t, err)
+	if err := client.Connect(); err == nil {
+		_, err = client.Probe()
+		assert.Error(t, err)
+		_ = client.Close()
+	}
+}
+
+func Test_ClientConfigServerName(t *testing.T) {
+	reloader, err := NewCertReloader(writeTestCerts(t, t.TempDir(), 1))
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", reloader.ClientConfig("10.0.0.1").ServerName)
+	// the zone only means something to the client
+	assert.Equal(t, "fe80::1", reloader.ClientConfig("fe80::1%eth0").ServerName)
+	assert.Equal(t, "kitter.example", reloader.ClientConfig("kitter.example").ServerName)
+}
+
+func Test_CertReloaderRotation(t *testing.T) {
+	dir := t.TempDir()
+	config := writeTestCerts(t, dir, 10)
+	reloader, err := NewCertReloader(config)
+	require.NoError(t, err)
+	before, _ := reloader.current()
+
+	// rotate the files and make sure the modification time moves forward
+	writeTestCerts(t, dir, 20)
+	future := time.Now().Add(time.Minute)
+	for _, file := range []string{config.CertFile, config.KeyFile, config.CAFile} {
+		require.NoError(t, os.Chtimes(file, future, future))
+	}
+
+	after, _ := reloader.current()
+	assert.NotEqual(t, before.Certificate[0], after.Certificate[0])
+}
+
+func Test_TLSUnsupported(t *testing.T) {
+	reloader, err := NewCertReloader(writeTestCerts(t, t.TempDir(), 1))
+	require.NoError(t, err)
+	for _, protocol := range []string{"udp", "unix", "twamp", "stamp"} {
+		_, err = NewServer(protocol, "127.0.0.1:0", WithServerTLS(reloader))
+		assert.ErrorIs(t, err, errTLSUnsupported, protocol)
+		_, err = NewClient(protocol, "127.0.0.1:5102", WithTLS(reloader))
+		assert.ErrorIs(t, err, errTLSUnsupported, protocol)
+	}
+	for _, protocol := range []string{"tcp", "http", "grpc", "quic"} {
+		_, err = NewServer(protocol, "127.0.0.1:0", WithServerTLS(reloader))
+		assert.NoError(t, err, protocol)
+	}
+}
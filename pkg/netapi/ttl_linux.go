@@ -0,0 +1,69 @@
+package netapi
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// ttlOOBSize is large enough for the control message carrying the TTL or hop limit of a datagram.
+const ttlOOBSize = 64
+
+// enableTTL makes the kernel report the TTL of the IPv4 datagrams and the hop limit of the IPv6 datagrams received
+// on conn. Dual stack sockets receive both.
+func enableTTL(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		err4 := unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVTTL, 1)
+		err6 := unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVHOPLIMIT, 1)
+		// a socket of a single family refuses the option of the other one
+		if err4 != nil && err6 != nil {
+			sockErr = err4
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// setTTL sets the TTL or hop limit of the datagrams sent on the connected socket conn.
+func setTTL(conn *net.UDPConn, ttl int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	level, opt := unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		level, opt = unix.IPPROTO_IP, unix.IP_TTL
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), level, opt, ttl)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// parseTTL returns the TTL or hop limit carried by the control messages oob, 0 when there is none.
+func parseTTL(oob []byte) int {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, msg := range msgs {
+		isTTL := msg.Header.Level == unix.IPPROTO_IP && msg.Header.Type == unix.IP_TTL
+		isHopLimit := msg.Header.Level == unix.IPPROTO_IPV6 && msg.Header.Type == unix.IPV6_HOPLIMIT
+		if (isTTL || isHopLimit) && len(msg.Data) >= 4 {
+			return int(binary.NativeEndian.Uint32(msg.Data))
+		}
+	}
+	return 0
+}
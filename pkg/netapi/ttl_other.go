@@ -0,0 +1,26 @@
+//go:build !linux
+
+package netapi
+
+import (
+	"errors"
+	"net"
+)
+
+// ttlOOBSize is 0 where the TTL of the datagrams is not reported.
+const ttlOOBSize = 0
+
+// enableTTL fails, the TTL of the datagrams received is only reported on Linux.
+func enableTTL(*net.UDPConn) error {
+	return errors.ErrUnsupported
+}
+
+// setTTL fails, the TTL of the datagrams sent is only set on Linux.
+func setTTL(*net.UDPConn, int) error {
+	return errors.ErrUnsupported
+}
+
+// parseTTL never finds a TTL, it is only reported on Linux.
+func parseTTL([]byte) int {
+	return 0
+}
@@ -0,0 +1,436 @@
+package netapi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// TWAMP-Light (RFC 5357 appendix I) measures the delays of a path with UDP test packets sent by a session-sender to
+// a session-reflector, which stamps them and sends them back, without the TWAMP control protocol. The packets use
+// the unauthenticated mode, all fields big endian.
+//
+// Test packet of the session-sender:
+//
+//	0  seq           uint32
+//	4  timestamp     NTP   when the sender sent the packet
+//	12 errorEstimate uint16
+//	14 padding
+//
+// Test packet of the session-reflector:
+//
+//	0  seq                 uint32
+//	4  timestamp           NTP   when the reflector sent the packet
+//	12 errorEstimate       uint16
+//	14 MBZ                 uint16
+//	16 receiveTimestamp    NTP   when the reflector received the test packet
+//	24 senderSeq           uint32
+//	28 senderTimestamp     NTP
+//	36 senderErrorEstimate uint16
+//	38 MBZ                 uint16
+//	40 senderTTL           uint8 TTL or hop limit the test packet was received with
+//	41 padding
+const (
+	twampSenderHeaderSize    = 14
+	twampReflectorHeaderSize = 41
+
+	// TWAMPPort is the well-known port of TWAMP, TWAMP-Light reflectors often listen on it as well.
+	TWAMPPort = 862
+
+	// twampTTL is the TTL the session-sender sends its test packets with.
+	twampTTL = 255
+)
+
+// NTPTimestamp is a timestamp in the 64 bit NTP format: seconds since 1900 in the upper 32 bits and the fraction of
+// a second in the lower 32 bits.
+type NTPTimestamp uint64
+
+// ntpEpochOffset is the number of seconds from the NTP epoch in 1900 to the unix epoch.
+const ntpEpochOffset = 2208988800
+
+// NewNTPTimestamp returns the NTPTimestamp of t.
+func NewNTPTimestamp(t time.Time) NTPTimestamp {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := (uint64(t.Nanosecond()) << 32) / uint64(time.Second)
+	return NTPTimestamp(secs<<32 | frac)
+}
+
+// Time returns the time of the timestamp, rounded to the nanosecond.
+func (ts NTPTimestamp) Time() time.Time {
+	secs := int64(ts>>32) - ntpEpochOffset
+	nanos := (uint64(ts&math.MaxUint32)*uint64(time.Second) + 1<<31) >> 32
+	return time.Unix(secs, int64(nanos))
+}
+
+// ErrorEstimate is the estimated error of a timestamp (RFC 4656 section 4.1.2): the S bit tells whether the clock is
+// synchronized to UTC, the Z bit is 0 for NTP timestamps and the error is Multiplier*2^(Scale-32) seconds.
+//
+//	S Z Scale(6 bits) Multiplier(8 bits)
+type ErrorEstimate uint16
+
+// NewErrorEstimate returns the ErrorEstimate of a clock with the error d, synchronized to UTC when synced is set.
+// The error is rounded up to what the estimate can represent.
+func NewErrorEstimate(synced bool, d time.Duration) ErrorEstimate {
+	var e ErrorEstimate
+	if synced {
+		e |= 1 << 15
+	}
+	// find the smallest scale that fits the error into the 8 bit multiplier
+	units := math.Ceil(d.Seconds() * (1 << 32))
+	scale := 0
+	for units > math.MaxUint8 && scale < 63 {
+		units = math.Ceil(units / 2)
+		scale++
+	}
+	multiplier := min(max(units, 1), math.MaxUint8) // a multiplier of 0 is invalid
+	return e | ErrorEstimate(scale)<<8 | ErrorEstimate(multiplier)
+}
+
+// Synchronized reports whether the clock that took the timestamp is synchronized to UTC.
+func (e ErrorEstimate) Synchronized() bool {
+	return e&(1<<15) != 0
+}
+
+// Seconds returns the estimated error in seconds.
+func (e ErrorEstimate) Seconds() float64 {
+	scale := int(e>>8) & 0x3f
+	return float64(e&0xff) * math.Ldexp(1, scale-32)
+}
+
+// twampErrorEstimate is the estimate sent with the timestamps of kitter, which does not know how well the clock of
+// the host is synchronized.
+var twampErrorEstimate = NewErrorEstimate(false, time.Millisecond)
+
+// TWAMPSenderPacket is an unauthenticated test packet of a TWAMP-Light session-sender.
+type TWAMPSenderPacket struct {
+	Seq           uint32
+	Timestamp     NTPTimestamp
+	ErrorEstimate ErrorEstimate
+	Padding       []byte
+}
+
+// MarshalBinary encodes the packet into its wire representation.
+func (p *TWAMPSenderPacket) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, twampSenderHeaderSize+len(p.Padding))
+	binary.BigEndian.PutUint32(buf[0:], p.Seq)
+	binary.BigEndian.PutUint64(buf[4:], uint64(p.Timestamp))
+	binary.BigEndian.PutUint16(buf[12:], uint16(p.ErrorEstimate))
+	copy(buf[twampSenderHeaderSize:], p.Padding)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a packet from a complete datagram.
+func (p *TWAMPSenderPacket) UnmarshalBinary(data []byte) error {
+	if len(data) < twampSenderHeaderSize {
+		return fmt.Errorf("TWAMP test packet of %d bytes is shorter than the minimum of %d", len(data), twampSenderHeaderSize)
+	}
+	p.Seq = binary.BigEndian.Uint32(data[0:])
+	p.Timestamp = NTPTimestamp(binary.BigEndian.Uint64(data[4:]))
+	p.ErrorEstimate = ErrorEstimate(binary.BigEndian.Uint16(data[12:]))
+	p.Padding = append([]byte(nil), data[twampSenderHeaderSize:]...)
+	return nil
+}
+
+// TWAMPReflectorPacket is an unauthenticated test packet of a TWAMP-Light session-reflector, the answer to a
+// TWAMPSenderPacket.
+type TWAMPReflectorPacket struct {
+	Seq                 uint32
+	Timestamp           NTPTimestamp
+	ErrorEstimate       ErrorEstimate
+	ReceiveTimestamp    NTPTimestamp
+	SenderSeq           uint32
+	SenderTimestamp     NTPTimestamp
+	SenderErrorEstimate ErrorEstimate
+	SenderTTL           uint8
+	Padding             []byte
+}
+
+// MarshalBinary encodes the packet into its wire representation, the MBZ fields are zero.
+func (p *TWAMPReflectorPacket) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, twampReflectorHeaderSize+len(p.Padding))
+	binary.BigEndian.PutUint32(buf[0:], p.Seq)
+	binary.BigEndian.PutUint64(buf[4:], uint64(p.Timestamp))
+	binary.BigEndian.PutUint16(buf[12:], uint16(p.ErrorEstimate))
+	binary.BigEndian.PutUint64(buf[16:], uint64(p.ReceiveTimestamp))
+	binary.BigEndian.PutUint32(buf[24:], p.SenderSeq)
+	binary.BigEndian.PutUint64(buf[28:], uint64(p.SenderTimestamp))
+	binary.BigEndian.PutUint16(buf[36:], uint16(p.SenderErrorEstimate))
+	buf[40] = p.SenderTTL
+	copy(buf[twampReflectorHeaderSize:], p.Padding)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a packet from a complete datagram.
+func (p *TWAMPReflectorPacket) UnmarshalBinary(data []byte) error {
+	if len(data) < twampReflectorHeaderSize {
+		return fmt.Errorf("TWAMP reflected packet of %d bytes is shorter than the minimum of %d", len(data), twampReflectorHeaderSize)
+	}
+	p.Seq = binary.BigEndian.Uint32(data[0:])
+	p.Timestamp = NTPTimestamp(binary.BigEndian.Uint64(data[4:]))
+	p.ErrorEstimate = ErrorEstimate(binary.BigEndian.Uint16(data[12:]))
+	p.ReceiveTimestamp = NTPTimestamp(binary.BigEndian.Uint64(data[16:]))
+	p.SenderSeq = binary.BigEndian.Uint32(data[24:])
+	p.SenderTimestamp = NTPTimestamp(binary.BigEndian.Uint64(data[28:]))
+	p.SenderErrorEstimate = ErrorEstimate(binary.BigEndian.Uint16(data[36:]))
+	p.SenderTTL = data[40]
+	p.Padding = append([]byte(nil), data[twampReflectorHeaderSize:]...)
+	return nil
+}
+
+// TWAMPResult holds the fields of a reflected TWAMP-Light or STAMP test packet that have no place in the Response.
+type TWAMPResult struct {
+	// ReflectorSeq is the sequence number of the reflected packet.
+	ReflectorSeq uint32 `json:"reflectorSeq"`
+
+	// ForwardLost and ReverseLost are the test packets lost on the way to the reflector and back since the previous
+	// reflected packet. Only stateful reflectors number their packets on their own, stateless ones copy the sequence
+	// number of the test packet and every loss is counted as a reverse loss.
+	ForwardLost uint32 `json:"forwardLost"`
+	ReverseLost uint32 `json:"reverseLost"`
+
+	// SenderTTL is the TTL or hop limit the test packet reached the reflector with, the sender sends it with 255.
+	// It is 0 when the reflector does not report it.
+	SenderTTL uint8 `json:"senderTTL"`
+
+	// SenderError and ReflectorError are the estimated errors of the timestamps of the two ends in seconds, and
+	// Synchronized reports whether both clocks are synchronized to UTC.
+	SenderError    float64 `json:"senderError"`
+	ReflectorError float64 `json:"reflectorError"`
+	Synchronized   bool    `json:"synchronized"`
+}
+
+// packetCodec encodes and decodes the test packets of TWAMP-Light or STAMP.
+type packetCodec interface {
+	marshalSender(p *TWAMPSenderPacket) ([]byte, error)
+	unmarshalSender(data []byte) (TWAMPSenderPacket, error)
+	marshalReflector(p *TWAMPReflectorPacket) ([]byte, error)
+	unmarshalReflector(data []byte) (TWAMPReflectorPacket, error)
+}
+
+// twampCodec encodes the TWAMP-Light test packets in the unauthenticated mode.
+type twampCodec struct{}
+
+func (twampCodec) marshalSender(p *TWAMPSenderPacket) ([]byte, error) {
+	return p.MarshalBinary()
+}
+
+func (twampCodec) unmarshalSender(data []byte) (TWAMPSenderPacket, error) {
+	var p TWAMPSenderPacket
+	return p, p.UnmarshalBinary(data)
+}
+
+func (twampCodec) marshalReflector(p *TWAMPReflectorPacket) ([]byte, error) {
+	return p.MarshalBinary()
+}
+
+func (twampCodec) unmarshalReflector(data []byte) (TWAMPReflectorPacket, error) {
+	var p TWAMPReflectorPacket
+	return p, p.UnmarshalBinary(data)
+}
+
+// reflector is the Handler of TWAMP-Light and STAMP servers. The padding of a reflected packet is shortened so it is
+// as large as the test packet when the sender padded it for that.
+type reflector struct {
+	codec packetCodec
+
+	// sessions numbers the reflected packets of every session when the reflector is stateful. When it is nil the
+	// reflector is stateless, the reflected packet carries the sequence number of the test packet.
+	sessions *reflectorSessions
+}
+
+// Handle answers the test packet of req.
+func (r *reflector) Handle(req *Request) ([]byte, error) {
+	test, err := r.codec.unmarshalSender(req.Data)
+	if err != nil {
+		return nil, err
+	}
+	seq := test.Seq
+	if r.sessions != nil {
+		seq = r.sessions.next(req.Conn.RemoteAddr, req.receivedAt())
+	}
+	reply := TWAMPReflectorPacket{
+		Seq:                 seq,
+		ErrorEstimate:       twampErrorEstimate,
+		ReceiveTimestamp:    NewNTPTimestamp(req.receivedAt()),
+		SenderSeq:           test.Seq,
+		SenderTimestamp:     test.Timestamp,
+		SenderErrorEstimate: test.ErrorEstimate,
+		SenderTTL:           uint8(min(req.TTL, math.MaxUint8)),
+		Padding:             make([]byte, max(len(test.Padding)-(twampReflectorHeaderSize-twampSenderHeaderSize), 0)),
+	}
+	reply.Timestamp = NewNTPTimestamp(time.Now())
+	return r.codec.marshalReflector(&reply)
+}
+
+// reflectorHandler returns r wrapped in the Middlewares and the server metrics. The Handler is not used, the
+// reflected packets have a fixed format.
+func (c ServerConfig) reflectorHandler(r *reflector) Handler {
+	return metricsMiddleware(Chain(r, c.Middlewares...))
+}
+
+// TWAMPClient is a TWAMP-Light or STAMP session-sender.
+// Every probe is a test packet on a connected UDP socket, the reflected packet carries the time the reflector
+// received and sent it, so the delays of both directions are known.
+type TWAMPClient struct {
+	// addr is the address of the reflector.
+	addr string
+
+	// config holds the options the client was created with.
+	config ClientConfig
+
+	// conn is the connected UDP socket used to reach the reflector.
+	conn *net.UDPConn
+
+	// codec encodes the test packets in the format of the protocol.
+	codec packetCodec
+
+	// padding is sent with every test packet.
+	padding []byte
+
+	// seq is the sequence number of the next test packet, the first one is 0.
+	seq uint32
+
+	// received counts the reflected packets received and forwardLost and reverseLost are the losses known so far.
+	// lastSeq and lastSenderSeq are the sequence numbers of the last reflected packet.
+	received      uint32
+	forwardLost   uint32
+	reverseLost   uint32
+	lastSeq       uint32
+	lastSenderSeq uint32
+}
+
+// twampPadding returns the padding of the test packets for a payload of size bytes. The padding is at least the
+// size the reflected packet adds, so both directions carry packets of the same size.
+func twampPadding(size int) []byte {
+	return make([]byte, max(size, twampReflectorHeaderSize-twampSenderHeaderSize))
+}
+
+// Connect is a method on the TWAMPClient struct that creates a connected UDP socket to the reflector.
+func (c *TWAMPClient) Connect() error {
+	conn, err := c.config.dialer("udp").Dial("udp", c.addr)
+	if err != nil {
+		return err
+	}
+	c.conn = conn.(*net.UDPConn)
+	if err := setTTL(c.conn, twampTTL); err != nil {
+		log.Debug().Err(err).Str("addr", c.addr).Msg("test packets are sent with the default TTL")
+	}
+	return nil
+}
+
+// SendData fails, a session-sender only sends test packets.
+func (c *TWAMPClient) SendData(string) (string, error) {
+	return "", errors.New("TWAMP-Light and STAMP only send test packets, use Probe")
+}
+
+// Probe is a method on the TWAMPClient struct that sends a single test packet and waits for it to be reflected.
+// Reflected packets of earlier test packets that arrive late are discarded.
+func (c *TWAMPClient) Probe() (Response, error) {
+	if c.conn == nil {
+		return Response{}, errors.New("connection not established")
+	}
+	if err := c.conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return Response{}, err
+	}
+
+	test := TWAMPSenderPacket{Seq: c.seq, ErrorEstimate: twampErrorEstimate, Padding: c.padding}
+	c.seq++
+	sent := time.Now()
+	test.Timestamp = NewNTPTimestamp(sent)
+	data, err := c.codec.marshalSender(&test)
+	if err != nil {
+		return Response{}, err
+	}
+	if _, err := c.conn.Write(data); err != nil {
+		return Response{}, err
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := c.conn.Read(buf)
+		done := time.Now()
+		if err != nil {
+			return Response{}, err
+		}
+		reply, err := c.codec.unmarshalReflector(buf[:n])
+		if err != nil {
+			return Response{}, err
+		}
+		forwardLost, reverseLost := c.countLosses(&reply)
+		if reply.SenderSeq != test.Seq || reply.SenderTimestamp != test.Timestamp {
+			// a late reply to a test packet that already timed out
+			continue
+		}
+		resp := c.response(sent, done, &reply)
+		resp.TWAMP.ForwardLost, resp.TWAMP.ReverseLost = forwardLost, reverseLost
+		return resp, nil
+	}
+}
+
+// countLosses counts reply as received and returns the packets lost in each direction since the previous reply.
+// The test packets the reflector did not receive are the gap between the sequence numbers of the test packet and the
+// reflected packet, the reflected packets the client did not receive are the gap between the sequence number of the
+// reflected packet and the count of reflected packets received.
+func (c *TWAMPClient) countLosses(reply *TWAMPReflectorPacket) (uint32, uint32) {
+	c.received++
+	if reply.SenderSeq < reply.Seq {
+		// the reflector does not number the packets of this session alone, the losses are unknown
+		return 0, 0
+	}
+	if c.received > 1 {
+		if reply.SenderSeq < c.lastSenderSeq {
+			// a reply later than the next one, it was counted as lost already
+			c.received--
+			return 0, 0
+		}
+		if reply.Seq < c.lastSeq {
+			// the reflector numbers the packets from the start again, for example after a restart
+			c.received = reply.Seq + 1
+			c.forwardLost, c.reverseLost = reply.SenderSeq-reply.Seq, 0
+		}
+	}
+	c.lastSenderSeq, c.lastSeq = reply.SenderSeq, reply.Seq
+	forwardLost := reply.SenderSeq - reply.Seq
+	reverseLost := reply.Seq + 1 - min(c.received, reply.Seq+1)
+	forward := forwardLost - min(forwardLost, c.forwardLost)
+	reverse := reverseLost - min(reverseLost, c.reverseLost)
+	c.forwardLost, c.reverseLost = max(forwardLost, c.forwardLost), max(reverseLost, c.reverseLost)
+	return forward, reverse
+}
+
+// response converts a reflected packet into a Response, sent and done are when the test packet was sent and the
+// reflected packet received.
+func (c *TWAMPClient) response(sent, done time.Time, reply *TWAMPReflectorPacket) Response {
+	received := reply.ReceiveTimestamp.Time()
+	return Response{
+		ClientTime:     sent.Format(time.RFC3339Nano),
+		ServerTime:     received.Format(time.RFC3339Nano),
+		ServerSendTime: reply.Timestamp.Time().Format(time.RFC3339Nano),
+		ClientDone:     done.Format(time.RFC3339Nano),
+		Client:         c.conn.LocalAddr().String(),
+		Server:         c.addr,
+		Latency:        received.Sub(sent).Seconds(),
+		Seq:            reply.SenderSeq,
+		PayloadSize:    len(reply.Padding),
+		TWAMP: &TWAMPResult{
+			ReflectorSeq:   reply.Seq,
+			SenderTTL:      reply.SenderTTL,
+			SenderError:    reply.SenderErrorEstimate.Seconds(),
+			ReflectorError: reply.ErrorEstimate.Seconds(),
+			Synchronized:   reply.SenderErrorEstimate.Synchronized() && reply.ErrorEstimate.Synchronized(),
+		},
+	}
+}
+
+// Close is a method on the TWAMPClient struct that closes the socket.
+func (c *TWAMPClient) Close() error {
+	if c.conn == nil {
+		return errors.New("connection not established")
+	}
+	return c.conn.Close()
+}
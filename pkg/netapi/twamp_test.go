@@ -0,0 +1,112 @@
+package netapi
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NTPTimestamp(t *testing.T) {
+	assert.Equal(t, NTPTimestamp(ntpEpochOffset<<32), NewNTPTimestamp(time.Unix(0, 0)))
+	// half a second is the top bit of the fraction
+	assert.Equal(t, NTPTimestamp(ntpEpochOffset<<32|1<<31), NewNTPTimestamp(time.Unix(0, 5e8)))
+
+	now := time.Now()
+	assert.True(t, now.Equal(NewNTPTimestamp(now).Time()), "the conversion keeps every nanosecond")
+}
+
+func Test_ErrorEstimate(t *testing.T) {
+	e := NewErrorEstimate(false, time.Millisecond)
+	assert.False(t, e.Synchronized())
+	assert.GreaterOrEqual(t, e.Seconds(), 0.001)
+	assert.Less(t, e.Seconds(), 0.002)
+
+	e = NewErrorEstimate(true, 0)
+	assert.True(t, e.Synchronized())
+	assert.Equal(t, ErrorEstimate(1<<15|1), e, "the multiplier is never 0")
+}
+
+func Test_TWAMPPackets(t *testing.T) {
+	now := NewNTPTimestamp(time.Now())
+	test := TWAMPSenderPacket{Seq: 7, Timestamp: now, ErrorEstimate: twampErrorEstimate, Padding: make([]byte, 27)}
+	data, err := test.MarshalBinary()
+	require.NoError(t, err)
+	assert.Len(t, data, 41)
+	var decoded TWAMPSenderPacket
+	require.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Equal(t, test, decoded)
+	assert.Error(t, decoded.UnmarshalBinary(data[:13]))
+
+	reflected := TWAMPReflectorPacket{Seq: 7, Timestamp: now + 2, ErrorEstimate: twampErrorEstimate,
+		ReceiveTimestamp: now + 1, SenderSeq: 7, SenderTimestamp: now, SenderErrorEstimate: twampErrorEstimate,
+		SenderTTL: 255, Padding: make([]byte, 3)}
+	data, err = reflected.MarshalBinary()
+	require.NoError(t, err)
+	assert.Len(t, data, 44)
+	var decodedReflected TWAMPReflectorPacket
+	require.NoError(t, decodedReflected.UnmarshalBinary(data))
+	assert.Equal(t, reflected, decodedReflected)
+	assert.Error(t, decodedReflected.UnmarshalBinary(data[:40]))
+}
+
+func Test_TWAMPReflect(t *testing.T) {
+	srv, err := NewServer("twamp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// a test packet without padding is answered with the smallest reflected packet
+	test := TWAMPSenderPacket{Seq: 3, Timestamp: NewNTPTimestamp(time.Now()), ErrorEstimate: NewErrorEstimate(true, 0)}
+	data, err := test.MarshalBinary()
+	require.NoError(t, err)
+	data, err = srv.ProcessData(context.Background(), data)
+	require.NoError(t, err)
+	var reply TWAMPReflectorPacket
+	require.NoError(t, reply.UnmarshalBinary(data))
+	assert.Len(t, data, 41)
+	assert.Equal(t, uint32(3), reply.Seq)
+	assert.Equal(t, test.Seq, reply.SenderSeq)
+	assert.Equal(t, test.Timestamp, reply.SenderTimestamp)
+	assert.Equal(t, test.ErrorEstimate, reply.SenderErrorEstimate)
+	assert.GreaterOrEqual(t, reply.Timestamp, reply.ReceiveTimestamp)
+
+	_, err = srv.ProcessData(context.Background(), []byte("too short"))
+	assert.Error(t, err)
+}
+
+func Test_TWAMPProbe(t *testing.T) {
+	srv, err := NewServer("twamp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startServer(t, srv)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+
+	client, err := NewClient("twamp", srv.BoundAddr().String(), WithPayloadSize(64))
+	require.NoError(t, err)
+	require.NoError(t, client.Connect())
+	defer func(client Client) {
+		_ = client.Close()
+	}(client)
+
+	for i := range 2 {
+		resp, err := client.Probe()
+		require.NoError(t, err)
+		assert.Equal(t, uint32(i), resp.Seq)
+		assert.NotEmpty(t, resp.ServerTime)
+		assert.NotEmpty(t, resp.ServerSendTime)
+		// the reflected packet is as large as the test packet
+		assert.Equal(t, 64+14-41, resp.PayloadSize)
+		require.NotNil(t, resp.TWAMP)
+		assert.Equal(t, uint32(i), resp.TWAMP.ReflectorSeq)
+		assert.Greater(t, resp.TWAMP.ReflectorError, float64(0))
+		if runtime.GOOS == "linux" {
+			assert.Equal(t, uint8(255), resp.TWAMP.SenderTTL, "loopback does not decrement the TTL")
+		}
+	}
+
+	_, err = client.SendData("hello")
+	assert.Error(t, err)
+}
@@ -0,0 +1,419 @@
+package netapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDatagramSize is the largest UDP payload the server and client will read.
+const maxDatagramSize = 65535
+
+// UDPServer is a struct that represents a UDP reflector.
+// Every datagram it receives is processed on its own and the response is sent back to the sender,
+// so lost or reordered packets are visible to the client instead of being hidden by retransmits.
+type UDPServer struct {
+	// Addr is the address where the server is hosted.
+	Addr string
+
+	// Config holds the options the server was created with.
+	Config ServerConfig
+
+	// handler answers the probes, the Handler of the Config wrapped in its Middlewares.
+	handler Handler
+
+	// ttl makes the server read the TTL of the datagrams, which TWAMP reflectors send back.
+	ttl bool
+
+	// server is a net.PacketConn which receives the incoming datagrams on the Addr.
+	server net.PacketConn
+	mu     sync.Mutex
+
+	// done is closed when the server stops reading datagrams.
+	done chan struct{}
+
+	// limiter limits the rate of probes per source IP, nil when the rate is not limited.
+	limiter *rateLimiter
+
+	// peers are the identities the clients announced on their probes, nil for the reflectors.
+	peers *announcedPeers
+}
+
+// Run is a method on the UDPServer struct that starts the UDP server.
+// This function takes a channel and sends a signal when it's ready.
+// It reads datagrams until ctx is done or the server is closed.
+func (u *UDPServer) Run(ctx context.Context, readyCh chan<- struct{}) (err error) {
+	// Listen on the UDP network at the server's address
+	server, err := u.Config.Socket.listenPacket(ctx, "udp", u.Addr)
+	if err == nil {
+		u.mu.Lock()
+		u.server = server
+		u.done = make(chan struct{})
+		u.mu.Unlock()
+	}
+	// Signal that the server is ready to receive datagrams
+	close(readyCh)
+	// If there is an error in listening, return the error
+	if err != nil {
+		return
+	}
+	defer close(u.done)
+
+	var oob []byte
+	if u.ttl {
+		if err := enableTTL(server.(*net.UDPConn)); err != nil {
+			log.Info().Err(err).Msg("the TTL of the datagrams is not reported")
+		} else {
+			oob = make([]byte, ttlOOBSize)
+		}
+	}
+
+	// stop reading when the context is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = server.Close()
+	})
+	defer stop()
+	return u.handlePackets(server, oob)
+}
+
+// BoundAddr returns the address the UDP Server is listening on.
+func (u *UDPServer) BoundAddr() net.Addr {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.server == nil {
+		return nil
+	}
+	return u.server.LocalAddr()
+}
+
+// Shutdown closes the UDP Server and waits for the datagram being handled to be answered.
+// A datagram is a whole exchange, so there are no connections to drain.
+func (u *UDPServer) Shutdown(ctx context.Context) error {
+	u.mu.Lock()
+	server, done := u.server, u.done
+	u.mu.Unlock()
+	if server == nil {
+		return errors.New("server not initialized")
+	}
+	if err := server.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close shuts down the UDP Server
+func (u *UDPServer) Close() (err error) {
+	u.mu.Lock()
+	server := u.server
+	u.mu.Unlock()
+	if server == nil {
+		return errors.New("server not initialized")
+	}
+	err = server.Close()
+	if errors.Is(err, net.ErrClosed) {
+		// the server was already stopped through its context
+		return nil
+	}
+	return err
+}
+
+// handlePackets reads datagrams from the socket, processes them and writes the response back to the sender.
+// The TTL of the datagrams is read into oob when it is not empty.
+func (u *UDPServer) handlePackets(server net.PacketConn, oob []byte) error {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, ttl, err := readDatagram(server, buf, oob)
+		if err != nil {
+			// A closed socket is the normal way to stop the server
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if u.Config.MaxProbeSize > 0 && n > u.Config.MaxProbeSize {
+			reject(rejectTooLarge)
+			continue
+		}
+		if !u.limiter.allow(addr.String()) {
+			// the client will notice the missing reply as a lost probe
+			reject(rejectRateLimit)
+			continue
+		}
+
+		data := buf[:n]
+		received := time.Now()
+		info := ConnInfo{RemoteAddr: addr.String(), LocalAddr: server.LocalAddr().String()}
+		info.Peer = u.peers.peer(info.RemoteAddr, data, received)
+		response, err := u.handle(&Request{
+			Data:     data,
+			Binary:   isFrame(data),
+			Received: received,
+			TTL:      ttl,
+			Conn:     info,
+			Server:   u.Addr,
+			Config:   u.Config,
+		})
+		if err != nil {
+			// the client will notice the missing reply as a lost probe
+			log.Error().Err(err).Msg("could not process datagram from client")
+			continue
+		}
+		if response == nil {
+			// the handler does not answer this probe
+			continue
+		}
+		_, _ = server.WriteTo(response, addr)
+	}
+}
+
+// readDatagram reads a single datagram into buf, with its TTL when oob is not empty.
+func readDatagram(conn net.PacketConn, buf, oob []byte) (int, net.Addr, int, error) {
+	udp, ok := conn.(*net.UDPConn)
+	if !ok || len(oob) == 0 {
+		n, addr, err := conn.ReadFrom(buf)
+		return n, addr, 0, err
+	}
+	n, oobn, _, addr, err := udp.ReadMsgUDP(buf, oob)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	return n, addr, parseTTL(oob[:oobn]), nil
+}
+
+// handle passes req to the handler of the server.
+func (u *UDPServer) handle(req *Request) ([]byte, error) {
+	return u.Config.handle(u.handler, req)
+}
+
+// ProcessData is a method on the UDPServer struct that processes the data received from a Client datagram.
+func (u *UDPServer) ProcessData(ctx context.Context, data []byte) ([]byte, error) {
+	info, _ := ConnInfoFrom(ctx)
+	return u.handle(&Request{
+		Data:   data,
+		Conn:   info,
+		Server: u.Addr,
+		Config: u.Config,
+	})
+}
+
+// UDPClient is a struct that represents a UDP Client.
+// It contains the address of the server and a connected UDP socket.
+type UDPClient struct {
+	// addr is the address of the server.
+	addr string
+
+	// config holds the options the client was created with.
+	config ClientConfig
+
+	// conn is the connected UDP socket used to reach the server.
+	conn net.Conn
+
+	// payload is the padding sent with every probe.
+	payload []byte
+
+	// seq is the sequence number of the last probe and probeID identifies the probes of this client.
+	seq     uint32
+	probeID uint64
+
+	// peer is the identity the server announced, the probes ask for it until it is known.
+	peer *Identity
+}
+
+// Connect is a method on the UDPClient struct that creates a connected UDP socket to the server.
+// No packets are exchanged, it only fixes the remote address for SendData.
+func (c *UDPClient) Connect() (err error) {
+	c.conn, err = c.config.dialer("udp").Dial("udp", c.addr)
+	if err != nil || !c.config.KernelTimestamps {
+		return err
+	}
+	if err := enableTimestamps(c.conn.(*net.UDPConn)); err != nil {
+		_ = c.conn.Close()
+		return fmt.Errorf("failed to enable kernel timestamps: %w", err)
+	}
+	return nil
+}
+
+// SendData is a method on the UDPClient struct that sends a single datagram to the server and waits for the reply.
+// A reply that does not arrive before the deadline is reported as an error.
+func (c *UDPClient) SendData(data string) (string, error) {
+	// Check if the connection is established
+	if c.conn == nil {
+		return "", errors.New("connection not established")
+	}
+
+	// set the timeout on the connection
+	err := c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		return "", err
+	}
+
+	_, err = c.conn.Write([]byte(data))
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Trim(string(buf[:n]), "\n"), nil
+}
+
+// sendText sends a text probe and waits for its reply. The server echoes the timestamp of the probe as the clientTime
+// of the reply, so replies to earlier probes that arrive late are discarded like the binary ones.
+func (c *UDPClient) sendText(data string) (string, error) {
+	// Check if the connection is established
+	if c.conn == nil {
+		return "", errors.New("connection not established")
+	}
+	stamp, _, _ := strings.Cut(data, " ")
+
+	// set the timeout on the connection
+	err := c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		return "", err
+	}
+
+	_, err = c.conn.Write([]byte(data))
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		var reply struct {
+			ClientTime string `json:"clientTime"`
+		}
+		if json.Unmarshal(buf[:n], &reply) == nil && reply.ClientTime != stamp {
+			// a late reply to a probe that already timed out
+			continue
+		}
+		return strings.Trim(string(buf[:n]), "\n"), nil
+	}
+}
+
+// Probe is a method on the UDPClient struct that sends a single probe datagram in the configured wire format.
+// UDP has no connection to negotiate on, so binary probes are sent with the current frame version and the server
+// answers every datagram in the format it was sent in. Replies to earlier probes that arrive late are discarded.
+func (c *UDPClient) Probe() (Response, error) {
+	// Check if the connection is established
+	if c.conn == nil {
+		return Response{}, errors.New("connection not established")
+	}
+	c.seq++
+	if c.config.Wire != WireBinary {
+		resp, err := textProbe(c.sendText, c.payload)
+		if err == nil {
+			identify(&resp, c.config.Identity, nil)
+		}
+		return resp, err
+	}
+
+	// set the timeout on the connection
+	err := c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		return Response{}, err
+	}
+
+	probe := newProbeFrame(CurrentFrameVersion, c.seq, c.probeID, c.payload)
+	if c.peer == nil {
+		// there is no hello, the identities are exchanged on the probes until the server answered with its own
+		if err := withIdentity(probe, c.config.Identity); err != nil {
+			return Response{}, err
+		}
+	}
+	probe.ClientTime = time.Now().UnixNano()
+	if err := WriteFrame(c.conn, probe); err != nil {
+		return Response{}, err
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, received, err := c.read(buf)
+		dStamp := time.Now()
+		if err != nil {
+			return Response{}, err
+		}
+		reply := &Frame{}
+		if err := reply.UnmarshalBinary(buf[:n]); err != nil {
+			return Response{}, err
+		}
+		if reply.Seq < probe.Seq {
+			// a late reply to a probe that already timed out
+			continue
+		}
+		if err := checkReply(probe, reply); err != nil {
+			return Response{}, err
+		}
+		peer, err := splitIdentity(reply)
+		if err != nil {
+			return Response{}, err
+		}
+		if peer != nil {
+			c.peer = peer
+		}
+		if err := checkReplySize(reply, len(c.payload), c.config.ReplySize); err != nil {
+			return Response{}, err
+		}
+		resp := frameResponse(reply, c.conn.LocalAddr().String(), c.addr, dStamp)
+		if c.config.KernelTimestamps {
+			resp.KernelRTT = c.kernelRTT(received)
+		}
+		identify(&resp, c.config.Identity, c.peer)
+		return resp, nil
+	}
+}
+
+// kernelRTT returns the time between the kernel sending the last probe and receiving its reply at received, 0 when
+// the kernel did not timestamp both.
+func (c *UDPClient) kernelRTT(received time.Time) float64 {
+	sent, err := txTimestamp(c.conn.(*net.UDPConn))
+	if err != nil {
+		log.Debug().Err(err).Str("addr", c.addr).Msg("no kernel timestamp for the probe")
+	}
+	if sent.IsZero() || received.IsZero() {
+		return 0
+	}
+	return received.Sub(sent).Seconds()
+}
+
+// read reads a single datagram into buf, with the time the kernel received it when kernel timestamps are enabled.
+func (c *UDPClient) read(buf []byte) (int, time.Time, error) {
+	if !c.config.KernelTimestamps {
+		n, err := c.conn.Read(buf)
+		return n, time.Time{}, err
+	}
+	oob := make([]byte, timestampOOBSize)
+	n, oobn, _, _, err := c.conn.(*net.UDPConn).ReadMsgUDP(buf, oob)
+	if err != nil {
+		return n, time.Time{}, err
+	}
+	received, _ := rxTimestamp(oob[:oobn])
+	return n, received, nil
+}
+
+// Close is a method on the UDPClient struct that closes the UDP socket.
+func (c *UDPClient) Close() error {
+	// Check if the connection is established
+	if c.conn == nil {
+		return errors.New("connection not established")
+	}
+	return c.conn.Close()
+}
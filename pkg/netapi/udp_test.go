@@ -0,0 +1,79 @@
+package netapi
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_UDPRoundTrip(t *testing.T) {
+	// Setup the server
+	srv, err := NewServer("udp", "127.0.0.1:1124")
+	require.NoError(t, err, "error creating UDP server")
+	readCh := make(chan struct{})
+
+	go func() {
+		err := srv.Run(context.Background(), readCh)
+		assert.NoError(t, err)
+	}()
+	<-readCh // make sure the server is listening before sending the probe
+	defer func(srv Server) {
+		err := srv.Close()
+		assert.NoError(t, err)
+	}(srv)
+
+	client, err := NewClient("udp", "127.0.0.1:1124")
+	require.NoError(t, err)
+	require.NoError(t, client.Connect())
+	defer func(client Client) {
+		_ = client.Close()
+	}(client)
+
+	stamp := time.Now().Format(time.RFC3339Nano)
+	data, err := client.SendData(stamp)
+	require.NoError(t, err, "SendData failed")
+
+	var resp Response
+	require.NoError(t, json.Unmarshal([]byte(data), &resp), "Failed to unmarshal response")
+	assert.Equal(t, stamp, resp.ClientTime)
+	assert.NotEmpty(t, resp.Client)
+}
+
+func Test_NewClientInvalidProtocol(t *testing.T) {
+	_, err := NewClient("sctp", "127.0.0.1:1124")
+	assert.Error(t, err)
+}
+
+func Test_UDPTextLateReply(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the reflector answers with the late reply to an earlier probe before the reply to this one
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		stale, _ := json.Marshal(Response{ClientTime: "2006-01-02T15:04:05Z", ServerTime: "2006-01-02T15:04:05Z"})
+		reply, _ := json.Marshal(Response{ClientTime: string(buf[:n]), ServerTime: time.Now().Format(time.RFC3339Nano)})
+		_, _ = conn.WriteTo(stale, addr)
+		_, _ = conn.WriteTo(reply, addr)
+	}()
+
+	client, err := NewClient("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	require.NoError(t, client.Connect())
+	defer func(client Client) {
+		_ = client.Close()
+	}(client)
+	resp, err := client.Probe()
+	require.NoError(t, err)
+	assert.NotEqual(t, "2006-01-02T15:04:05Z", resp.ClientTime)
+}
@@ -0,0 +1,47 @@
+package netapi
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Unix domain sockets are served by TCPServer and probed by TCPClient since they are stream oriented as well.
+// A socket name starting with "@" is in the Linux abstract namespace and has no file on disk.
+
+// isAbstractSocket reports whether addr names a socket in the abstract namespace.
+func isAbstractSocket(addr string) bool {
+	return strings.HasPrefix(addr, "@")
+}
+
+// removeStaleSocket removes a socket file left behind by a previous server that did not shut down cleanly,
+// so the new server can bind to the same path. Anything that is not a socket is left alone, and so is a socket a
+// running server still accepts connections on: only a socket that refuses connections is stale.
+func removeStaleSocket(path string) error {
+	if isAbstractSocket(path) {
+		return nil
+	}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%s is used by a running server: %w", path, syscall.EADDRINUSE)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("failed to check whether %s is stale: %w", path, err)
+	}
+	return os.Remove(path)
+}
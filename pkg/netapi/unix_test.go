@@ -0,0 +1,80 @@
+package netapi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_UnixSocketProbe(t *testing.T) {
+	addrs := []string{
+		filepath.Join(t.TempDir(), "kitter.sock"),
+		fmt.Sprintf("@kitter-test-%d", os.Getpid()),
+	}
+	for _, addr := range addrs {
+		srv, err := NewServer("unix", addr)
+		require.NoError(t, err)
+		readCh := make(chan struct{})
+		go func() {
+			_ = srv.Run(context.Background(), readCh)
+		}()
+		<-readCh
+
+		for _, wire := range []string{WireText, WireBinary} {
+			client, err := NewClient("unix", addr, WithWire(wire))
+			require.NoError(t, err)
+			require.NoError(t, client.Connect(), addr)
+
+			resp, err := client.Probe()
+			require.NoError(t, err, addr)
+			assert.NotEmpty(t, resp.ServerSendTime, addr)
+			_ = client.Close()
+		}
+		require.NoError(t, srv.Close())
+	}
+}
+
+func Test_RemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	// a regular file is never removed
+	file := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(file, nil, 0o600))
+	assert.Error(t, removeStaleSocket(file))
+
+	// missing files and abstract sockets are fine
+	assert.NoError(t, removeStaleSocket(filepath.Join(dir, "missing.sock")))
+	assert.NoError(t, removeStaleSocket("@kitter"))
+
+	// a socket nobody listens on is removed
+	stale := filepath.Join(dir, "stale.sock")
+	listener, err := net.Listen("unix", stale)
+	require.NoError(t, err)
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, listener.Close())
+	require.NoError(t, removeStaleSocket(stale))
+	assert.NoFileExists(t, stale)
+
+	// the socket of a running server is left alone
+	srv, err := NewServer("unix", stale)
+	require.NoError(t, err)
+	startServer(t, srv)
+	defer func(srv Server) {
+		_ = srv.Close()
+	}(srv)
+	assert.ErrorIs(t, removeStaleSocket(stale), syscall.EADDRINUSE)
+	second, err := NewServer("unix", stale)
+	require.NoError(t, err)
+	assert.Error(t, second.Run(context.Background(), make(chan struct{})))
+	client, err := NewClient("unix", stale)
+	require.NoError(t, err)
+	require.NoError(t, client.Connect(), "the first server still owns the socket")
+	_ = client.Close()
+}